@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/PlayEconomy37/Play.Common/types"
+)
+
+// Generic helper for sending JSON-formatted error
+// messages to the client with a given status code
+func (app *Application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
+	env := types.Envelope{"error": message}
+
+	err := app.WriteJSON(w, status, env, nil)
+	if err != nil {
+		app.Logger.Error(err, map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+		})
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// preconditionFailedResponse will be used to send a 412 Precondition Failed status code when the If-Match header
+// of a request does not match the current version of a resource
+func (app *Application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource was modified since you last retrieved it, please retrieve it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// idempotencyKeyInUseResponse will be used to send a 409 Conflict status code when a request is sent
+// while another request with the same idempotency key is still being processed
+func (app *Application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// inactiveAccountResponse will be used to send a 403 Forbidden status code when the user account
+// of the authenticated user was deactivated
+func (app *Application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
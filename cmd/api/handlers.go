@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/PlayEconomy37/Play.Common/database"
@@ -10,6 +13,7 @@ import (
 	"github.com/PlayEconomy37/Play.Common/types"
 	"github.com/PlayEconomy37/Play.Common/validator"
 	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/go-chi/chi/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.opentelemetry.io/otel/attribute"
@@ -22,22 +26,37 @@ func (app *Application) healthCheckHandler(w http.ResponseWriter, r *http.Reques
 		"status": "available",
 	}
 
+	// Report the state of our connection to the message broker. The service keeps serving
+	// requests while disconnected, but messages are neither consumed nor published.
+	if app.MessageBroker != nil {
+		if app.MessageBroker.IsConnected() {
+			env["messageBroker"] = "connected"
+		} else {
+			env["status"] = "degraded"
+			env["messageBroker"] = "disconnected"
+		}
+	}
+
 	err := app.WriteJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 	}
 }
 
-// getInventoryItemsHandler is the handler for the "GET /items" endpoint
+// getInventoryItemsHandler is the handler for the "GET /items" endpoint.
+// It lists the inventory of any user and requires the "inventory:admin" permission,
+// even to list the inventory of the authenticated user, which is listed by "GET /items/me".
 func (app *Application) getInventoryItemsHandler(w http.ResponseWriter, r *http.Request) {
 	// Create trace for the handler
 	ctx, span := app.Tracer.Start(r.Context(), "Retrieving inventory items")
 	defer span.End()
 
-	// Anonymous struct used to hold the expected values from the request's query string
-	var input struct {
-		userID int64
-		filters.Filters
+	// Check that the user is allowed to read the inventory of any user before reading the query,
+	// so that users without permission do not learn how it is validated
+	if !app.ContextGetUser(r).GetPermissions().Include("inventory:admin") {
+		span.SetStatus(codes.Error, "User is not allowed to read the inventory of other users")
+		app.NotPermittedResponse(w, r)
+		return
 	}
 
 	// Instantiate validator
@@ -46,18 +65,58 @@ func (app *Application) getInventoryItemsHandler(w http.ResponseWriter, r *http.
 	// Read query string
 	queryString := r.URL.Query()
 
-	// Extract values from query string if they exist
-	input.userID = int64(app.ReadIntFromQueryString(queryString, "user_id", 0, v))
-	input.Filters.Page = app.ReadIntFromQueryString(queryString, "page", 1, v)
-	input.Filters.PageSize = app.ReadIntFromQueryString(queryString, "page_size", 20, v)
-	input.Filters.Sort = app.ReadStringFromQueryString(queryString, "sort", "_id")
+	// Extract and validate values from query string if they exist
+	userID := int64(app.ReadIntFromQueryString(queryString, "user_id", 0, v))
+	query := app.readInventoryItemsQuery(queryString, v)
+
+	v.Check(userID > 0, "user_id", "must be greater than 0")
+
+	// Check the Validator instance for any errors
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("userID", userID))
+
+	// Retrieve inventory items
+	env, err := app.searchInventoryItems(ctx, userID, query)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			app.FailedValidationResponse(w, r, map[string]string{"cursor": "is invalid or does not match sort"})
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Send back response
+	err = app.WriteJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// getMyInventoryItemsHandler is the handler for the "GET /items/me" endpoint.
+// It lists the inventory of the authenticated user.
+func (app *Application) getMyInventoryItemsHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Retrieving inventory items of authenticated user")
+	defer span.End()
 
-	// Add the supported sort values for this endpoint to the sort safelist
-	input.Filters.SortSafelist = []string{"_id", "quantity", "acquiredDate", "-_id", "-quantity", "-acquiredDate"}
+	// Instantiate validator
+	v := validator.New()
 
-	// Validate user id and filters
-	v.Check(input.userID > 0, "user_id", "must be greater than 0")
-	filters.ValidateFilters(v, input.Filters)
+	// Extract and validate values from query string if they exist
+	query := app.readInventoryItemsQuery(r.URL.Query(), v)
 
 	// Check the Validator instance for any errors
 	if v.HasErrors() {
@@ -66,74 +125,228 @@ func (app *Application) getInventoryItemsHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	span.SetAttributes(attribute.Int64("userID", input.userID))
+	user := app.ContextGetUser(r)
 
-	// Set filter
-	filter := bson.M{}
+	span.SetAttributes(attribute.Int64("userID", user.ID))
+
+	// Retrieve inventory items
+	env, err := app.searchInventoryItems(ctx, user.ID, query)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			app.FailedValidationResponse(w, r, map[string]string{"cursor": "is invalid or does not match sort"})
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Send back response
+	err = app.WriteJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// getInventoryItemHandler is the handler for the "GET /items/{id}" endpoint.
+// Users can only read their own inventory items unless they have the "inventory:admin" permission.
+func (app *Application) getInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Retrieving inventory item by id")
+	defer span.End()
+
+	// Read id from URL
+	id, err := app.ReadObjectIDParam(r)
+	if err != nil {
+		span.SetStatus(codes.Error, "Invalid id")
+		app.NotFoundResponse(w, r)
+		return
+	}
+
+	span.SetAttributes(attribute.String("id", id.Hex()))
+
+	// Retrieve inventory item along with the details of its catalog item
+	item, err := app.InventoryItemsRepository.GetWithCatalogItem(ctx, bson.M{"_id": id})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
 
-	filter["user_id"] = bson.M{"$eq": input.userID}
+	// Check that the user is allowed to read this inventory item
+	if !canAccessInventory(app.ContextGetUser(r), item.UserID) {
+		span.SetStatus(codes.Error, "User is not allowed to read this inventory item")
+		app.NotPermittedResponse(w, r)
+		return
+	}
 
-	// Retrieve all inventory items
-	inventoryItems, metadata, err := app.InventoryItemsRepository.GetAll(ctx, filter, input.Filters)
+	// Send back response along with the entity tag of the inventory item
+	headers := make(http.Header)
+	headers.Set("ETag", inventoryItemETag(item.ID, item.Version))
+
+	err = app.WriteJSON(w, http.StatusOK, types.Envelope{"item": item}, headers)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// getUserInventoryItemHandler is the handler for the "GET /users/{userID}/items/{catalogItemID}" endpoint.
+// Users can only read their own inventory items unless they have the "inventory:admin" permission.
+func (app *Application) getUserInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Retrieving inventory item by user and catalog item")
+	defer span.End()
+
+	// Read user id and catalog item id from URL
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID < 1 {
+		span.SetStatus(codes.Error, "Invalid user id")
+		app.NotFoundResponse(w, r)
+		return
+	}
+
+	catalogItemID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "catalogItemID"))
+	if err != nil {
+		span.SetStatus(codes.Error, "Invalid catalog item id")
+		app.NotFoundResponse(w, r)
 		return
 	}
 
-	// Collect catalog item ids from inventory items
-	var itemIds []primitive.ObjectID
+	span.SetAttributes(attribute.Int64("userID", userID), attribute.String("catalogItemID", catalogItemID.Hex()))
 
-	for _, item := range inventoryItems {
-		itemIds = append(itemIds, item.CatalogItemID)
+	// Check that the user is allowed to read the requested inventory
+	if !canAccessInventory(app.ContextGetUser(r), userID) {
+		span.SetStatus(codes.Error, "User is not allowed to read this inventory")
+		app.NotPermittedResponse(w, r)
+		return
 	}
 
 	// Set filter
-	filter = bson.M{}
+	filter := bson.M{}
 
-	filter["_id"] = bson.M{"$in": itemIds}
+	filter["user_id"] = userID
+	filter["catalog_item_id"] = catalogItemID
 
-	// Retrieve all catalog items using collected item ids.
-	// We use default filters otherwise this causes unexpected errors.
-	catalogItems, _, err := app.CatalogItemsRepository.GetAll(ctx, filter, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id"}})
+	// Retrieve inventory item along with the details of its catalog item
+	item, err := app.InventoryItemsRepository.GetWithCatalogItem(ctx, filter)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		app.ServerErrorResponse(w, r, err)
+
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
 		return
 	}
 
-	type fullInventoryItem struct {
-		ID            primitive.ObjectID `json:"id"`
-		UserID        int64              `json:"userID"`
-		CatalogItemID primitive.ObjectID `json:"catalogItemID"`
-		Name          string             `json:"name"`
-		Description   string             `json:"description"`
-		Quantity      int64              `json:"quantity"`
+	// Send back response along with the entity tag of the inventory item
+	headers := make(http.Header)
+	headers.Set("ETag", inventoryItemETag(item.ID, item.Version))
+
+	err = app.WriteJSON(w, http.StatusOK, types.Envelope{"item": item}, headers)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
 	}
+}
 
-	var items []fullInventoryItem
+// getInventoryHistoryHandler is the handler for the "GET /items/history" endpoint.
+// It lists the ledger entries recording the quantity changes of the inventory of an user, which defaults to the authenticated user.
+// Users can only read their own history unless they have the "inventory:admin" permission.
+func (app *Application) getInventoryHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Retrieving inventory history")
+	defer span.End()
 
-	for _, inventoryItem := range inventoryItems {
-		for _, catalogItem := range catalogItems {
-			if catalogItem.ID == inventoryItem.CatalogItemID {
-				item := fullInventoryItem{
-					Name:          catalogItem.Name,
-					Description:   catalogItem.Description,
-					ID:            inventoryItem.ID,
-					UserID:        inventoryItem.UserID,
-					CatalogItemID: inventoryItem.CatalogItemID,
-					Quantity:      inventoryItem.Quantity,
-				}
+	// Instantiate validator
+	v := validator.New()
 
-				items = append(items, item)
-			}
+	// Read query string
+	queryString := r.URL.Query()
+
+	// Extract and validate values from query string if they exist
+	userID := int64(app.ReadIntFromQueryString(queryString, "user_id", int(app.ContextGetUser(r).ID), v))
+
+	var catalogItemID primitive.ObjectID
+
+	if value := queryString.Get("catalog_item_id"); value != "" {
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			v.AddError("catalog_item_id", "must be a valid id")
 		}
+
+		catalogItemID = id
+	}
+
+	input := filters.Filters{
+		Page:     app.ReadIntFromQueryString(queryString, "page", 1, v),
+		PageSize: app.ReadIntFromQueryString(queryString, "page_size", 20, v),
+		Sort:     app.ReadStringFromQueryString(queryString, "sort", "-_id"),
+		// Supported sort values for ledger entries
+		SortSafelist: []string{"_id", "-_id"},
+	}
+
+	v.Check(userID > 0, "user_id", "must be greater than 0")
+	filters.ValidateFilters(v, input)
+
+	// Check the Validator instance for any errors
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("userID", userID))
+
+	// Check that the user is allowed to read the requested inventory
+	if !canAccessInventory(app.ContextGetUser(r), userID) {
+		span.SetStatus(codes.Error, "User is not allowed to read this inventory")
+		app.NotPermittedResponse(w, r)
+		return
+	}
+
+	// Set filter
+	filter := bson.M{}
+
+	filter["user_id"] = userID
+
+	if !catalogItemID.IsZero() {
+		span.SetAttributes(attribute.String("catalogItemID", catalogItemID.Hex()))
+		filter["catalog_item_id"] = catalogItemID
+	}
+
+	// Retrieve ledger entries
+	entries, metadata, err := app.LedgerEntriesRepository.GetAll(ctx, filter, input)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+		return
 	}
 
 	env := types.Envelope{
-		"items":    items,
+		"entries":  entries,
 		"metadata": metadata,
 	}
 
@@ -158,6 +371,8 @@ func (app *Application) grantItemsHandler(w http.ResponseWriter, r *http.Request
 		UserID        int64              `json:"userID"`
 		CatalogItemID primitive.ObjectID `json:"catalogItemID"`
 		Quantity      int64              `json:"quantity"`
+		ExpiresAt     time.Time          `json:"expiresAt"`
+		AllowPartial  bool               `json:"allowPartial"`
 	}
 
 	// Read request body and decode it into the input struct
@@ -176,7 +391,6 @@ func (app *Application) grantItemsHandler(w http.ResponseWriter, r *http.Request
 		Quantity:      input.Quantity,
 		Version:       1,
 		AcquiredDate:  time.Now().UTC(),
-		MessageIds:    []primitive.ObjectID{},
 	}
 
 	// Initialize a new Validator instance
@@ -184,6 +398,18 @@ func (app *Application) grantItemsHandler(w http.ResponseWriter, r *http.Request
 
 	// Perform validation checks
 	data.ValidateInventoryItem(v, item)
+	data.ValidateExpiry(v, input.ExpiresAt, time.Now())
+
+	// Check that the user and the catalog item exist
+	if !v.HasErrors() {
+		err = app.newGrantReferences().Check(ctx, v, item)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
 
 	if v.HasErrors() {
 		span.SetStatus(codes.Error, "Validation failed")
@@ -198,56 +424,1011 @@ func (app *Application) grantItemsHandler(w http.ResponseWriter, r *http.Request
 		attribute.Int64("quantity", item.Quantity),
 	)
 
-	// Set filters
-	filter := bson.M{}
+	if !input.ExpiresAt.IsZero() {
+		span.SetAttributes(attribute.String("expiresAt", input.ExpiresAt.Format(time.RFC3339)))
+	}
 
-	filter["user_id"] = bson.M{"$eq": item.UserID}
-	filter["catalog_item_id"] = bson.M{"$eq": item.CatalogItemID}
+	// Read the optional If-Match header
+	precondition, ok := readIfMatchHeader(r)
+	if !ok {
+		span.SetStatus(codes.Error, "Precondition failed")
+		app.preconditionFailedResponse(w, r)
+		return
+	}
 
-	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(ctx, filter)
+	// Increment the quantity of the inventory item, creating it if needed.
+	// Time-limited items are granted in their own lot.
+	// Only part of the items may be granted when the client allows it.
+	grantedItem, grantedQuantity, err := app.InventoryItemsRepository.Grant(
+		ctx,
+		item.UserID,
+		item.CatalogItemID,
+		item.Quantity,
+		input.ExpiresAt,
+		app.httpSource(r),
+		precondition,
+		input.AllowPartial,
+	)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 
 		switch {
-		case errors.Is(err, database.ErrRecordNotFound):
-			break
+		case errors.Is(err, data.ErrPreconditionFailed):
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrIdempotencyKeyLost):
+			// A retry of the request took its idempotency key over since we did not grant the items in time
+			app.idempotencyKeyInUseResponse(w, r)
+		case addInventoryLimitError(v, err):
+			app.FailedValidationResponse(w, r, v.Errors)
 		default:
 			app.ServerErrorResponse(w, r, err)
-			return
 		}
+
+		return
 	}
 
-	if inventoryItem.ID == primitive.NilObjectID {
-		// Create a record in the database
-		_, err := app.InventoryItemsRepository.Create(ctx, item)
-		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			app.ServerErrorResponse(w, r, err)
-			return
-		}
-	} else {
-		// Update record in the database
-		inventoryItem.Quantity = inventoryItem.Quantity + item.Quantity
+	// The items are granted even if we fail to send the response
+	markCommitted(r)
 
-		err = app.InventoryItemsRepository.Update(ctx, inventoryItem)
-		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(attribute.Int64("grantedQuantity", grantedQuantity))
+
+	env := types.Envelope{
+		"message":         "Item granted successfully",
+		"grantedQuantity": grantedQuantity,
+	}
+
+	// Send back the entity tag of the updated inventory item
+	headers := make(http.Header)
+	headers.Set("ETag", inventoryItemETag(grantedItem.ID, grantedItem.Version))
+
+	err = app.WriteJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// subtractItemsHandler is the handler for the "POST /items/subtract" endpoint
+func (app *Application) subtractItemsHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Subtracting inventory items")
+	defer span.End()
+
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// request body. This struct will be our *target decode destination*
+	var input struct {
+		UserID        int64              `json:"userID"`
+		CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+		Quantity      int64              `json:"quantity"`
+	}
+
+	// Read request body and decode it into the input struct
+	err := app.ReadJSON(w, r, &input)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	// Copy the values from the input struct to a new Item struct
+	item := data.InventoryItem{
+		UserID:        input.UserID,
+		CatalogItemID: input.CatalogItemID,
+		Quantity:      input.Quantity,
+	}
+
+	// Initialize a new Validator instance
+	v := validator.New()
+
+	// Perform validation checks
+	data.ValidateInventoryItem(v, item)
+
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Record item attributes in trace
+	span.SetAttributes(
+		attribute.Int64("userID", item.UserID),
+		attribute.String("catalogItemID", item.CatalogItemID.Hex()),
+		attribute.Int64("quantity", item.Quantity),
+	)
+
+	// Read the optional If-Match header
+	precondition, ok := readIfMatchHeader(r)
+	if !ok {
+		span.SetStatus(codes.Error, "Precondition failed")
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	// Decrement the quantity of the inventory item, deleting it if none is left
+	remainingItem, err := app.InventoryItemsRepository.Subtract(ctx, item.UserID, item.CatalogItemID, item.Quantity, data.HTTPSource(app.ContextGetUser(r).ID), precondition)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrPreconditionFailed):
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrInsufficientQuantity):
+			v.AddError("quantity", "must not exceed the quantity owned by the user")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
 			app.ServerErrorResponse(w, r, err)
-			return
 		}
+
+		return
 	}
 
 	env := types.Envelope{
-		"message": "Item granted successfully",
+		"message":  "Item subtracted successfully",
+		"quantity": remainingItem.Quantity,
 	}
 
-	err = app.WriteJSON(w, http.StatusOK, env, nil)
+	// Send back the entity tag of the updated inventory item, unless it was deleted
+	headers := make(http.Header)
+	if remainingItem.Quantity > 0 {
+		headers.Set("ETag", inventoryItemETag(remainingItem.ID, remainingItem.Version))
+	}
+
+	err = app.WriteJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		app.ServerErrorResponse(w, r, err)
 	}
 }
+
+// batchGrantItemsHandler grants many inventory items at once. In the "atomic" mode, either every inventory item
+// is granted or none is. In the "bestEffort" mode, every valid inventory item which can be granted is granted.
+// The response reports the result of every inventory item of the request.
+func (app *Application) batchGrantItemsHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Granting inventory items in batch")
+	defer span.End()
+
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// request body. This struct will be our *target decode destination*
+	var input struct {
+		Mode         string `json:"mode"`
+		AllowPartial bool   `json:"allowPartial"`
+		Items        []struct {
+			UserID        int64              `json:"userID"`
+			CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+			Quantity      int64              `json:"quantity"`
+			ExpiresAt     time.Time          `json:"expiresAt"`
+		} `json:"items"`
+	}
+
+	// Read request body and decode it into the input struct
+	err := app.ReadJSON(w, r, &input)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	// Batches are atomic by default
+	if input.Mode == "" {
+		input.Mode = batchModeAtomic
+	}
+
+	// Initialize a new Validator instance
+	v := validator.New()
+
+	// Perform validation checks on the batch
+	v.Check(validator.In(input.Mode, batchModeAtomic, batchModeBestEffort), "mode", "must be either atomic or bestEffort")
+	v.Check(len(input.Items) > 0, "items", "must contain at least one item")
+	v.Check(len(input.Items) <= maxBatchSize, "items", "must not contain more than 1000 items")
+
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Record batch attributes in trace
+	span.SetAttributes(
+		attribute.String("mode", input.Mode),
+		attribute.Int("items", len(input.Items)),
+	)
+
+	// Perform validation checks on every inventory item, and check that their users and catalog items exist.
+	// Only valid inventory items are granted.
+	results := make([]batchGrantResult, len(input.Items))
+	items := []data.InventoryItem{}
+	itemIndexes := []int{}
+	refs := app.newGrantReferences()
+
+	for i, inputItem := range input.Items {
+		item := data.InventoryItem{
+			UserID:        inputItem.UserID,
+			CatalogItemID: inputItem.CatalogItemID,
+			Quantity:      inputItem.Quantity,
+		}
+
+		// Time-limited items are granted in a lot holding their whole quantity
+		if !inputItem.ExpiresAt.IsZero() {
+			item.Lots = []data.InventoryLot{{Quantity: item.Quantity, ExpiresAt: inputItem.ExpiresAt.UTC()}}
+		}
+
+		itemValidator := validator.New()
+		data.ValidateInventoryItem(itemValidator, item)
+		data.ValidateExpiry(itemValidator, inputItem.ExpiresAt, time.Now())
+
+		if !itemValidator.HasErrors() {
+			err = refs.Check(ctx, itemValidator, item)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				app.ServerErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		results[i].Index = i
+
+		if itemValidator.HasErrors() {
+			results[i].Status = batchStatusInvalid
+			results[i].Errors = itemValidator.Errors
+			continue
+		}
+
+		items = append(items, item)
+		itemIndexes = append(itemIndexes, i)
+	}
+
+	atomic := input.Mode == batchModeAtomic
+
+	// Atomic batches are rejected as a whole if any of their inventory items is invalid
+	if atomic && len(items) != len(input.Items) {
+		for _, i := range itemIndexes {
+			results[i].Status = batchStatusSkipped
+		}
+
+		span.SetStatus(codes.Error, "Validation failed")
+
+		env := types.Envelope{
+			"error":   "the batch contains invalid items, no item was granted",
+			"results": results,
+		}
+
+		err = app.WriteJSON(w, http.StatusUnprocessableEntity, env, nil)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Grant the valid inventory items.
+	// Only part of the items may be granted when the client allows it.
+	grantedQuantities := make([]int64, len(items))
+	itemErrors := make([]error, len(items))
+
+	if len(items) != 0 {
+		grantedQuantities, itemErrors, err = app.InventoryItemsRepository.GrantMany(
+			ctx,
+			items,
+			atomic,
+			input.AllowPartial,
+			app.httpSource(r),
+		)
+
+		// Atomic batches are rejected as a whole if any of their inventory items exceeds the limits of inventories
+		if errors.Is(err, data.ErrBatchRejected) {
+			for j, i := range itemIndexes {
+				itemValidator := validator.New()
+
+				if addInventoryLimitError(itemValidator, itemErrors[j]) {
+					results[i].Status = batchStatusInvalid
+					results[i].Errors = itemValidator.Errors
+					continue
+				}
+
+				results[i].Status = batchStatusSkipped
+			}
+
+			span.SetStatus(codes.Error, "Validation failed")
+
+			env := types.Envelope{
+				"error":   "the batch exceeds the limits of inventories, no item was granted",
+				"results": results,
+			}
+
+			err = app.WriteJSON(w, http.StatusUnprocessableEntity, env, nil)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				app.ServerErrorResponse(w, r, err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			// A retry of the request took its idempotency key over since we did not grant the items in time
+			if errors.Is(err, data.ErrIdempotencyKeyLost) {
+				app.idempotencyKeyInUseResponse(w, r)
+				return
+			}
+
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		// The items are granted even if we fail to send the response
+		markCommitted(r)
+	}
+
+	for j, i := range itemIndexes {
+		// Inventory items exceeding the limits of inventories are invalid
+		itemValidator := validator.New()
+
+		if addInventoryLimitError(itemValidator, itemErrors[j]) {
+			results[i].Status = batchStatusInvalid
+			results[i].Errors = itemValidator.Errors
+			continue
+		}
+
+		if itemErrors[j] != nil {
+			// We log the error since we do not expose it
+			span.RecordError(itemErrors[j])
+			app.Logger.Error(itemErrors[j], map[string]string{
+				"request_method": r.Method,
+				"request_url":    r.URL.String(),
+				"item_index":     strconv.Itoa(i),
+			})
+
+			results[i].Status = batchStatusFailed
+			results[i].Error = "could not be granted"
+			continue
+		}
+
+		results[i].Status = batchStatusGranted
+		results[i].GrantedQuantity = grantedQuantities[j]
+	}
+
+	err = app.WriteJSON(w, http.StatusOK, types.Envelope{"results": results}, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// createTransferHandler moves a quantity of a catalog item from the inventory of one user to the inventory of another user.
+// Users can give their own items, and users with the "inventory:admin" permission can transfer items of any user.
+func (app *Application) createTransferHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Transferring inventory items")
+	defer span.End()
+
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// request body. This struct will be our *target decode destination*
+	var input struct {
+		FromUserID    int64              `json:"fromUserID"`
+		ToUserID      int64              `json:"toUserID"`
+		CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+		Quantity      int64              `json:"quantity"`
+	}
+
+	// Read request body and decode it into the input struct
+	err := app.ReadJSON(w, r, &input)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.ContextGetUser(r)
+
+	// Copy the values from the input struct to a new Transfer struct
+	transfer := data.Transfer{
+		FromUserID:    input.FromUserID,
+		ToUserID:      input.ToUserID,
+		CatalogItemID: input.CatalogItemID,
+		Quantity:      input.Quantity,
+		InitiatedBy:   user.ID,
+	}
+
+	// Initialize a new Validator instance
+	v := validator.New()
+
+	// Perform validation checks
+	data.ValidateTransfer(v, transfer)
+
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Record transfer attributes in trace
+	span.SetAttributes(
+		attribute.Int64("fromUserID", transfer.FromUserID),
+		attribute.Int64("toUserID", transfer.ToUserID),
+		attribute.String("catalogItemID", transfer.CatalogItemID.Hex()),
+		attribute.Int64("quantity", transfer.Quantity),
+	)
+
+	// Users can only give items they own
+	if !canAccessInventory(user, transfer.FromUserID) {
+		span.SetStatus(codes.Error, "User not permitted")
+		app.NotPermittedResponse(w, r)
+		return
+	}
+
+	// Check that the target user exists and is activated
+	toUser, err := app.UsersRepository.GetByID(ctx, transfer.ToUserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("toUserID", "must be an existing user")
+		default:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	} else if !toUser.Activated {
+		v.AddError("toUserID", "must be an activated user")
+	}
+
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Read the optional If-Match header, which applies to the inventory item of the source user
+	precondition, ok := readIfMatchHeader(r)
+	if !ok {
+		span.SetStatus(codes.Error, "Precondition failed")
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	// Move the items and record the transfer
+	err = app.InventoryItemsRepository.Transfer(ctx, &transfer, precondition)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrPreconditionFailed):
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrInsufficientQuantity):
+			v.AddError("quantity", "must not exceed the quantity owned by the user")
+			app.FailedValidationResponse(w, r, v.Errors)
+		case addInventoryLimitError(v, err):
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.WriteJSON(w, http.StatusCreated, types.Envelope{"transfer": transfer}, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// createReservationHandler holds a quantity of a catalog item in the inventory of an user while a deal is pending.
+// The reservation expires after the given number of seconds unless it is confirmed or released before.
+func (app *Application) createReservationHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Reserving inventory items")
+	defer span.End()
+
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// request body. This struct will be our *target decode destination*
+	var input struct {
+		UserID        int64              `json:"userID"`
+		CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+		Quantity      int64              `json:"quantity"`
+		ExpiresIn     *int64             `json:"expiresIn"`
+	}
+
+	// Read request body and decode it into the input struct
+	err := app.ReadJSON(w, r, &input)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	duration := data.DefaultReservationDuration
+	if input.ExpiresIn != nil {
+		duration = time.Duration(*input.ExpiresIn) * time.Second
+	}
+
+	// Copy the values from the input struct to a new Reservation struct
+	now := time.Now().UTC()
+
+	reservation := data.Reservation{
+		UserID:        input.UserID,
+		CatalogItemID: input.CatalogItemID,
+		Quantity:      input.Quantity,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(duration),
+	}
+
+	// Initialize a new Validator instance
+	v := validator.New()
+
+	// Perform validation checks
+	data.ValidateReservation(v, reservation)
+	v.Check(duration > 0, "expiresIn", "must be greater than 0")
+	v.Check(duration <= data.MaxReservationDuration, "expiresIn", "must not be more than 86400 seconds")
+
+	if v.HasErrors() {
+		span.SetStatus(codes.Error, "Validation failed")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Record reservation attributes in trace
+	span.SetAttributes(
+		attribute.Int64("userID", reservation.UserID),
+		attribute.String("catalogItemID", reservation.CatalogItemID.Hex()),
+		attribute.Int64("quantity", reservation.Quantity),
+	)
+
+	// Users can only reserve items they own
+	if !canAccessInventory(app.ContextGetUser(r), reservation.UserID) {
+		span.SetStatus(codes.Error, "User not permitted")
+		app.NotPermittedResponse(w, r)
+		return
+	}
+
+	err = app.InventoryItemsRepository.Reserve(ctx, &reservation)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrInsufficientQuantity):
+			v.AddError("quantity", "must not exceed the available quantity owned by the user")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.WriteJSON(w, http.StatusCreated, types.Envelope{"reservation": reservation}, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// confirmReservationHandler completes a reservation by subtracting its items from the inventory of its user
+func (app *Application) confirmReservationHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Confirming reservation")
+	defer span.End()
+
+	reservation, ok := app.readReservation(ctx, w, r)
+	if !ok {
+		span.SetStatus(codes.Error, "Reservation not readable")
+		return
+	}
+
+	// Read the optional If-Match header, which applies to the inventory item of the reservation
+	precondition, ok := readIfMatchHeader(r)
+	if !ok {
+		span.SetStatus(codes.Error, "Precondition failed")
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	// Delete the reservation and subtract its items
+	_, remainingItem, err := app.InventoryItemsRepository.ConfirmReservation(ctx, reservation.ID, data.HTTPSource(app.ContextGetUser(r).ID), precondition)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, data.ErrPreconditionFailed):
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	env := types.Envelope{
+		"message":           "Reservation confirmed successfully",
+		"remainingQuantity": remainingItem.Quantity,
+	}
+
+	// Send back the entity tag of the updated inventory item, unless it was deleted
+	headers := make(http.Header)
+	if remainingItem.Quantity > 0 {
+		headers.Set("ETag", inventoryItemETag(remainingItem.ID, remainingItem.Version))
+	}
+
+	err = app.WriteJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// releaseReservationHandler cancels a reservation so that its items are available again
+func (app *Application) releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
+	// Create trace for the handler
+	ctx, span := app.Tracer.Start(r.Context(), "Releasing reservation")
+	defer span.End()
+
+	reservation, ok := app.readReservation(ctx, w, r)
+	if !ok {
+		span.SetStatus(codes.Error, "Reservation not readable")
+		return
+	}
+
+	err := app.InventoryItemsRepository.ReleaseReservation(ctx, reservation.ID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.WriteJSON(w, http.StatusOK, types.Envelope{"message": "Reservation released successfully"}, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+const (
+	// batchModeAtomic is the batch mode in which either every inventory item is granted or none is
+	batchModeAtomic = "atomic"
+
+	// batchModeBestEffort is the batch mode in which every inventory item which can be granted is granted
+	batchModeBestEffort = "bestEffort"
+
+	// maxBatchSize is the maximum number of inventory items granted by a single batch
+	maxBatchSize = 1000
+)
+
+// Statuses of the inventory items of a batch
+const (
+	batchStatusGranted = "granted"
+	batchStatusInvalid = "invalid"
+	batchStatusFailed  = "failed"
+	batchStatusSkipped = "skipped"
+)
+
+// batchGrantResult is a struct that holds the result of an inventory item of a batch grant
+type batchGrantResult struct {
+	Index           int               `json:"index"`
+	Status          string            `json:"status"`
+	GrantedQuantity int64             `json:"grantedQuantity,omitempty"`
+	Errors          map[string]string `json:"errors,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// canAccessInventory returns whether the given user is allowed to access the inventory of the user with the given id.
+// Users can access their own inventory, and users with the "inventory:admin" permission can access any inventory.
+func canAccessInventory(user database.User, userID int64) bool {
+	return user.ID == userID || user.GetPermissions().Include("inventory:admin")
+}
+
+// readReservation reads the reservation whose id is in the URL and checks that the authenticated user
+// can access it. It sends the error response and returns false if it cannot.
+func (app *Application) readReservation(ctx context.Context, w http.ResponseWriter, r *http.Request) (data.Reservation, bool) {
+	id, err := app.ReadObjectIDParam(r)
+	if err != nil {
+		app.NotFoundResponse(w, r)
+		return data.Reservation{}, false
+	}
+
+	reservation, err := app.ReservationsRepository.Get(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+
+		return reservation, false
+	}
+
+	if !canAccessInventory(app.ContextGetUser(r), reservation.UserID) {
+		app.NotPermittedResponse(w, r)
+		return reservation, false
+	}
+
+	return reservation, true
+}
+
+// inventoryItemsQuery is a struct that holds the values used to search and page through inventory items.
+// Zero values mean that the corresponding filter is not set.
+type inventoryItemsQuery struct {
+	name           string
+	catalogItemIDs []primitive.ObjectID
+	minQuantity    int64
+	maxQuantity    int64
+	acquiredAfter  time.Time
+	acquiredBefore time.Time
+	asOf           time.Time
+	useCursor      bool
+	cursor         string
+	filters.Filters
+}
+
+// readInventoryItemsQuery extracts the values used to search and page through inventory items
+// from the given query string and validates them
+func (app *Application) readInventoryItemsQuery(queryString url.Values, v *validator.Validator) inventoryItemsQuery {
+	var query inventoryItemsQuery
+
+	query.name = app.ReadStringFromQueryString(queryString, "name", "")
+	query.minQuantity = int64(app.ReadIntFromQueryString(queryString, "min_quantity", 0, v))
+	query.maxQuantity = int64(app.ReadIntFromQueryString(queryString, "max_quantity", 0, v))
+	query.acquiredAfter = readTimeFromQueryString(queryString, "acquired_after", v)
+	query.acquiredBefore = readTimeFromQueryString(queryString, "acquired_before", v)
+	query.asOf = readTimeFromQueryString(queryString, "as_of", v)
+
+	// Cursor based pagination is used as soon as the cursor key is set. Its value is empty for the first page.
+	query.useCursor = queryString.Has("cursor")
+	query.cursor = queryString.Get("cursor")
+
+	// Catalog item ids are given as comma separated values
+	for _, value := range app.ReadCsvFromQueryString(queryString, "catalog_item_id", []string{}) {
+		catalogItemID, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			v.AddError("catalog_item_id", "must only contain valid ids")
+			break
+		}
+
+		query.catalogItemIDs = append(query.catalogItemIDs, catalogItemID)
+	}
+
+	query.Filters = filters.Filters{
+		Page:     app.ReadIntFromQueryString(queryString, "page", 1, v),
+		PageSize: app.ReadIntFromQueryString(queryString, "page_size", 20, v),
+		Sort:     app.ReadStringFromQueryString(queryString, "sort", "_id"),
+		// Supported sort values for inventory items
+		SortSafelist: []string{"_id", "quantity", "acquiredDate", "name", "-_id", "-quantity", "-acquiredDate", "-name"},
+	}
+
+	// Validate search values and filters
+	v.Check(validator.MaxCharacters(query.name, 100), "name", "must not be more than 100 characters long")
+	v.Check(len(query.catalogItemIDs) <= 100, "catalog_item_id", "must not contain more than 100 ids")
+	v.Check(query.minQuantity >= 0, "min_quantity", "must be greater or equal to 0")
+	v.Check(query.maxQuantity >= 0, "max_quantity", "must be greater or equal to 0")
+
+	if query.minQuantity > 0 && query.maxQuantity > 0 {
+		v.Check(query.minQuantity <= query.maxQuantity, "max_quantity", "must be greater or equal to min_quantity")
+	}
+
+	if !query.acquiredAfter.IsZero() && !query.acquiredBefore.IsZero() {
+		v.Check(query.acquiredAfter.Before(query.acquiredBefore), "acquired_before", "must be later than acquired_after")
+	}
+
+	// Past inventories are recomputed from our ledger, which only supports offset based pagination
+	// and does not know when inventory items were acquired
+	if !query.asOf.IsZero() {
+		v.Check(!query.asOf.After(time.Now()), "as_of", "must not be in the future")
+		v.Check(!query.useCursor, "as_of", "must not be used along with a cursor")
+		v.Check(query.acquiredAfter.IsZero() && query.acquiredBefore.IsZero(), "as_of", "must not be used along with acquired_after or acquired_before")
+	}
+
+	filters.ValidateFilters(v, query.Filters)
+
+	if query.useCursor {
+		v.Check(query.PageSize > 0, "page_size", "must be greater than 0 when using a cursor")
+	}
+
+	return query
+}
+
+// searchInventoryItems retrieves a page of the inventory items of the given user matching the given query
+// with the search function of its pagination mode. It returns the inventory items along with their pagination
+// metadata as a response envelope.
+func (app *Application) searchInventoryItems(ctx context.Context, userID int64, query inventoryItemsQuery) (types.Envelope, error) {
+	switch {
+	case !query.asOf.IsZero():
+		items, metadata, err := app.searchInventorySnapshot(ctx, userID, query)
+		if err != nil {
+			return nil, err
+		}
+
+		return types.Envelope{"items": items, "metadata": metadata}, nil
+	case query.useCursor:
+		items, metadata, err := app.searchInventoryItemsPage(ctx, userID, query)
+		if err != nil {
+			return nil, err
+		}
+
+		return types.Envelope{"items": items, "metadata": metadata}, nil
+	default:
+		items, metadata, err := app.searchInventoryItemsOffset(ctx, userID, query)
+		if err != nil {
+			return nil, err
+		}
+
+		return types.Envelope{"items": items, "metadata": metadata}, nil
+	}
+}
+
+// searchInventoryItemsOffset retrieves a page of the inventory items of the given user matching the given query
+// using offset based pagination
+func (app *Application) searchInventoryItemsOffset(
+	ctx context.Context,
+	userID int64,
+	query inventoryItemsQuery,
+) ([]data.FullInventoryItem, filters.Metadata, error) {
+	filter, err := app.inventoryItemsFilter(ctx, userID, query)
+	if err != nil {
+		return nil, filters.Metadata{}, err
+	}
+
+	return app.InventoryItemsRepository.GetAllWithCatalogItems(ctx, filter, query.Filters)
+}
+
+// searchInventoryItemsPage retrieves a page of the inventory items of the given user matching the given query
+// using cursor based pagination
+func (app *Application) searchInventoryItemsPage(
+	ctx context.Context,
+	userID int64,
+	query inventoryItemsQuery,
+) ([]data.FullInventoryItem, data.CursorMetadata, error) {
+	filter, err := app.inventoryItemsFilter(ctx, userID, query)
+	if err != nil {
+		return nil, data.CursorMetadata{}, err
+	}
+
+	return app.InventoryItemsRepository.GetPageWithCatalogItems(ctx, filter, query.Filters, query.cursor)
+}
+
+// searchInventorySnapshot retrieves a page of the inventory items the given user owned at the date of the given
+// query from our ledger. The catalog item conditions select the ledger entries to replay and the quantity conditions
+// select the recomputed inventory items.
+func (app *Application) searchInventorySnapshot(
+	ctx context.Context,
+	userID int64,
+	query inventoryItemsQuery,
+) ([]data.InventoryItemSnapshot, filters.Metadata, error) {
+	entriesFilter, err := app.catalogItemsFilter(ctx, userID, query)
+	if err != nil {
+		return nil, filters.Metadata{}, err
+	}
+
+	snapshotFilter := bson.M{}
+
+	if quantity := query.quantityCondition(); len(quantity) != 0 {
+		snapshotFilter["quantity"] = quantity
+	}
+
+	return app.LedgerEntriesRepository.GetSnapshot(ctx, userID, query.asOf, entriesFilter, snapshotFilter, query.Filters)
+}
+
+// inventoryItemsFilter returns the filter which selects the inventory items of the given user matching the given query
+func (app *Application) inventoryItemsFilter(ctx context.Context, userID int64, query inventoryItemsQuery) (bson.M, error) {
+	filter, err := app.catalogItemsFilter(ctx, userID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if quantity := query.quantityCondition(); len(quantity) != 0 {
+		filter["quantity"] = quantity
+	}
+
+	acquiredDate := bson.M{}
+
+	if !query.acquiredAfter.IsZero() {
+		acquiredDate["$gt"] = query.acquiredAfter
+	}
+
+	if !query.acquiredBefore.IsZero() {
+		acquiredDate["$lt"] = query.acquiredBefore
+	}
+
+	if len(acquiredDate) != 0 {
+		filter["acquired_date"] = acquiredDate
+	}
+
+	return filter, nil
+}
+
+// catalogItemsFilter returns the filter which selects the documents of the given user whose catalog item
+// matches the catalog item ids and the name of the given query
+func (app *Application) catalogItemsFilter(ctx context.Context, userID int64, query inventoryItemsQuery) (bson.M, error) {
+	filter := bson.M{
+		"user_id": userID,
+	}
+
+	// Both catalog item conditions must hold when searching by ids and by name
+	var catalogItemConditions bson.A
+
+	if len(query.catalogItemIDs) != 0 {
+		catalogItemConditions = append(catalogItemConditions, bson.M{"catalog_item_id": bson.M{"$in": query.catalogItemIDs}})
+	}
+
+	if query.name != "" {
+		catalogItemIDs, err := app.CatalogItemsRepository.SearchIDsByName(ctx, query.name)
+		if err != nil {
+			return nil, err
+		}
+
+		catalogItemConditions = append(catalogItemConditions, bson.M{"catalog_item_id": bson.M{"$in": catalogItemIDs}})
+	}
+
+	if len(catalogItemConditions) != 0 {
+		filter["$and"] = catalogItemConditions
+	}
+
+	return filter, nil
+}
+
+// quantityCondition returns the condition on the quantity of inventory items set by the query,
+// which is empty if the query does not set any
+func (query inventoryItemsQuery) quantityCondition() bson.M {
+	quantity := bson.M{}
+
+	if query.minQuantity > 0 {
+		quantity["$gte"] = query.minQuantity
+	}
+
+	if query.maxQuantity > 0 {
+		quantity["$lte"] = query.maxQuantity
+	}
+
+	return quantity
+}
+
+// readTimeFromQueryString reads a RFC 3339 date from the query string. If no matching key could be found
+// it returns the zero time. If the value couldn't be parsed, then we record an error message in the provided Validator instance.
+func readTimeFromQueryString(queryString url.Values, key string, v *validator.Validator) time.Time {
+	str := queryString.Get(key)
+
+	if str == "" {
+		return time.Time{}
+	}
+
+	value, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		v.AddError(key, "must be a RFC 3339 date (i.e. 2006-01-02T15:04:05Z)")
+		return time.Time{}
+	}
+
+	return value
+}
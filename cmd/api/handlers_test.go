@@ -3,12 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/PlayEconomy37/Play.Common/database"
 	"github.com/PlayEconomy37/Play.Common/filters"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -29,6 +36,35 @@ func TestHealthCheckHandler(t *testing.T) {
 	if !bytes.Contains(resBody, []byte("available")) {
 		t.Errorf("want body %q to contain %q", []byte("available"), resBody)
 	}
+
+	// -----------------------------
+
+	messageBrokerTests := []struct {
+		testName           string
+		connected          bool
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Connected to message broker", true, http.StatusOK, []byte(`"messageBroker": "connected"`)},
+		{"Disconnected from message broker", false, http.StatusOK, []byte(`"messageBroker": "disconnected"`)},
+		{"Degraded while disconnected from message broker", false, http.StatusOK, []byte("degraded")},
+	}
+
+	for _, tt := range messageBrokerTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			app.MessageBroker = testMessageBroker{connected: tt.connected}
+
+			statusCode, _, resBody := ts.get(t, "/healthcheck", false, "")
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
 }
 
 func TestGetInventoryItemsHandler(t *testing.T) {
@@ -85,6 +121,16 @@ func TestGetInventoryItemsHandler(t *testing.T) {
 		{"page greater than 10000000", "?page=10000001", http.StatusUnprocessableEntity, []byte("must be greater or equal to 0 and lower or equal to 10 million")},
 		{"page_size lower than 0", "?page_size=-1", http.StatusUnprocessableEntity, []byte("must be greater or equal to 0 and lower or equal to 100")},
 		{"page_size greater than 100", "?page_size=101", http.StatusUnprocessableEntity, []byte("must be greater or equal to 0 and lower or equal to 100")},
+		{"Invalid catalog_item_id", "?user_id=1&catalog_item_id=invalid", http.StatusUnprocessableEntity, []byte("must only contain valid ids")},
+		{"Invalid min_quantity", "?user_id=1&min_quantity=invalid", http.StatusUnprocessableEntity, []byte("must be an integer value")},
+		{"min_quantity lower than 0", "?user_id=1&min_quantity=-1", http.StatusUnprocessableEntity, []byte("must be greater or equal to 0")},
+		{"max_quantity lower than min_quantity", "?user_id=1&min_quantity=5&max_quantity=2", http.StatusUnprocessableEntity, []byte("must be greater or equal to min_quantity")},
+		{"Invalid acquired_after", "?user_id=1&acquired_after=yesterday", http.StatusUnprocessableEntity, []byte("must be a RFC 3339 date")},
+		{"acquired_before earlier than acquired_after", "?user_id=1&acquired_after=2022-01-02T00:00:00Z&acquired_before=2022-01-01T00:00:00Z", http.StatusUnprocessableEntity, []byte("must be later than acquired_after")},
+		{"Invalid as_of", "?user_id=1&as_of=yesterday", http.StatusUnprocessableEntity, []byte("must be a RFC 3339 date")},
+		{"as_of in the future", "?user_id=1&as_of=2999-01-01T00:00:00Z", http.StatusUnprocessableEntity, []byte("must not be in the future")},
+		{"as_of used along with a cursor", "?user_id=1&as_of=2022-01-01T00:00:00Z&cursor=", http.StatusUnprocessableEntity, []byte("must not be used along with a cursor")},
+		{"as_of used along with acquired_after", "?user_id=1&as_of=2022-01-02T00:00:00Z&acquired_after=2022-01-01T00:00:00Z", http.StatusUnprocessableEntity, []byte("must not be used along with acquired_after or acquired_before")},
 	}
 
 	for _, tt := range validationTests {
@@ -114,6 +160,13 @@ func TestGetInventoryItemsHandler(t *testing.T) {
 		{"user_id, page and page_size filters (page 1)", "?user_id=1&page=1&page_size=2", http.StatusOK, 2, 1, 2},
 		{"user_id, page and page_size filters (page 2)", "?user_id=1&page=2&page_size=2", http.StatusOK, 1, 2, 2},
 		{"user_id and sort filters", "?user_id=1&sort=-quantity", http.StatusOK, 3, 1, 1},
+		{"user_id and sort by name", "?user_id=1&sort=name", http.StatusOK, 3, 1, 1},
+		{"user_id and name filters", "?user_id=1&name=potion", http.StatusOK, 1, 1, 1},
+		{"user_id and catalog_item_id filters", fmt.Sprintf("?user_id=1&catalog_item_id=%s,%s", catalogItemIDs[0].Hex(), catalogItemIDs[1].Hex()), http.StatusOK, 2, 1, 1},
+		{"user_id, catalog_item_id and name filters", fmt.Sprintf("?user_id=1&catalog_item_id=%s,%s&name=ether", catalogItemIDs[0].Hex(), catalogItemIDs[1].Hex()), http.StatusOK, 1, 1, 1},
+		{"user_id, min_quantity and max_quantity filters", "?user_id=1&min_quantity=3&max_quantity=4", http.StatusOK, 1, 1, 1},
+		{"user_id and acquired_after filters", "?user_id=1&acquired_after=2000-01-01T00:00:00Z", http.StatusOK, 3, 1, 1},
+		{"user_id and acquired_before filters", "?user_id=1&acquired_before=2000-01-01T00:00:00Z", http.StatusOK, 0, 0, 0},
 	}
 
 	for _, tt := range successTests {
@@ -150,6 +203,17 @@ func TestGetInventoryItemsHandler(t *testing.T) {
 				}
 			}
 
+			if tt.testName == "user_id and sort by name" {
+				wantedNames := []string{"Antidote", "Ether", "Potion"}
+
+				for i, wantedName := range wantedNames {
+					item := (items[i]).(map[string]any)
+					if item["name"] != wantedName {
+						t.Errorf("want to receive %s but got %s", wantedName, item["name"])
+					}
+				}
+			}
+
 			if len(items) != tt.expectedTotalRecords {
 				t.Errorf("want to receive %d items but got %d", tt.expectedTotalRecords, len(items))
 			}
@@ -169,71 +233,93 @@ func TestGetInventoryItemsHandler(t *testing.T) {
 			}
 		})
 	}
-}
 
-func TestGrantItemsHandler(t *testing.T) {
-	app, cleanup, catalogItemIDs := newTestApplication(t)
-	t.Cleanup(cleanup)
+	// -----------------------------
 
-	ts := newTestServer(t, app.routes())
-	defer ts.Close()
+	// Give the inventory items of user 1 distinct acquisition dates: Potion, then Ether, then Antidote
+	for i, catalogItemID := range catalogItemIDs[:3] {
+		item, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemID})
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	authenticationTests := []struct {
-		testName           string
-		useAuthHeader      bool
-		accessToken        string
-		wantedStatusCode   int
-		wantedResponseBody []byte
+		item.AcquiredDate = time.Date(2022, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC)
+
+		err = app.InventoryItemsRepository.Update(context.Background(), item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Items are sorted by name: Antidote, Ether, Potion
+	filterTests := []struct {
+		testName             string
+		queryString          string
+		wantedCatalogItemIDs []primitive.ObjectID
 	}{
-		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
-		{"Invalid access token", true, "invalid", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
-		{"Access token not generated by identity microservice", true, invalidAccessToken, http.StatusUnauthorized, []byte("invalid or missing authentication token")},
-		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
-		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Name matching a word", "&name=ether", []primitive.ObjectID{catalogItemIDs[1]}},
+		{"Name matching a word ignoring case", "&name=POTION", []primitive.ObjectID{catalogItemIDs[0]}},
+		{"Name starting with prefix", "&name=anti", []primitive.ObjectID{catalogItemIDs[2]}},
+		{"Name matching nothing", "&name=elixir", []primitive.ObjectID{}},
+		{"Multiple catalog_item_id values", fmt.Sprintf("&catalog_item_id=%s,%s", catalogItemIDs[0].Hex(), catalogItemIDs[2].Hex()), []primitive.ObjectID{catalogItemIDs[2], catalogItemIDs[0]}},
+		{"catalog_item_id of an item the user does not own", fmt.Sprintf("&catalog_item_id=%s,%s", catalogItemIDs[1].Hex(), catalogItemIDs[4].Hex()), []primitive.ObjectID{catalogItemIDs[1]}},
+		{"acquired_after", "&acquired_after=2022-01-15T00:00:00Z", []primitive.ObjectID{catalogItemIDs[2], catalogItemIDs[1]}},
+		{"acquired_before", "&acquired_before=2022-02-15T00:00:00Z", []primitive.ObjectID{catalogItemIDs[1], catalogItemIDs[0]}},
+		{"acquired_after and acquired_before", "&acquired_after=2022-01-15T00:00:00Z&acquired_before=2022-02-15T00:00:00Z", []primitive.ObjectID{catalogItemIDs[1]}},
 	}
 
-	for _, tt := range authenticationTests {
+	for _, tt := range filterTests {
 		t.Run(tt.testName, func(t *testing.T) {
-			body := map[string]any{}
-			body["userID"] = 1
-			body["catalogItemID"] = catalogItemIDs[0]
-			body["quantity"] = 2
+			statusCode, _, resBody := ts.get(t, "/items?user_id=1&sort=name"+tt.queryString, true, accessTokenUser1)
 
-			statusCode, _, resBody := ts.post(t, "/items", body, tt.useAuthHeader, tt.accessToken)
+			if statusCode != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, statusCode)
+			}
 
-			if statusCode != tt.wantedStatusCode {
-				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			var jsonRes map[string]any
+
+			err := json.Unmarshal(resBody, &jsonRes)
+			if err != nil {
+				t.Fatal("Failed to parse json response")
 			}
 
-			if !bytes.Contains(resBody, tt.wantedResponseBody) {
-				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			catalogItemIDs := []string{}
+
+			for _, item := range (jsonRes["items"]).([]any) {
+				catalogItemIDs = append(catalogItemIDs, item.(map[string]any)["catalogItemID"].(string))
+			}
+
+			wantedCatalogItemIDs := []string{}
+
+			for _, id := range tt.wantedCatalogItemIDs {
+				wantedCatalogItemIDs = append(wantedCatalogItemIDs, id.Hex())
+			}
+
+			if strings.Join(catalogItemIDs, ",") != strings.Join(wantedCatalogItemIDs, ",") {
+				t.Errorf("want to receive catalog items %v but got %v", wantedCatalogItemIDs, catalogItemIDs)
 			}
 		})
 	}
 
 	// -----------------------------
 
-	tests := []struct {
+	ownershipTests := []struct {
 		testName           string
-		userID             int64
-		catalogItemID      primitive.ObjectID
-		quantity           int64
+		queryString        string
+		accessToken        string
 		wantedStatusCode   int
 		wantedResponseBody []byte
 	}{
-		{"Valid submission", 1, catalogItemIDs[0], 2, http.StatusOK, []byte("Item granted successfully")},
-		{"Invalid user id (below 1)", 0, catalogItemIDs[0], 2, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
-		{"Invalid quantity (below 1)", 1, catalogItemIDs[0], 0, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"User 2 cannot read inventory of user 1", "?user_id=1", accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 2 cannot read own inventory without inventory:admin", "?user_id=2", accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 2 without inventory:admin is not told that user_id is missing", "", accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 2 without inventory:admin is not told that the query is invalid", "?user_id=-1&page=invalid", accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 1 with inventory:admin can read inventory of user 2", "?user_id=2", accessTokenUser1, http.StatusOK, []byte(`"items":[]`)},
 	}
 
-	for _, tt := range tests {
+	for _, tt := range ownershipTests {
 		t.Run(tt.testName, func(t *testing.T) {
-			body := map[string]any{}
-			body["userID"] = tt.userID
-			body["catalogItemID"] = tt.catalogItemID
-			body["quantity"] = tt.quantity
-
-			statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+			statusCode, _, resBody := ts.get(t, fmt.Sprintf("/items%s", tt.queryString), true, tt.accessToken)
 
 			if statusCode != tt.wantedStatusCode {
 				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
@@ -245,130 +331,1899 @@ func TestGrantItemsHandler(t *testing.T) {
 		})
 	}
 
-	// Check if inventory item was created successfully
-	inventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id", "name"}})
-	if err != nil {
-		t.Fatal(err)
-	}
+	// -----------------------------
 
-	if len(inventoryItems) != 1 {
-		t.Errorf("want inventoryItems to contain 1 item, but got %d", len(inventoryItems))
-	}
+	t.Run("Cursor pagination", func(t *testing.T) {
+		wantedNames := map[string][]string{
+			"-quantity": {"Antidote", "Ether", "Potion"},
+			"name":      {"Antidote", "Ether", "Potion"},
+			"-name":     {"Potion", "Ether", "Antidote"},
+		}
 
-	if inventoryItems[0].Quantity != 2 {
-		t.Errorf("want quantity to be 2, but got %d", inventoryItems[0].Quantity)
-	}
+		// Page through the inventory of user 1 for every supported sort value
+		for _, sort := range []string{"_id", "quantity", "acquiredDate", "name", "-_id", "-quantity", "-acquiredDate", "-name"} {
+			var names []string
+
+			cursor := ""
+
+			for page := 1; ; page++ {
+				statusCode, _, resBody := ts.get(t, fmt.Sprintf("/items?user_id=1&page_size=2&sort=%s&cursor=%s", sort, cursor), true, accessTokenUser1)
+
+				if statusCode != http.StatusOK {
+					t.Fatalf("want %d; got %d (sort %s)", http.StatusOK, statusCode, sort)
+				}
+
+				var jsonRes map[string]any
+
+				err := json.Unmarshal(resBody, &jsonRes)
+				if err != nil {
+					t.Fatal("Failed to parse json response")
+				}
+
+				for _, item := range (jsonRes["items"]).([]any) {
+					names = append(names, (item.(map[string]any))["name"].(string))
+				}
+
+				metadata := (jsonRes["metadata"]).(map[string]any)
+
+				nextCursor, ok := metadata["next_cursor"].(string)
+				if !ok {
+					break
+				}
+
+				if page == 3 {
+					t.Fatalf("want 2 pages but got more (sort %s)", sort)
+				}
+
+				cursor = nextCursor
+			}
+
+			if len(names) != 3 {
+				t.Errorf("want to receive 3 items but got %d (sort %s)", len(names), sort)
+			}
+
+			if wanted, ok := wantedNames[sort]; ok {
+				if strings.Join(names, ",") != strings.Join(wanted, ",") {
+					t.Errorf("want to receive %v but got %v (sort %s)", wanted, names, sort)
+				}
+			}
+		}
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		statusCode, _, resBody := ts.get(t, "/items?user_id=1&cursor=invalid", true, accessTokenUser1)
+
+		if statusCode != http.StatusUnprocessableEntity {
+			t.Errorf("want %d; got %d", http.StatusUnprocessableEntity, statusCode)
+		}
+
+		if !bytes.Contains(resBody, []byte("is invalid or does not match sort")) {
+			t.Errorf("want body %q to contain %q", resBody, "is invalid or does not match sort")
+		}
+	})
+
+	t.Run("Cursor used with another sort", func(t *testing.T) {
+		_, _, resBody := ts.get(t, "/items?user_id=1&page_size=1&sort=quantity&cursor=", true, accessTokenUser1)
+
+		var jsonRes map[string]any
+
+		err := json.Unmarshal(resBody, &jsonRes)
+		if err != nil {
+			t.Fatal("Failed to parse json response")
+		}
+
+		nextCursor := (jsonRes["metadata"]).(map[string]any)["next_cursor"].(string)
+
+		statusCode, _, _ := ts.get(t, fmt.Sprintf("/items?user_id=1&page_size=1&sort=name&cursor=%s", nextCursor), true, accessTokenUser1)
+
+		if statusCode != http.StatusUnprocessableEntity {
+			t.Errorf("want %d; got %d", http.StatusUnprocessableEntity, statusCode)
+		}
+	})
+
+	t.Run("Cursor whose value does not match the sort", func(t *testing.T) {
+		tests := []struct {
+			testName string
+			sort     string
+			value    any
+		}{
+			{"String value when sorting by quantity", "quantity", "2"},
+			{"Number value when sorting by name", "name", int64(2)},
+			{"String value when sorting by acquired date", "-acquiredDate", "2022-01-01T00:00:00Z"},
+		}
+
+		for _, tt := range tests {
+			// Cursors are base64 encoded BSON documents holding the sort, the value of the sorted field and the id of the last record
+			document, err := bson.Marshal(bson.M{"s": tt.sort, "v": tt.value, "id": primitive.NewObjectID()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cursor := base64.RawURLEncoding.EncodeToString(document)
+
+			statusCode, _, resBody := ts.get(t, fmt.Sprintf("/items?user_id=1&sort=%s&cursor=%s", tt.sort, cursor), true, accessTokenUser1)
+
+			if statusCode != http.StatusUnprocessableEntity {
+				t.Errorf("want %d; got %d (%s)", http.StatusUnprocessableEntity, statusCode, tt.testName)
+			}
+
+			if !bytes.Contains(resBody, []byte("is invalid or does not match sort")) {
+				t.Errorf("want body %q to contain %q (%s)", resBody, "is invalid or does not match sort", tt.testName)
+			}
+		}
+	})
 
 	// -----------------------------
 
-	updateItemTest := struct {
-		testName           string
-		userID             int64
-		catalogItemID      primitive.ObjectID
-		quantity           int64
-		wantedStatusCode   int
-		wantedResponseBody []byte
-	}{
-		"Valid update",
-		1,
-		catalogItemIDs[0],
-		3,
-		http.StatusOK,
-		[]byte("Item granted successfully"),
-	}
+	t.Run("Inventory item whose catalog item is missing", func(t *testing.T) {
+		unknownCatalogItemID := primitive.NewObjectID()
 
-	body := map[string]any{}
-	body["userID"] = updateItemTest.userID
-	body["catalogItemID"] = updateItemTest.catalogItemID
-	body["quantity"] = updateItemTest.quantity
+		_, _, err := app.InventoryItemsRepository.Grant(context.Background(), 2, unknownCatalogItemID, 1, time.Time{}, data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+		statusCode, _, resBody := ts.get(t, "/items/me", true, accessTokenUser2)
 
-	if statusCode != updateItemTest.wantedStatusCode {
-		t.Errorf("want %d; got %d", updateItemTest.wantedStatusCode, statusCode)
-	}
+		if statusCode != http.StatusOK {
+			t.Errorf("want %d; got %d", http.StatusOK, statusCode)
+		}
 
-	if !bytes.Contains(resBody, updateItemTest.wantedResponseBody) {
-		t.Errorf("want body %q to contain %q", resBody, updateItemTest.wantedResponseBody)
-	}
+		var jsonRes map[string]any
 
-	// Check if inventory item was created successfully
-	refetchedInventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id", "name"}})
-	if err != nil {
-		t.Fatal(err)
-	}
+		err = json.Unmarshal(resBody, &jsonRes)
+		if err != nil {
+			t.Fatal("Failed to parse json response")
+		}
 
-	if len(refetchedInventoryItems) != 1 {
-		t.Errorf("want refetchedInventoryItems to contain 1 item, but got %d", len(refetchedInventoryItems))
-	}
+		items := (jsonRes["items"]).([]any)
 
-	if refetchedInventoryItems[0].Quantity != 5 {
-		t.Errorf("want quantity to be 5, but got %d", refetchedInventoryItems[0].Quantity)
-	}
+		if len(items) != 1 {
+			t.Fatalf("want to receive 1 item but got %d", len(items))
+		}
+
+		item := (items[0]).(map[string]any)
+
+		if item["catalogItemID"] != unknownCatalogItemID.Hex() {
+			t.Errorf("want catalogItemID to be %s but got %s", unknownCatalogItemID.Hex(), item["catalogItemID"])
+		}
+
+		if item["name"] != data.UnknownCatalogItemName {
+			t.Errorf("want name to be %q but got %q", data.UnknownCatalogItemName, item["name"])
+		}
+
+		if item["catalogItemMissing"] != true {
+			t.Errorf("want catalogItemMissing to be true but got %v", item["catalogItemMissing"])
+		}
+	})
 
 	// -----------------------------
 
-	malformedJSONTest := struct {
+	t.Run("Inventory as of a past date", func(t *testing.T) {
+		// Ledger entries are stored with a millisecond precision
+		time.Sleep(10 * time.Millisecond)
+		asOf := time.Now().UTC()
+		time.Sleep(10 * time.Millisecond)
+
+		// Subtract every Potion and grant a Hi-Potion to user 1
+		_, err := app.InventoryItemsRepository.Subtract(context.Background(), 1, catalogItemIDs[0], 2, data.HTTPSource(1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = app.InventoryItemsRepository.Grant(context.Background(), 1, catalogItemIDs[3], 1, time.Time{}, data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			testName       string
+			queryString    string
+			wantedNames    []string
+			wantedQuantity map[string]float64
+		}{
+			{"Before any grant", "&as_of=2022-01-01T00:00:00Z", []string{}, nil},
+			{"Before the last changes", "&as_of=" + asOf.Format(time.RFC3339Nano), []string{"Antidote", "Ether", "Potion"}, map[string]float64{"Potion": 2}},
+			{"Before the last changes filtered by quantity", "&as_of=" + asOf.Format(time.RFC3339Nano) + "&min_quantity=3", []string{"Antidote", "Ether"}, nil},
+			{"Before the last changes filtered by catalog item", fmt.Sprintf("&as_of=%s&catalog_item_id=%s", asOf.Format(time.RFC3339Nano), catalogItemIDs[0].Hex()), []string{"Potion"}, nil},
+			{"Now", "&as_of=" + time.Now().UTC().Format(time.RFC3339Nano), []string{"Antidote", "Ether", "Hi-Potion"}, map[string]float64{"Hi-Potion": 1}},
+		}
+
+		for _, tt := range tests {
+			statusCode, _, resBody := ts.get(t, "/items?user_id=1&sort=name"+tt.queryString, true, accessTokenUser1)
+
+			if statusCode != http.StatusOK {
+				t.Errorf("want %d; got %d (%s)", http.StatusOK, statusCode, tt.testName)
+			}
+
+			var jsonRes map[string]any
+
+			err := json.Unmarshal(resBody, &jsonRes)
+			if err != nil {
+				t.Fatal("Failed to parse json response")
+			}
+
+			names := []string{}
+
+			for _, item := range (jsonRes["items"]).([]any) {
+				item := item.(map[string]any)
+				name := item["name"].(string)
+				names = append(names, name)
+
+				if quantity, ok := tt.wantedQuantity[name]; ok && item["quantity"] != quantity {
+					t.Errorf("want %s quantity to be %v but got %v (%s)", name, quantity, item["quantity"], tt.testName)
+				}
+			}
+
+			if strings.Join(names, ",") != strings.Join(tt.wantedNames, ",") {
+				t.Errorf("want to receive %v but got %v (%s)", tt.wantedNames, names, tt.testName)
+			}
+		}
+
+		// The stored inventory matches its ledger
+		drifts, err := app.InventoryItemsRepository.Reconcile(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(drifts) != 0 {
+			t.Errorf("want no drift but got %v", drifts)
+		}
+	})
+}
+
+func TestGetMyInventoryItemsHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	authenticationTests := []struct {
 		testName           string
-		userID             int64
-		catalogItemID      primitive.ObjectID
-		quantity           string
+		path               string
+		useAuthHeader      bool
+		accessToken        string
 		wantedStatusCode   int
 		wantedResponseBody []byte
 	}{
-		"Malformed JSON",
-		1,
-		catalogItemIDs[0],
-		"invalid",
-		http.StatusBadRequest,
-		[]byte("body contains incorrect JSON type for field"),
+		{"No Authorization header", "/items/me", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Invalid access token", "/items/me", true, "invalid", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has catalog:read", "/items/me", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid sort value", "/items/me?sort=invalid", true, accessTokenUser1, http.StatusUnprocessableEntity, []byte("invalid sort value")},
 	}
 
-	body = map[string]any{}
-	body["userID"] = malformedJSONTest.userID
-	body["catalogItemID"] = malformedJSONTest.catalogItemID
-	body["quantity"] = malformedJSONTest.quantity
-
-	statusCode, _, resBody = ts.post(t, "/items", body, true, accessTokenUser1)
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.get(t, tt.path, tt.useAuthHeader, tt.accessToken)
 
-	if statusCode != malformedJSONTest.wantedStatusCode {
-		t.Errorf("want %d; got %d", malformedJSONTest.wantedStatusCode, statusCode)
-	}
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
 
-	if !bytes.Contains(resBody, malformedJSONTest.wantedResponseBody) {
-		t.Errorf("want body %q to contain %q", resBody, malformedJSONTest.wantedResponseBody)
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
 	}
 
 	// -----------------------------
 
-	unknownKeyTest := struct {
-		testName           string
-		userID             int64
-		catalogItemID      primitive.ObjectID
-		invalid            int64
-		wantedStatusCode   int
-		wantedResponseBody []byte
+	successTests := []struct {
+		testName            string
+		accessToken         string
+		expectedItemsLength int
 	}{
-		"Malformed JSON",
-		1,
-		catalogItemIDs[0],
-		2,
-		http.StatusBadRequest,
-		[]byte("body contains unknown key"),
+		{"User 1 reads own inventory", accessTokenUser1, 3},
+		{"User 2 does not see inventory of user 1", accessTokenUser2, 0},
 	}
 
-	body = map[string]any{}
-	body["userID"] = unknownKeyTest.userID
-	body["catalogItemID"] = unknownKeyTest.catalogItemID
-	body["invalid"] = unknownKeyTest.invalid
+	for _, tt := range successTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.get(t, "/items/me", true, tt.accessToken)
 
-	statusCode, _, resBody = ts.post(t, "/items", body, true, accessTokenUser1)
+			if statusCode != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, statusCode)
+			}
 
-	if statusCode != unknownKeyTest.wantedStatusCode {
-		t.Errorf("want %d; got %d", unknownKeyTest.wantedStatusCode, statusCode)
-	}
+			var jsonRes map[string]any
 
-	if !bytes.Contains(resBody, unknownKeyTest.wantedResponseBody) {
-		t.Errorf("want body %q to contain %q", resBody, unknownKeyTest.wantedResponseBody)
+			err := json.Unmarshal(resBody, &jsonRes)
+			if err != nil {
+				t.Fatal("Failed to parse json response")
+			}
+
+			items := (jsonRes["items"]).([]any)
+
+			if len(items) != tt.expectedItemsLength {
+				t.Errorf("want to receive %d items but got %d", tt.expectedItemsLength, len(items))
+			}
+
+			for _, item := range items {
+				if (item.(map[string]any))["userID"] != float64(1) {
+					t.Errorf("want to only receive items of user 1 but got %v", item)
+				}
+			}
+		})
+	}
+}
+
+func TestUserUpdates(t *testing.T) {
+	app, cleanup, _ := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// User 2 starts with version 2 and the inventory:read permission
+	tests := []struct {
+		testName           string
+		user               database.User
+		wantedApplied      bool
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Stale update revoking permissions", database.User{ID: 2, Permissions: []string{}, Activated: true, Version: 1}, false, http.StatusOK, []byte(`"items"`)},
+		{"Update with the same version", database.User{ID: 2, Permissions: []string{}, Activated: true, Version: 2}, false, http.StatusOK, []byte(`"items"`)},
+		{"Revoke permissions", database.User{ID: 2, Permissions: []string{}, Activated: true, Version: 3}, true, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Stale update granting permissions back", database.User{ID: 2, Permissions: []string{"inventory:read"}, Activated: true, Version: 3}, false, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Grant permissions back", database.User{ID: 2, Permissions: []string{"inventory:read"}, Activated: true, Version: 4}, true, http.StatusOK, []byte(`"items"`)},
+		{"Deactivate user", database.User{ID: 2, Permissions: []string{"inventory:read"}, Activated: false, Version: 5}, true, http.StatusForbidden, []byte("your user account must be activated to access this resource")},
+		{"Stale update activating user", database.User{ID: 2, Permissions: []string{"inventory:read"}, Activated: true, Version: 4}, false, http.StatusForbidden, []byte("your user account must be activated to access this resource")},
+		{"Activate user", database.User{ID: 2, Permissions: []string{"inventory:read"}, Activated: true, Version: 6}, true, http.StatusOK, []byte(`"items"`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			applied, err := app.UsersRepository.Upsert(context.Background(), tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if applied != tt.wantedApplied {
+				t.Errorf("want applied to be %t, but got %t", tt.wantedApplied, applied)
+			}
+
+			statusCode, _, resBody := ts.get(t, "/items/me", true, accessTokenUser2)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+}
+
+func TestGetInventoryItemHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	// Retrieve the id of the Potion owned by user 1
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName           string
+		id                 string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", inventoryItem.ID.Hex(), false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has catalog:read", inventoryItem.ID.Hex(), true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 2 cannot read inventory item of user 1", inventoryItem.ID.Hex(), true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid id", "invalid", true, accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Inventory item does not exist", primitive.NewObjectID().Hex(), true, accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Valid request", inventoryItem.ID.Hex(), true, accessTokenUser1, http.StatusOK, []byte(`"name":"Potion"`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, headers, resBody := ts.get(t, fmt.Sprintf("/items/%s", tt.id), tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if statusCode == http.StatusOK && headers.Get("ETag") != inventoryItemETag(inventoryItem.ID, inventoryItem.Version) {
+				t.Errorf("want ETag header %q; got %q", inventoryItemETag(inventoryItem.ID, inventoryItem.Version), headers.Get("ETag"))
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+}
+
+func TestGetUserInventoryItemHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	tests := []struct {
+		testName           string
+		urlPath            string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", fmt.Sprintf("/users/1/items/%s", catalogItemIDs[1].Hex()), false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has catalog:read", fmt.Sprintf("/users/1/items/%s", catalogItemIDs[1].Hex()), true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User 2 cannot read inventory item of user 1", fmt.Sprintf("/users/1/items/%s", catalogItemIDs[1].Hex()), true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid user id", fmt.Sprintf("/users/invalid/items/%s", catalogItemIDs[1].Hex()), true, accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Invalid catalog item id", "/users/1/items/invalid", true, accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"User does not own catalog item", fmt.Sprintf("/users/1/items/%s", catalogItemIDs[3].Hex()), true, accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Valid request", fmt.Sprintf("/users/1/items/%s", catalogItemIDs[1].Hex()), true, accessTokenUser1, http.StatusOK, []byte(`"name":"Ether"`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, headers, resBody := ts.get(t, tt.urlPath, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if statusCode == http.StatusOK && headers.Get("ETag") == "" {
+				t.Error("want ETag header to be set")
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+}
+
+func TestGetInventoryHistoryHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	// Subtract a Potion owned by user 1
+	_, err := app.InventoryItemsRepository.Subtract(context.Background(), 1, catalogItemIDs[0], 1, data.HTTPSource(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticationTests := []struct {
+		testName           string
+		path               string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", "/items/history", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has catalog:read", "/items/history", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User reads the history of another user", "/items/history?user_id=1", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid user id", "/items/history?user_id=0", true, accessTokenUser1, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid catalog item id", "/items/history?catalog_item_id=invalid", true, accessTokenUser1, http.StatusUnprocessableEntity, []byte("must be a valid id")},
+		{"Invalid sort value", "/items/history?sort=quantity", true, accessTokenUser1, http.StatusUnprocessableEntity, []byte("invalid sort value")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.get(t, tt.path, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	successTests := []struct {
+		testName              string
+		path                  string
+		accessToken           string
+		expectedEntriesLength int
+	}{
+		{"User 1 reads own history", "/items/history", accessTokenUser1, 4},
+		{"User 1 reads own history of a catalog item", fmt.Sprintf("/items/history?catalog_item_id=%s", catalogItemIDs[0].Hex()), accessTokenUser1, 2},
+		{"User 1 reads a page of own history", "/items/history?page=2&page_size=3", accessTokenUser1, 1},
+		{"User 2 does not see history of user 1", "/items/history", accessTokenUser2, 0},
+	}
+
+	for _, tt := range successTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.get(t, tt.path, true, tt.accessToken)
+
+			if statusCode != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, statusCode)
+			}
+
+			var jsonRes map[string]any
+
+			err := json.Unmarshal(resBody, &jsonRes)
+			if err != nil {
+				t.Fatal("Failed to parse json response")
+			}
+
+			entries := (jsonRes["entries"]).([]any)
+
+			if len(entries) != tt.expectedEntriesLength {
+				t.Errorf("want to receive %d entries but got %d", tt.expectedEntriesLength, len(entries))
+			}
+		})
+	}
+
+	// Check that the latest entry records the subtraction along with its source
+	_, _, resBody := ts.get(t, fmt.Sprintf("/items/history?catalog_item_id=%s", catalogItemIDs[0].Hex()), true, accessTokenUser1)
+
+	for _, want := range [][]byte{[]byte(`"delta": -1`), []byte(`"quantity": 1`), []byte(`"type": "http"`), []byte(`"actorID": 1`)} {
+		if !bytes.Contains(resBody, want) {
+			t.Errorf("want body %q to contain %q", resBody, want)
+		}
+	}
+}
+
+func TestGrantItemsHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	authenticationTests := []struct {
+		testName           string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Invalid access token", true, "invalid", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Access token not generated by identity microservice", true, invalidAccessToken, http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = 2
+
+			statusCode, _, resBody := ts.post(t, "/items", body, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	tests := []struct {
+		testName           string
+		userID             int64
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Valid submission", 1, catalogItemIDs[0], 2, http.StatusOK, []byte("Item granted successfully")},
+		{"Invalid user id (below 1)", 0, catalogItemIDs[0], 2, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid quantity (below 1)", 1, catalogItemIDs[0], 0, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Missing catalog item id", 1, primitive.NilObjectID, 2, http.StatusUnprocessableEntity, []byte("must be provided")},
+		{"User does not exist", 99, catalogItemIDs[0], 2, http.StatusUnprocessableEntity, []byte("must be an existing user")},
+		{"Catalog item does not exist", 1, primitive.NewObjectID(), 2, http.StatusUnprocessableEntity, []byte("must be an existing catalog item")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = tt.userID
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = tt.quantity
+
+			statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check if inventory item was created successfully
+	inventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id", "name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventoryItems) != 1 {
+		t.Errorf("want inventoryItems to contain 1 item, but got %d", len(inventoryItems))
+	}
+
+	if inventoryItems[0].Quantity != 2 {
+		t.Errorf("want quantity to be 2, but got %d", inventoryItems[0].Quantity)
+	}
+
+	// -----------------------------
+
+	updateItemTest := struct {
+		testName           string
+		userID             int64
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		"Valid update",
+		1,
+		catalogItemIDs[0],
+		3,
+		http.StatusOK,
+		[]byte("Item granted successfully"),
+	}
+
+	body := map[string]any{}
+	body["userID"] = updateItemTest.userID
+	body["catalogItemID"] = updateItemTest.catalogItemID
+	body["quantity"] = updateItemTest.quantity
+
+	statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+
+	if statusCode != updateItemTest.wantedStatusCode {
+		t.Errorf("want %d; got %d", updateItemTest.wantedStatusCode, statusCode)
+	}
+
+	if !bytes.Contains(resBody, updateItemTest.wantedResponseBody) {
+		t.Errorf("want body %q to contain %q", resBody, updateItemTest.wantedResponseBody)
+	}
+
+	// Check if inventory item was created successfully
+	refetchedInventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id", "name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refetchedInventoryItems) != 1 {
+		t.Errorf("want refetchedInventoryItems to contain 1 item, but got %d", len(refetchedInventoryItems))
+	}
+
+	if refetchedInventoryItems[0].Quantity != 5 {
+		t.Errorf("want quantity to be 5, but got %d", refetchedInventoryItems[0].Quantity)
+	}
+
+	// -----------------------------
+
+	malformedJSONTest := struct {
+		testName           string
+		userID             int64
+		catalogItemID      primitive.ObjectID
+		quantity           string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		"Malformed JSON",
+		1,
+		catalogItemIDs[0],
+		"invalid",
+		http.StatusBadRequest,
+		[]byte("body contains incorrect JSON type for field"),
+	}
+
+	body = map[string]any{}
+	body["userID"] = malformedJSONTest.userID
+	body["catalogItemID"] = malformedJSONTest.catalogItemID
+	body["quantity"] = malformedJSONTest.quantity
+
+	statusCode, _, resBody = ts.post(t, "/items", body, true, accessTokenUser1)
+
+	if statusCode != malformedJSONTest.wantedStatusCode {
+		t.Errorf("want %d; got %d", malformedJSONTest.wantedStatusCode, statusCode)
+	}
+
+	if !bytes.Contains(resBody, malformedJSONTest.wantedResponseBody) {
+		t.Errorf("want body %q to contain %q", resBody, malformedJSONTest.wantedResponseBody)
+	}
+
+	// -----------------------------
+
+	unknownKeyTest := struct {
+		testName           string
+		userID             int64
+		catalogItemID      primitive.ObjectID
+		invalid            int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		"Malformed JSON",
+		1,
+		catalogItemIDs[0],
+		2,
+		http.StatusBadRequest,
+		[]byte("body contains unknown key"),
+	}
+
+	body = map[string]any{}
+	body["userID"] = unknownKeyTest.userID
+	body["catalogItemID"] = unknownKeyTest.catalogItemID
+	body["invalid"] = unknownKeyTest.invalid
+
+	statusCode, _, resBody = ts.post(t, "/items", body, true, accessTokenUser1)
+
+	if statusCode != unknownKeyTest.wantedStatusCode {
+		t.Errorf("want %d; got %d", unknownKeyTest.wantedStatusCode, statusCode)
+	}
+
+	if !bytes.Contains(resBody, unknownKeyTest.wantedResponseBody) {
+		t.Errorf("want body %q to contain %q", resBody, unknownKeyTest.wantedResponseBody)
+	}
+
+	// -----------------------------
+
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version)
+	staleETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version-1)
+
+	ifMatchTests := []struct {
+		testName           string
+		catalogItemID      primitive.ObjectID
+		ifMatch            string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"If-Match with stale ETag", catalogItemIDs[0], staleETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with malformed ETag", catalogItemIDs[0], "invalid", http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with ETag of another inventory item", catalogItemIDs[1], currentETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match any on missing inventory item", catalogItemIDs[1], "*", http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with current ETag", catalogItemIDs[0], currentETag, http.StatusOK, []byte("Item granted successfully")},
+		{"If-Match any on existing inventory item", catalogItemIDs[0], "*", http.StatusOK, []byte("Item granted successfully")},
+	}
+
+	for _, tt := range ifMatchTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = 1
+
+			headers := make(http.Header)
+			headers.Set("If-Match", tt.ifMatch)
+
+			statusCode, resHeaders, resBody := ts.postWithHeaders(t, "/items", body, headers, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if statusCode == http.StatusOK && resHeaders.Get("ETag") == tt.ifMatch {
+				t.Errorf("want ETag header to change; got %q", resHeaders.Get("ETag"))
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that only the requests with a matching If-Match header were applied
+	inventoryItem, err = app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.Quantity != 7 {
+		t.Errorf("want quantity to be 7, but got %d", inventoryItem.Quantity)
+	}
+
+	_, err = app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[1]})
+	if !errors.Is(err, database.ErrRecordNotFound) {
+		t.Errorf("want inventory item of catalog item %s not to be created", catalogItemIDs[1].Hex())
+	}
+
+	// -----------------------------
+
+	idempotencyTests := []struct {
+		testName           string
+		idempotencyKey     string
+		quantity           int64
+		wantedStatusCode   int
+		wantedReplayed     bool
+		wantedResponseBody []byte
+	}{
+		{"Idempotency key too long", strings.Repeat("a", 256), 2, http.StatusUnprocessableEntity, false, []byte("must not be more than 255 bytes long")},
+		{"First request with idempotency key", "grant-request", 2, http.StatusOK, false, []byte("Item granted successfully")},
+		{"Retried request with idempotency key", "grant-request", 2, http.StatusOK, true, []byte("Item granted successfully")},
+		{"Idempotency key reused with a different payload", "grant-request", 3, http.StatusUnprocessableEntity, false, []byte("was already used with a different request")},
+		{"Request with another idempotency key", "another-grant-request", 2, http.StatusOK, false, []byte("Item granted successfully")},
+	}
+
+	for _, tt := range idempotencyTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = catalogItemIDs[3]
+			body["quantity"] = tt.quantity
+
+			headers := make(http.Header)
+			headers.Set("Idempotency-Key", tt.idempotencyKey)
+
+			statusCode, resHeaders, resBody := ts.postWithHeaders(t, "/items", body, headers, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if replayed := resHeaders.Get("Idempotent-Replayed") == "true"; replayed != tt.wantedReplayed {
+				t.Errorf("want replayed response to be %t; got %t", tt.wantedReplayed, replayed)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the retried request was not granted twice
+	inventoryItem, err = app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.Quantity != 4 {
+		t.Errorf("want quantity to be 4, but got %d", inventoryItem.Quantity)
+	}
+}
+
+func TestGrantItemsHandlerConcurrentRequests(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	const requests = 50
+
+	var wg sync.WaitGroup
+
+	statusCodes := make(chan int, requests)
+
+	// Grant the same catalog item to the same user from many goroutines at once
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = 2
+
+			statusCode, _, _ := ts.post(t, "/items", body, true, accessTokenUser1)
+
+			statusCodes <- statusCode
+		}()
+	}
+
+	wg.Wait()
+	close(statusCodes)
+
+	for statusCode := range statusCodes {
+		if statusCode != http.StatusOK {
+			t.Errorf("want %d; got %d", http.StatusOK, statusCode)
+		}
+	}
+
+	// Check that a single inventory item holds the quantity of every grant
+	inventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventoryItems) != 1 {
+		t.Fatalf("want inventoryItems to contain 1 item, but got %d", len(inventoryItems))
+	}
+
+	if inventoryItems[0].Quantity != requests*2 {
+		t.Errorf("want quantity to be %d, but got %d", requests*2, inventoryItems[0].Quantity)
+	}
+}
+
+func TestGrantItemsHandlerInventoryLimits(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Users can own at most 3 Mega Potions
+	_, err := app.CatalogItemsRepository.Upsert(context.Background(), data.CatalogItem{ID: catalogItemIDs[4], Name: "Mega Potion", Description: "Restores a small big of health", MaxStack: 3, Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a catalog item which does not fit in a full inventory
+	elixirID, err := app.CatalogItemsRepository.Create(context.Background(), data.CatalogItem{Name: "Elixir", Description: "Fully restores health and MP", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName           string
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		allowPartial       bool
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Grant below the stack limit", catalogItemIDs[4], 2, false, http.StatusOK, []byte(`"grantedQuantity": 2`)},
+		{"Grant exceeding the stack limit", catalogItemIDs[4], 2, false, http.StatusUnprocessableEntity, []byte("must not exceed the maximum stack size of the catalog item")},
+		{"Partial grant exceeding the stack limit", catalogItemIDs[4], 2, true, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+		{"Partial grant on a full stack", catalogItemIDs[4], 1, true, http.StatusUnprocessableEntity, []byte("must not exceed the maximum stack size of the catalog item")},
+		{"Grant using the second slot", catalogItemIDs[0], 1, false, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+		{"Grant using the third slot", catalogItemIDs[1], 1, false, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+		{"Grant using the fourth slot", catalogItemIDs[2], 1, false, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+		{"Grant using the last slot", catalogItemIDs[3], 1, false, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+		{"Grant of a new item to a full inventory", *elixirID, 1, true, http.StatusUnprocessableEntity, []byte("cannot be added to the inventory of the user since it is full")},
+		{"Grant of an owned item to a full inventory", catalogItemIDs[0], 1, false, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 2
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = tt.quantity
+			body["allowPartial"] = tt.allowPartial
+
+			statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the stack limit was not exceeded
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 2, "catalog_item_id": catalogItemIDs[4]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.Quantity != 3 {
+		t.Errorf("want quantity to be 3, but got %d", inventoryItem.Quantity)
+	}
+}
+
+func TestGrantItemsHandlerTimeLimitedItems(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		testName           string
+		quantity           int64
+		expiresAt          time.Time
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Grant of time-limited items", 2, time.Now().Add(time.Hour), http.StatusOK, []byte("Item granted successfully")},
+		{"Grant of items which do not expire", 1, time.Time{}, http.StatusOK, []byte("Item granted successfully")},
+		{"Expiry date in the past", 1, time.Now().Add(-time.Hour), http.StatusUnprocessableEntity, []byte("must be in the future")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 2
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = tt.quantity
+
+			if !tt.expiresAt.IsZero() {
+				body["expiresAt"] = tt.expiresAt
+			}
+
+			statusCode, _, resBody := ts.post(t, "/items", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Grant items which already expired, along with an inventory item holding nothing but expired items
+	for _, catalogItemID := range []primitive.ObjectID{catalogItemIDs[0], catalogItemIDs[1]} {
+		_, _, err := app.InventoryItemsRepository.Grant(context.Background(), 2, catalogItemID, 3, time.Now().Add(-time.Minute), data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// -----------------------------
+
+	readTests := []struct {
+		testName           string
+		urlPath            string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Expired items are left out", fmt.Sprintf("/users/2/items/%s", catalogItemIDs[0].Hex()), http.StatusOK, []byte(`"availableQuantity": 3`)},
+		{"Inventory item holding expired items only", fmt.Sprintf("/users/2/items/%s", catalogItemIDs[1].Hex()), http.StatusNotFound, []byte("the requested resource could not be found")},
+		{"Listing leaves out expired items", "/items?user_id=2", http.StatusOK, []byte(`"total_records": 1`)},
+	}
+
+	for _, tt := range readTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.get(t, tt.urlPath, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Expired items cannot be subtracted, and time-limited items are subtracted first
+	_, err := app.InventoryItemsRepository.Subtract(context.Background(), 2, catalogItemIDs[0], 4, data.HTTPSource(1), nil)
+	if !errors.Is(err, data.ErrInsufficientQuantity) {
+		t.Errorf("want error %v, but got %v", data.ErrInsufficientQuantity, err)
+	}
+
+	_, err = app.InventoryItemsRepository.Subtract(context.Background(), 2, catalogItemIDs[0], 2, data.HTTPSource(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the expired items
+	expired, err := app.InventoryItemsRepository.ExpireLots(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expired != 2 {
+		t.Errorf("want 2 inventory items to expire, but got %d", expired)
+	}
+
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 2, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.Quantity != 1 || len(inventoryItem.Lots) != 0 {
+		t.Errorf("want quantity to be 1 without any lot, but got %d with %d lots", inventoryItem.Quantity, len(inventoryItem.Lots))
+	}
+
+	_, err = app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 2, "catalog_item_id": catalogItemIDs[1]})
+	if !errors.Is(err, database.ErrRecordNotFound) {
+		t.Errorf("want error %v, but got %v", database.ErrRecordNotFound, err)
+	}
+
+	// Check that the expired items are recorded in the history of the user
+	statusCode, _, resBody := ts.get(t, "/items/history?user_id=2", true, accessTokenUser1)
+
+	if statusCode != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, statusCode)
+	}
+
+	if !bytes.Contains(resBody, []byte(`"type": "expiry"`)) {
+		t.Errorf("want body %q to contain %q", resBody, `"type": "expiry"`)
+	}
+}
+
+func TestSubtractItemsHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	authenticationTests := []struct {
+		testName           string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Invalid access token", true, "invalid", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Access token not generated by identity microservice", true, invalidAccessToken, http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = 1
+
+			statusCode, _, resBody := ts.post(t, "/items/subtract", body, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	tests := []struct {
+		testName           string
+		userID             int64
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Invalid user id (below 1)", 0, catalogItemIDs[0], 1, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid quantity (below 1)", 1, catalogItemIDs[0], 0, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Missing catalog item id", 1, primitive.NilObjectID, 1, http.StatusUnprocessableEntity, []byte("must be provided")},
+		{"Quantity greater than owned quantity", 1, catalogItemIDs[0], 3, http.StatusUnprocessableEntity, []byte("must not exceed the quantity owned by the user")},
+		{"Catalog item not owned by user", 1, catalogItemIDs[3], 1, http.StatusUnprocessableEntity, []byte("must not exceed the quantity owned by the user")},
+		{"Valid submission", 1, catalogItemIDs[0], 1, http.StatusOK, []byte("Item subtracted successfully")},
+		{"Valid submission subtracting every remaining item", 1, catalogItemIDs[1], 3, http.StatusOK, []byte("Item subtracted successfully")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = tt.userID
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = tt.quantity
+
+			statusCode, _, resBody := ts.post(t, "/items/subtract", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the first inventory item was decremented and that the second one was deleted
+	inventoryItems, _, err := app.InventoryItemsRepository.GetAll(context.Background(), bson.M{}, filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventoryItems) != 2 {
+		t.Fatalf("want inventoryItems to contain 2 items, but got %d", len(inventoryItems))
+	}
+
+	for _, inventoryItem := range inventoryItems {
+		if inventoryItem.CatalogItemID == catalogItemIDs[1] {
+			t.Errorf("want inventory item of catalog item %s to be deleted", catalogItemIDs[1].Hex())
+		}
+
+		if inventoryItem.CatalogItemID == catalogItemIDs[0] && inventoryItem.Quantity != 1 {
+			t.Errorf("want quantity to be 1, but got %d", inventoryItem.Quantity)
+		}
+	}
+
+	// -----------------------------
+
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version)
+	staleETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version-1)
+	nextETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version+1)
+
+	ifMatchTests := []struct {
+		testName           string
+		catalogItemID      primitive.ObjectID
+		ifMatch            string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"If-Match with stale ETag", catalogItemIDs[2], staleETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with malformed ETag", catalogItemIDs[2], `"invalid"`, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with ETag of another inventory item", catalogItemIDs[0], currentETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match any on missing inventory item", catalogItemIDs[1], "*", http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with current ETag", catalogItemIDs[2], currentETag, http.StatusOK, []byte("Item subtracted successfully")},
+		{"If-Match with ETag consumed by previous request", catalogItemIDs[2], currentETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+	}
+
+	for _, tt := range ifMatchTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = 1
+
+			headers := make(http.Header)
+			headers.Set("If-Match", tt.ifMatch)
+
+			statusCode, resHeaders, resBody := ts.postWithHeaders(t, "/items/subtract", body, headers, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if statusCode == http.StatusOK && resHeaders.Get("ETag") != nextETag {
+				t.Errorf("want ETag header %q; got %q", nextETag, resHeaders.Get("ETag"))
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+}
+
+func TestCreateTransferHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	authenticationTests := []struct {
+		testName           string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"Invalid access token", true, "invalid", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["fromUserID"] = 1
+			body["toUserID"] = 2
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = 1
+
+			statusCode, _, resBody := ts.post(t, "/transfers", body, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	tests := []struct {
+		testName           string
+		fromUserID         int64
+		toUserID           int64
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Invalid source user id (below 1)", 0, 2, catalogItemIDs[0], 1, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid quantity (below 1)", 1, 2, catalogItemIDs[0], 0, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Transfer to the source user", 1, 1, catalogItemIDs[0], 1, http.StatusUnprocessableEntity, []byte("must be different from fromUserID")},
+		{"Missing catalog item id", 1, 2, primitive.NilObjectID, 1, http.StatusUnprocessableEntity, []byte("must be provided")},
+		{"Target user does not exist", 1, 99, catalogItemIDs[0], 1, http.StatusUnprocessableEntity, []byte("must be an existing user")},
+		{"Target user is not activated", 1, 4, catalogItemIDs[0], 1, http.StatusUnprocessableEntity, []byte("must be an activated user")},
+		{"Quantity greater than owned quantity", 1, 2, catalogItemIDs[0], 3, http.StatusUnprocessableEntity, []byte("must not exceed the quantity owned by the user")},
+		{"Catalog item not owned by source user", 1, 2, catalogItemIDs[3], 1, http.StatusUnprocessableEntity, []byte("must not exceed the quantity owned by the user")},
+		{"Valid transfer", 1, 2, catalogItemIDs[0], 1, http.StatusCreated, []byte(`"initiatedBy": 1`)},
+		{"Valid transfer of every remaining item", 1, 2, catalogItemIDs[1], 3, http.StatusCreated, []byte(`"quantity": 3`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["fromUserID"] = tt.fromUserID
+			body["toUserID"] = tt.toUserID
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = tt.quantity
+
+			statusCode, _, resBody := ts.post(t, "/transfers", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version)
+	staleETag := inventoryItemETag(inventoryItem.ID, inventoryItem.Version-1)
+
+	ifMatchTests := []struct {
+		testName           string
+		catalogItemID      primitive.ObjectID
+		ifMatch            string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"If-Match with stale ETag", catalogItemIDs[2], staleETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with malformed ETag", catalogItemIDs[2], `"invalid"`, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with ETag of another inventory item", catalogItemIDs[0], currentETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with current ETag", catalogItemIDs[2], currentETag, http.StatusCreated, []byte(`"initiatedBy": 1`)},
+		{"If-Match with ETag consumed by previous request", catalogItemIDs[2], currentETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+	}
+
+	for _, tt := range ifMatchTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["fromUserID"] = 1
+			body["toUserID"] = 2
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = 1
+
+			headers := make(http.Header)
+			headers.Set("If-Match", tt.ifMatch)
+
+			statusCode, _, resBody := ts.postWithHeaders(t, "/transfers", body, headers, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the items were moved from user 1 to user 2
+	wantedQuantities := []struct {
+		userID        int64
+		catalogItemID primitive.ObjectID
+		quantity      int64
+	}{
+		{1, catalogItemIDs[0], 1},
+		{1, catalogItemIDs[1], 0},
+		{1, catalogItemIDs[2], 4},
+		{2, catalogItemIDs[0], 1},
+		{2, catalogItemIDs[1], 3},
+		{2, catalogItemIDs[2], 1},
+	}
+
+	for _, wanted := range wantedQuantities {
+		inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": wanted.userID, "catalog_item_id": wanted.catalogItemID})
+		if errors.Is(err, database.ErrRecordNotFound) && wanted.quantity == 0 {
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if inventoryItem.Quantity != wanted.quantity {
+			t.Errorf("want quantity of user %d to be %d, but got %d", wanted.userID, wanted.quantity, inventoryItem.Quantity)
+		}
+	}
+}
+
+func TestBatchGrantItemsHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	validItems := []map[string]any{
+		{"userID": 1, "catalogItemID": catalogItemIDs[0], "quantity": 2},
+		{"userID": 2, "catalogItemID": catalogItemIDs[0], "quantity": 3},
+		{"userID": 1, "catalogItemID": catalogItemIDs[0], "quantity": 1},
+	}
+
+	itemsWithInvalidItems := []map[string]any{
+		{"userID": 2, "catalogItemID": catalogItemIDs[1], "quantity": 4},
+		{"userID": 0, "catalogItemID": catalogItemIDs[1], "quantity": 4},
+		{"userID": 99, "catalogItemID": catalogItemIDs[1], "quantity": 4},
+		{"userID": 2, "catalogItemID": primitive.NewObjectID(), "quantity": 4},
+	}
+
+	authenticationTests := []struct {
+		testName           string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["mode"] = "atomic"
+			body["items"] = validItems
+
+			statusCode, _, resBody := ts.post(t, "/items/batch", body, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	tests := []struct {
+		testName           string
+		mode               string
+		items              []map[string]any
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Invalid mode", "invalid", validItems, http.StatusUnprocessableEntity, []byte("must be either atomic or bestEffort")},
+		{"No items", "atomic", []map[string]any{}, http.StatusUnprocessableEntity, []byte("must contain at least one item")},
+		{"Atomic batch with invalid items", "atomic", itemsWithInvalidItems, http.StatusUnprocessableEntity, []byte(`"status": "skipped"`)},
+		{"Valid atomic batch", "atomic", validItems, http.StatusOK, []byte(`"status": "granted"`)},
+		{"Valid batch without mode", "", validItems, http.StatusOK, []byte(`"status": "granted"`)},
+		{"Best effort batch with invalid items", "bestEffort", itemsWithInvalidItems, http.StatusOK, []byte(`"status": "invalid"`)},
+		{"Best effort batch with an unknown user", "bestEffort", itemsWithInvalidItems[2:3], http.StatusOK, []byte("must be an existing user")},
+		{"Best effort batch with an unknown catalog item", "bestEffort", itemsWithInvalidItems[3:], http.StatusOK, []byte("must be an existing catalog item")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["mode"] = tt.mode
+			body["items"] = tt.items
+
+			statusCode, _, resBody := ts.post(t, "/items/batch", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the valid batches were granted, and that the best effort batch granted its valid item
+	wantedQuantities := []struct {
+		userID        int64
+		catalogItemID primitive.ObjectID
+		quantity      int64
+	}{
+		{1, catalogItemIDs[0], 6},
+		{2, catalogItemIDs[0], 6},
+		{2, catalogItemIDs[1], 4},
+	}
+
+	for _, wanted := range wantedQuantities {
+		inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": wanted.userID, "catalog_item_id": wanted.catalogItemID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if inventoryItem.Quantity != wanted.quantity {
+			t.Errorf("want quantity of user %d to be %d, but got %d", wanted.userID, wanted.quantity, inventoryItem.Quantity)
+		}
+	}
+
+	// -----------------------------
+
+	// Users can own at most 3 Antidotes
+	_, err := app.CatalogItemsRepository.Upsert(context.Background(), data.CatalogItem{ID: catalogItemIDs[2], Name: "Antidote", Description: "Cures poison", MaxStack: 3, Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itemsExceedingStackLimit := []map[string]any{
+		{"userID": 1, "catalogItemID": catalogItemIDs[2], "quantity": 2},
+		{"userID": 1, "catalogItemID": catalogItemIDs[2], "quantity": 2},
+	}
+
+	limitTests := []struct {
+		testName           string
+		mode               string
+		allowPartial       bool
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Atomic batch exceeding the stack limit", "atomic", false, http.StatusUnprocessableEntity, []byte("the batch exceeds the limits of inventories, no item was granted")},
+		{"Best effort batch exceeding the stack limit", "bestEffort", false, http.StatusOK, []byte("must not exceed the maximum stack size of the catalog item")},
+		{"Partial batch exceeding the stack limit", "bestEffort", true, http.StatusOK, []byte(`"grantedQuantity": 1`)},
+	}
+
+	for _, tt := range limitTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			// Start from an empty stack
+			inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[2]})
+			if err == nil {
+				_, err = app.InventoryItemsRepository.Subtract(context.Background(), 1, catalogItemIDs[2], inventoryItem.Quantity, data.HTTPSource(1), nil)
+			}
+
+			if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+				t.Fatal(err)
+			}
+
+			body := map[string]any{}
+			body["mode"] = tt.mode
+			body["allowPartial"] = tt.allowPartial
+			body["items"] = itemsExceedingStackLimit
+
+			statusCode, _, resBody := ts.post(t, "/items/batch", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the partial batch filled the stack
+	inventoryItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.Quantity != 3 {
+		t.Errorf("want quantity to be 3, but got %d", inventoryItem.Quantity)
+	}
+}
+
+func TestCreateReservationHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	authenticationTests := []struct {
+		testName           string
+		useAuthHeader      bool
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"No Authorization header", false, "", http.StatusUnauthorized, []byte("invalid or missing authentication token")},
+		{"User does not have permission - has inventory:read", true, accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"User does not have permission - has catalog:read", true, accessTokenUser3, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+	}
+
+	for _, tt := range authenticationTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = catalogItemIDs[0]
+			body["quantity"] = 1
+
+			statusCode, _, resBody := ts.post(t, "/reservations", body, tt.useAuthHeader, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// -----------------------------
+
+	tests := []struct {
+		testName           string
+		catalogItemID      primitive.ObjectID
+		quantity           int64
+		expiresIn          int64
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"Invalid quantity (below 1)", catalogItemIDs[0], 0, 60, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid expiration (below 1 second)", catalogItemIDs[0], 1, 0, http.StatusUnprocessableEntity, []byte("must be greater than 0")},
+		{"Invalid expiration (above 1 day)", catalogItemIDs[0], 1, 86401, http.StatusUnprocessableEntity, []byte("must not be more than 86400 seconds")},
+		{"Quantity greater than owned quantity", catalogItemIDs[0], 3, 60, http.StatusUnprocessableEntity, []byte("must not exceed the available quantity owned by the user")},
+		{"Catalog item not owned by user", catalogItemIDs[3], 1, 60, http.StatusUnprocessableEntity, []byte("must not exceed the available quantity owned by the user")},
+		{"Valid reservation", catalogItemIDs[0], 1, 60, http.StatusCreated, []byte(`"quantity": 1`)},
+		{"Valid reservation of the last available item", catalogItemIDs[0], 1, 60, http.StatusCreated, []byte(`"quantity": 1`)},
+		{"Every item is reserved", catalogItemIDs[0], 1, 60, http.StatusUnprocessableEntity, []byte("must not exceed the available quantity owned by the user")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			body := map[string]any{}
+			body["userID"] = 1
+			body["catalogItemID"] = tt.catalogItemID
+			body["quantity"] = tt.quantity
+			body["expiresIn"] = tt.expiresIn
+
+			statusCode, _, resBody := ts.post(t, "/reservations", body, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that reserved items are excluded from the available quantity and cannot be subtracted
+	statusCode, _, resBody := ts.get(t, fmt.Sprintf("/users/1/items/%s", catalogItemIDs[0].Hex()), true, accessTokenUser1)
+	if statusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, statusCode)
+	}
+
+	for _, wanted := range [][]byte{[]byte(`"quantity": 2`), []byte(`"reservedQuantity": 2`), []byte(`"availableQuantity": 0`)} {
+		if !bytes.Contains(resBody, wanted) {
+			t.Errorf("want body %q to contain %q", resBody, wanted)
+		}
+	}
+
+	body := map[string]any{}
+	body["userID"] = 1
+	body["catalogItemID"] = catalogItemIDs[0]
+	body["quantity"] = 1
+
+	statusCode, _, resBody = ts.post(t, "/items/subtract", body, true, accessTokenUser1)
+	if statusCode != http.StatusUnprocessableEntity {
+		t.Errorf("want %d; got %d", http.StatusUnprocessableEntity, statusCode)
+	}
+
+	if !bytes.Contains(resBody, []byte("must not exceed the quantity owned by the user")) {
+		t.Errorf("want body %q to contain %q", resBody, "must not exceed the quantity owned by the user")
+	}
+}
+
+func TestConfirmReservationHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	// Reserve 2 of the 3 Ethers owned by user 1, and the Potions of user 1 with a reservation which already expired
+	reservation := data.Reservation{UserID: 1, CatalogItemID: catalogItemIDs[1], Quantity: 2, CreatedAt: time.Now().UTC(), ExpiresAt: time.Now().UTC().Add(time.Minute)}
+	expiredReservation := data.Reservation{UserID: 1, CatalogItemID: catalogItemIDs[0], Quantity: 2, CreatedAt: time.Now().UTC(), ExpiresAt: time.Now().UTC().Add(-time.Minute)}
+
+	for _, r := range []*data.Reservation{&reservation, &expiredReservation} {
+		err := app.InventoryItemsRepository.Reserve(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		testName           string
+		id                 string
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"User does not have permission - has inventory:read", reservation.ID.Hex(), accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid id", "invalid", accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Reservation does not exist", primitive.NewObjectID().Hex(), accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Reservation expired", expiredReservation.ID.Hex(), accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Valid confirmation", reservation.ID.Hex(), accessTokenUser1, http.StatusOK, []byte(`"remainingQuantity": 1`)},
+		{"Reservation already confirmed", reservation.ID.Hex(), accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.post(t, fmt.Sprintf("/reservations/%s/confirm", tt.id), map[string]any{}, true, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the expired reservation does not hold any item
+	inventoryItem, err := app.InventoryItemsRepository.GetWithCatalogItem(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoryItem.AvailableQuantity != 2 {
+		t.Errorf("want available quantity to be 2, but got %d", inventoryItem.AvailableQuantity)
+	}
+
+	// -----------------------------
+
+	// Reserve 1 of the 5 Hi-Potions owned by user 1
+	hiPotionReservation := data.Reservation{UserID: 1, CatalogItemID: catalogItemIDs[2], Quantity: 1, CreatedAt: time.Now().UTC(), ExpiresAt: time.Now().UTC().Add(time.Minute)}
+
+	err = app.InventoryItemsRepository.Reserve(context.Background(), &hiPotionReservation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hiPotionItem, err := app.InventoryItemsRepository.GetByFilter(context.Background(), bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentETag := inventoryItemETag(hiPotionItem.ID, hiPotionItem.Version)
+	staleETag := inventoryItemETag(hiPotionItem.ID, hiPotionItem.Version-1)
+	nextETag := inventoryItemETag(hiPotionItem.ID, hiPotionItem.Version+1)
+
+	ifMatchTests := []struct {
+		testName           string
+		ifMatch            string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"If-Match with stale ETag", staleETag, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with malformed ETag", `"invalid"`, http.StatusPreconditionFailed, []byte("the resource was modified since you last retrieved it")},
+		{"If-Match with current ETag", currentETag, http.StatusOK, []byte(`"remainingQuantity": 4`)},
+		{"Reservation confirmed by previous request", currentETag, http.StatusNotFound, []byte("The requested resource could not be found")},
+	}
+
+	for _, tt := range ifMatchTests {
+		t.Run(tt.testName, func(t *testing.T) {
+			headers := make(http.Header)
+			headers.Set("If-Match", tt.ifMatch)
+
+			statusCode, resHeaders, resBody := ts.postWithHeaders(t, fmt.Sprintf("/reservations/%s/confirm", hiPotionReservation.ID.Hex()), map[string]any{}, headers, true, accessTokenUser1)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if statusCode == http.StatusOK && resHeaders.Get("ETag") != nextETag {
+				t.Errorf("want ETag header %q; got %q", nextETag, resHeaders.Get("ETag"))
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+}
+
+func TestReleaseReservationHandler(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Seed inventory items collection
+	seedInventoryItemsCollection(t, ts, app.InventoryItemsRepository, catalogItemIDs)
+
+	// Reserve every Antidote owned by user 1
+	reservation := data.Reservation{UserID: 1, CatalogItemID: catalogItemIDs[2], Quantity: 5, CreatedAt: time.Now().UTC(), ExpiresAt: time.Now().UTC().Add(time.Minute)}
+
+	err := app.InventoryItemsRepository.Reserve(context.Background(), &reservation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName           string
+		id                 string
+		accessToken        string
+		wantedStatusCode   int
+		wantedResponseBody []byte
+	}{
+		{"User does not have permission - has inventory:read", reservation.ID.Hex(), accessTokenUser2, http.StatusForbidden, []byte("your user account doesn't have the necessary permissions to access this resource")},
+		{"Invalid id", "invalid", accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Reservation does not exist", primitive.NewObjectID().Hex(), accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+		{"Valid release", reservation.ID.Hex(), accessTokenUser1, http.StatusOK, []byte("Reservation released successfully")},
+		{"Reservation already released", reservation.ID.Hex(), accessTokenUser1, http.StatusNotFound, []byte("The requested resource could not be found")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			statusCode, _, resBody := ts.delete(t, fmt.Sprintf("/reservations/%s", tt.id), true, tt.accessToken)
+
+			if statusCode != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, statusCode)
+			}
+
+			if !bytes.Contains(resBody, tt.wantedResponseBody) {
+				t.Errorf("want body %q to contain %q", resBody, tt.wantedResponseBody)
+			}
+		})
+	}
+
+	// Check that the released items can be subtracted
+	_, err = app.InventoryItemsRepository.Subtract(context.Background(), 1, catalogItemIDs[2], 5, data.HTTPSource(1), nil)
+	if err != nil {
+		t.Errorf("want released items to be subtracted, but got %v", err)
 	}
 }
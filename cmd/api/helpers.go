@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// inventoryItemETag returns the entity tag of the given version of an inventory item.
+// It includes the id of the inventory item since versions start over when an inventory item is recreated.
+func inventoryItemETag(id primitive.ObjectID, version int32) string {
+	return fmt.Sprintf(`"%s-%d"`, id.Hex(), version)
+}
+
+// readIfMatchHeader converts the If-Match header of the given request into a precondition.
+// It returns nil if the header is not set, and false if the header holds an entity tag which was
+// not returned by our endpoints, since such a tag can never match an inventory item.
+func readIfMatchHeader(r *http.Request) (*data.Precondition, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+
+	if header == "" {
+		return nil, true
+	}
+
+	// Any existing inventory item matches
+	if header == "*" {
+		return &data.Precondition{}, true
+	}
+
+	// Our entity tags have the "<id>-<version>" format. Weak entity tags never match If-Match headers.
+	tag, err := strconv.Unquote(header)
+	if err != nil {
+		return nil, false
+	}
+
+	id, version, found := strings.Cut(tag, "-")
+	if !found {
+		return nil, false
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, false
+	}
+
+	parsedVersion, err := strconv.ParseInt(version, 10, 32)
+	if err != nil || parsedVersion < 1 {
+		return nil, false
+	}
+
+	return &data.Precondition{ID: objectID, Version: int32(parsedVersion)}, true
+}
+
+// newGrantReferences returns a new data.GrantReferences which reads our users and catalog items
+func (app *Application) newGrantReferences() *data.GrantReferences {
+	return data.NewGrantReferences(app.UsersRepository, app.CatalogItemsRepository)
+}
+
+// addInventoryLimitError adds a validation error to v when err informs that a grant exceeds the limits
+// of inventories. It returns false if err is not one of these errors.
+func addInventoryLimitError(v *validator.Validator, err error) bool {
+	switch {
+	case errors.Is(err, data.ErrStackLimitReached):
+		v.AddError("quantity", "must not exceed the maximum stack size of the catalog item")
+	case errors.Is(err, data.ErrInventoryFull):
+		v.AddError("catalogItemID", "cannot be added to the inventory of the user since it is full")
+	default:
+		return false
+	}
+
+	return true
+}
@@ -3,19 +3,19 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/PlayEconomy37/Play.Common/common"
 	"github.com/PlayEconomy37/Play.Common/configuration"
 	"github.com/PlayEconomy37/Play.Common/database"
-	"github.com/PlayEconomy37/Play.Common/events"
 	"github.com/PlayEconomy37/Play.Common/logger"
 	"github.com/PlayEconomy37/Play.Common/opentelemetry"
-	"github.com/PlayEconomy37/Play.Common/types"
 	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
 	"github.com/PlayEconomy37/Play.Inventory/internal/data"
 	"github.com/PlayEconomy37/Play.Inventory/internal/rabbitmq"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"github.com/PlayEconomy37/Play.Inventory/internal/settings"
 	"go.opentelemetry.io/otel"
 )
 
@@ -23,9 +23,18 @@ import (
 // It embeds the common packages common application struct.
 type Application struct {
 	common.App
-	CatalogItemsRepository   types.MongoRepository[primitive.ObjectID, data.CatalogItem]
-	InventoryItemsRepository types.MongoRepository[primitive.ObjectID, data.InventoryItem]
-	UsersRepository          types.MongoRepository[int64, database.User]
+	CatalogItemsRepository    *data.CatalogItemsRepository
+	InventoryItemsRepository  *data.InventoryItemsRepository
+	IdempotencyKeysRepository *data.IdempotencyKeysRepository
+	LedgerEntriesRepository   *data.LedgerEntriesRepository
+	ReservationsRepository    *data.ReservationsRepository
+	UsersRepository           *data.UsersRepository
+	MessageBroker             MessageBrokerStatus
+}
+
+// MessageBrokerStatus is an interface that reports the state of our connection to the message broker
+type MessageBrokerStatus interface {
+	IsConnected() bool
 }
 
 func main() {
@@ -38,18 +47,15 @@ func main() {
 		logger.Fatal(err, nil)
 	}
 
+	// Read settings specific to this microservice
+	settings, err := settings.LoadSettings("config/dev.json")
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
+
 	// Start MongoDB
 	mongoClient, err := database.NewMongoClient(config)
 
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err = mongoClient.Disconnect(ctx); err != nil {
-			logger.Fatal(err, nil)
-		}
-	}()
-
 	// Create "catalog_items" collection
 	err = data.CreateCatalogItemsCollection(mongoClient, constants.Database)
 	if err != nil {
@@ -62,47 +68,87 @@ func main() {
 		logger.Fatal(err, nil)
 	}
 
-	// Create "users" collection
-	err = database.CreateUsersCollection(mongoClient, constants.Database)
+	// Create "outbox_messages" collection
+	err = data.CreateOutboxMessagesCollection(mongoClient, constants.Database)
 	if err != nil {
 		logger.Fatal(err, nil)
 	}
 
-	// Initialize tracer
-	tracerProvider := opentelemetry.SetupTracer(false)
-
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+	// Create "idempotency_keys" collection
+	err = data.CreateIdempotencyKeysCollection(mongoClient, constants.Database)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
 
-		if err := tracerProvider.Shutdown(ctx); err != nil {
-			logger.Error(err, nil)
-		}
-	}()
+	// Create "reservations" collection
+	err = data.CreateReservationsCollection(mongoClient, constants.Database)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
 
-	// Connect to RabbitMQ
-	rabbitMQConnection, err := events.NewRabbitMQConnection(config)
+	// Create "transfers" collection
+	err = data.CreateTransfersCollection(mongoClient, constants.Database)
 	if err != nil {
 		logger.Fatal(err, nil)
 	}
 
-	defer rabbitMQConnection.Close()
+	// Create "ledger_entries" collection
+	err = data.CreateLedgerEntriesCollection(mongoClient, constants.Database)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
 
-	// Create users repository
-	usersRepository := database.NewMongoRepository[int64, database.User](mongoClient, constants.Database, database.UsersCollection)
+	// Create "processed_messages" collection
+	err = data.CreateProcessedMessagesCollection(mongoClient, constants.Database)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
 
-	// Create consumer
-	updatedUserConsumer, err := rabbitmq.NewUserUpdatedConsumer(rabbitMQConnection, usersRepository, config.ServiceName, logger)
+	// Create "users" collection
+	err = database.CreateUsersCollection(mongoClient, constants.Database)
 	if err != nil {
 		logger.Fatal(err, nil)
 	}
 
-	// Watch the queue and consume events
+	// Initialize tracer
+	tracerProvider := opentelemetry.SetupTracer(false)
+
+	// Create repositories
+	usersRepository := data.NewUsersRepository(mongoClient, constants.Database)
+	catalogItemsRepository := data.NewCatalogItemsRepository(mongoClient, constants.Database)
+	inventoryItemsRepository := data.NewInventoryItemsRepository(mongoClient, constants.Database, settings.Inventory.SlotCapacity)
+	outboxMessagesRepository := data.NewOutboxMessagesRepository(mongoClient, constants.Database)
+	idempotencyKeysRepository := data.NewIdempotencyKeysRepository(mongoClient, constants.Database)
+	reservationsRepository := data.NewReservationsRepository(mongoClient, constants.Database)
+	ledgerEntriesRepository := data.NewLedgerEntriesRepository(mongoClient, constants.Database)
+	processedMessagesRepository := data.NewProcessedMessagesRepository(mongoClient, constants.Database)
+
+	// Create RabbitMQ supervisor which owns our connection and keeps our consumers running
+	supervisor := rabbitmq.NewSupervisor(config, logger)
+
+	// Register consumers. Each consumer handles its messages with a pool of workers.
+	consumerOptions := rabbitmq.ConsumerOptions{
+		Workers:  settings.Consumers.Workers,
+		Prefetch: settings.Consumers.Prefetch,
+	}
+
+	supervisor.RegisterConsumer(rabbitmq.NewUserUpdatedConsumer(usersRepository, config.ServiceName, consumerOptions, logger))
+	supervisor.RegisterConsumer(rabbitmq.NewCatalogItemUpsertedConsumer(catalogItemsRepository, rabbitmq.CatalogItemCreatedEvent, config.ServiceName, consumerOptions, logger))
+	supervisor.RegisterConsumer(rabbitmq.NewCatalogItemUpsertedConsumer(catalogItemsRepository, rabbitmq.CatalogItemUpdatedEvent, config.ServiceName, consumerOptions, logger))
+	supervisor.RegisterConsumer(rabbitmq.NewCatalogItemDeletedConsumer(catalogItemsRepository, config.ServiceName, consumerOptions, logger))
+	supervisor.RegisterConsumer(rabbitmq.NewGrantItemsConsumer(inventoryItemsRepository, processedMessagesRepository, usersRepository, catalogItemsRepository, config.ServiceName, consumerOptions, logger))
+	supervisor.RegisterConsumer(rabbitmq.NewSubtractItemsConsumer(inventoryItemsRepository, processedMessagesRepository, config.ServiceName, consumerOptions, logger))
+
+	// Register outbox relay which publishes the events written along with our inventory changes
+	supervisor.RegisterConsumer(rabbitmq.NewOutboxRelay(outboxMessagesRepository, logger))
+
+	// Connect to RabbitMQ, watch the queues and consume events until consumers are stopped
+	consumersCtx, stopConsumers := context.WithCancel(context.Background())
+	consumersDone := make(chan struct{})
+
 	go func() {
-		err = updatedUserConsumer.StartConsumer()
-		if err != nil {
-			logger.Fatal(err, nil)
-		}
+		supervisor.Start(consumersCtx)
+		close(consumersDone)
 	}()
 
 	app := &Application{
@@ -111,13 +157,57 @@ func main() {
 			Logger: logger,
 			Tracer: otel.Tracer(config.ServiceName),
 		},
-		CatalogItemsRepository:   database.NewMongoRepository[primitive.ObjectID, data.CatalogItem](mongoClient, constants.Database, constants.CatalogItemsCollection),
-		InventoryItemsRepository: database.NewMongoRepository[primitive.ObjectID, data.InventoryItem](mongoClient, constants.Database, constants.InventoryItemsCollection),
-		UsersRepository:          usersRepository,
+		CatalogItemsRepository:    catalogItemsRepository,
+		InventoryItemsRepository:  inventoryItemsRepository,
+		IdempotencyKeysRepository: idempotencyKeysRepository,
+		LedgerEntriesRepository:   ledgerEntriesRepository,
+		ReservationsRepository:    reservationsRepository,
+		UsersRepository:           usersRepository,
+		MessageBroker:             supervisor,
 	}
 
-	err = app.Serve(app.routes())
-	if err != nil {
-		logger.Fatal(err, nil)
+	// Remove expired lots from inventories in the background
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	sweeperDone := make(chan struct{})
+
+	go func() {
+		app.sweepExpiredLots(sweeperCtx)
+		close(sweeperDone)
+	}()
+
+	// Create a context which is canceled when we receive a SIGINT or SIGTERM signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Serve requests until we receive a signal. We then shut down our components in order:
+	// consumers and lot sweeper, HTTP server, MongoDB and finally the tracer so that it exports every span.
+	serveErr := app.serve(ctx, app.routes(), func() {
+		app.Logger.Info("Stopping consumers", nil)
+
+		stopConsumers()
+		<-consumersDone
+
+		app.Logger.Info("Stopping lot sweeper", nil)
+
+		stopSweeper()
+		<-sweeperDone
+	})
+	if serveErr != nil {
+		logger.Error(serveErr, nil)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mongoClient.Disconnect(shutdownCtx); err != nil {
+		logger.Error(err, nil)
+	}
+
+	if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+		logger.Error(err, nil)
+	}
+
+	if serveErr != nil {
+		os.Exit(1)
 	}
 }
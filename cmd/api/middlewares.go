@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+)
+
+// maxIdempotencyKeyLength is the maximum length of the idempotency keys sent by clients
+const maxIdempotencyKeyLength = 255
+
+// contextKey is the type of the keys of the values our middlewares store in request contexts
+type contextKey string
+
+// idempotencyStateContextKey is the key of the idempotencyState of a request sent with an idempotency key
+const idempotencyStateContextKey = contextKey("idempotencyState")
+
+// idempotencyState holds the idempotency key reserved for a request and tracks whether its handler committed its changes
+type idempotencyState struct {
+	idempotencyKey data.IdempotencyKey
+	committed      bool
+}
+
+// httpSource returns the source of the changes requested by the given request. It holds the idempotency key
+// of the request, if any, so that the key is recorded as committed in the same transaction as the changes.
+func (app *Application) httpSource(r *http.Request) data.Source {
+	source := data.HTTPSource(app.ContextGetUser(r).ID)
+
+	state, ok := r.Context().Value(idempotencyStateContextKey).(*idempotencyState)
+	if ok {
+		source = source.WithIdempotencyKey(state.idempotencyKey)
+	}
+
+	return source
+}
+
+// markCommitted records that the handler of the given request committed its changes, so that its idempotency key
+// is kept even if the handler fails afterwards. It does nothing for requests sent without an idempotency key.
+func markCommitted(r *http.Request) {
+	state, ok := r.Context().Value(idempotencyStateContextKey).(*idempotencyState)
+	if ok {
+		state.committed = true
+	}
+}
+
+// responseRecorder is an http.ResponseWriter which records the response it writes
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+// WriteHeader records the status code and writes it to the wrapped http.ResponseWriter
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the given bytes and writes them to the wrapped http.ResponseWriter
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+
+	rec.body.Write(b)
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// requireActivatedUser is a middleware used to deny access to users whose account was deactivated.
+// It must be used after the Authenticate middleware, which reads the latest state of the user.
+func (app *Application) requireActivatedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.ContextGetUser(r)
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// idempotent is a middleware used to make sure that a request sent with an Idempotency-Key header is handled once.
+// Retries of the request with the same key are answered with the original response, and reusing the key
+// with a different request is rejected. Requests without an Idempotency-Key header are handled as usual.
+// It must be used after the Authenticate middleware since idempotency keys are scoped to the authenticated user.
+func (app *Application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		v.Check(len(key) <= maxIdempotencyKeyLength, "idempotencyKey", "must not be more than 255 bytes long")
+
+		if v.HasErrors() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Read the request body so that we can hash it, and restore it for the next handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.BadRequestResponse(w, r, errors.New("body must not be larger than 1MB"))
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		user := app.ContextGetUser(r)
+		requestHash := hashRequest(r, body)
+
+		idempotencyKey, reserved, err := app.IdempotencyKeysRepository.Reserve(r.Context(), user.ID, key, requestHash)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		if !reserved {
+			switch {
+			case idempotencyKey.RequestHash != requestHash:
+				v.AddError("idempotencyKey", "was already used with a different request")
+				app.FailedValidationResponse(w, r, v.Errors)
+			case idempotencyKey.Response == nil:
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				replayResponse(w, *idempotencyKey.Response)
+			}
+
+			return
+		}
+
+		state := &idempotencyState{idempotencyKey: idempotencyKey}
+		r = r.WithContext(context.WithValue(r.Context(), idempotencyStateContextKey, state))
+
+		rec := &responseRecorder{ResponseWriter: w}
+
+		// Settle the key if the handler panics, and let the RecoverPanic middleware answer the request
+		defer func() {
+			if err := recover(); err != nil {
+				if rec.statusCode == 0 {
+					rec.statusCode = http.StatusInternalServerError
+				}
+
+				app.settleIdempotencyKey(r, idempotencyKey, state, rec)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		app.settleIdempotencyKey(r, idempotencyKey, state, rec)
+	})
+}
+
+// settleIdempotencyKey records the response of a request sent with an idempotency key once it was handled.
+// The key is released instead when the handler failed with a server error before committing any change,
+// so that the request can be retried with the same key. Once changes are committed, retries are answered
+// with the recorded response since handling the request again would apply the changes twice.
+// Keys are recorded as committed along with the changes, so a key whose response could not be recorded
+// is neither released nor taken over, and its retries are answered with a conflict.
+func (app *Application) settleIdempotencyKey(r *http.Request, idempotencyKey data.IdempotencyKey, state *idempotencyState, rec *responseRecorder) {
+	var err error
+
+	// We do not use the request context since the response must be recorded even if the client is gone
+	if rec.statusCode >= http.StatusInternalServerError && !state.committed {
+		err = app.IdempotencyKeysRepository.Release(context.Background(), idempotencyKey)
+	} else {
+		err = app.IdempotencyKeysRepository.Complete(context.Background(), idempotencyKey, data.StoredResponse{
+			StatusCode: rec.statusCode,
+			Headers:    rec.Header().Clone(),
+			Body:       rec.body.Bytes(),
+		})
+	}
+
+	// The response was already sent so we can only log the error
+	if err != nil {
+		app.Logger.Error(err, map[string]string{
+			"request_method":  r.Method,
+			"request_url":     r.URL.String(),
+			"idempotency_key": idempotencyKey.Key,
+		})
+	}
+}
+
+// hashRequest returns a hash of the given request and body, which identifies
+// the request sent along with an idempotency key
+func hashRequest(r *http.Request, body []byte) string {
+	hash := sha256.New()
+
+	hash.Write([]byte(r.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.Path))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.Header.Get("If-Match")))
+	hash.Write([]byte{0})
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// replayResponse writes the given recorded response
+func replayResponse(w http.ResponseWriter, response data.StoredResponse) {
+	for key, values := range response.Headers {
+		w.Header()[key] = values
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.StatusCode)
+	w.Write(response.Body)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PlayEconomy37/Play.Common/types"
+)
+
+func TestIdempotentMiddleware(t *testing.T) {
+	app, cleanup, _ := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	user, err := app.UsersRepository.GetByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName         string
+		commit           bool
+		panics           bool
+		wantedCalls      int
+		wantedStatusCode int
+		wantedReplayed   bool
+	}{
+		{"Server error before commit", false, false, 2, http.StatusOK, false},
+		{"Server error after commit", true, false, 1, http.StatusInternalServerError, true},
+		{"Panic before commit", false, true, 2, http.StatusOK, false},
+		{"Panic after commit", true, true, 1, http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			calls := 0
+
+			// The first call fails after committing its changes or not, and the following ones succeed
+			handler := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				if calls > 1 {
+					app.WriteJSON(w, http.StatusOK, types.Envelope{"message": "Item granted successfully"}, nil)
+					return
+				}
+
+				if tt.commit {
+					markCommitted(r)
+				}
+
+				if tt.panics {
+					panic("handler failed")
+				}
+
+				app.ServerErrorResponse(w, r, errors.New("response could not be written"))
+			}))
+
+			// Panics are answered by the RecoverPanic middleware like in our routes
+			send := func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"quantity":1}`))
+				r.Header.Set("Idempotency-Key", tt.testName)
+				r = app.ContextSetUser(r, user)
+
+				rr := httptest.NewRecorder()
+				app.RecoverPanic(handler).ServeHTTP(rr, r)
+
+				return rr
+			}
+
+			rr := send()
+			if rr.Code != http.StatusInternalServerError {
+				t.Fatalf("want %d; got %d", http.StatusInternalServerError, rr.Code)
+			}
+
+			// Retry the request with the same key
+			rr = send()
+
+			if calls != tt.wantedCalls {
+				t.Errorf("want handler to be called %d times; got %d", tt.wantedCalls, calls)
+			}
+
+			if rr.Code != tt.wantedStatusCode {
+				t.Errorf("want %d; got %d", tt.wantedStatusCode, rr.Code)
+			}
+
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantedReplayed {
+				t.Errorf("want replayed response to be %t; got %t", tt.wantedReplayed, replayed)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/filters"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestCatalogItemsRepositoryVersions(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	elixirID := primitive.NewObjectID()
+
+	tests := []struct {
+		testName      string
+		upsert        *data.CatalogItem
+		deleteID      primitive.ObjectID
+		deleteVersion int32
+		wantedApplied bool
+		wantedErr     error
+		wantedExists  bool
+	}{
+		{"Delete before create", nil, elixirID, 2, true, nil, false},
+		{"Create delayed after delete", &data.CatalogItem{ID: elixirID, Name: "Elixir", Description: "Fully restores health and MP", Version: 1}, primitive.NilObjectID, 0, false, nil, false},
+		{"Update delayed after delete", &data.CatalogItem{ID: elixirID, Name: "Elixir", Description: "Fully restores health and MP", Version: 2}, primitive.NilObjectID, 0, false, nil, false},
+		{"Update newer than delete", &data.CatalogItem{ID: elixirID, Name: "Elixir", Description: "Fully restores health and MP", Version: 3}, primitive.NilObjectID, 0, true, nil, true},
+		{"Delete older than update", nil, elixirID, 2, false, nil, true},
+		{"Delete newer than update", nil, elixirID, 4, true, nil, false},
+		{"Delete again", nil, elixirID, 4, true, nil, false},
+		{"Create with the name of another item", &data.CatalogItem{ID: primitive.NewObjectID(), Name: "Potion", Description: "Restores health", Version: 1}, primitive.NilObjectID, 0, true, nil, true},
+		{"Create with the description of another item", &data.CatalogItem{ID: primitive.NewObjectID(), Name: "Super Potion", Description: "Cures poison", Version: 1}, primitive.NilObjectID, 0, true, nil, true},
+		{"Delete another item", nil, catalogItemIDs[1], 2, true, nil, false},
+		{"Create with the name of a deleted item", &data.CatalogItem{ID: elixirID, Name: "Ether", Description: "Restores a small amount of MP", Version: 5}, primitive.NilObjectID, 0, true, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			var (
+				id      primitive.ObjectID
+				applied bool
+				err     error
+			)
+
+			if tt.upsert != nil {
+				id = tt.upsert.ID
+				applied, err = app.CatalogItemsRepository.Upsert(ctx, *tt.upsert)
+			} else {
+				id = tt.deleteID
+				applied, err = app.CatalogItemsRepository.DeleteVersion(ctx, tt.deleteID, tt.deleteVersion)
+			}
+
+			if !errors.Is(err, tt.wantedErr) {
+				t.Fatalf("want error %v, but got %v", tt.wantedErr, err)
+			}
+
+			if applied != tt.wantedApplied {
+				t.Errorf("want applied to be %t, but got %t", tt.wantedApplied, applied)
+			}
+
+			_, err = app.CatalogItemsRepository.GetByID(ctx, id)
+
+			switch {
+			case tt.wantedExists && err != nil:
+				t.Errorf("want catalog item to exist, but got %v", err)
+			case !tt.wantedExists && !errors.Is(err, database.ErrRecordNotFound):
+				t.Errorf("want catalog item not to exist, but got %v", err)
+			}
+		})
+	}
+}
+
+func TestInventoryItemsRepositoryDuplicateMessages(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	grantMessageID := primitive.NewObjectID()
+	subtractMessageID := primitive.NewObjectID()
+
+	grant := func(messageID primitive.ObjectID, quantity int64) error {
+		_, _, err := app.InventoryItemsRepository.Grant(ctx, 2, catalogItemIDs[3], quantity, time.Time{}, data.MessageSource(messageID), nil, false)
+		return err
+	}
+
+	subtract := func(messageID primitive.ObjectID, quantity int64) error {
+		_, err := app.InventoryItemsRepository.Subtract(ctx, 2, catalogItemIDs[3], quantity, data.MessageSource(messageID), nil)
+		return err
+	}
+
+	tests := []struct {
+		testName       string
+		apply          func() error
+		wantedErr      error
+		wantedQuantity int64
+	}{
+		{"Grant", func() error { return grant(grantMessageID, 3) }, nil, 3},
+		{"Duplicate grant", func() error { return grant(grantMessageID, 3) }, data.ErrMessageAlreadyProcessed, 3},
+		{"Subtract every item", func() error { return subtract(subtractMessageID, 3) }, nil, 0},
+		{"Duplicate subtract after the item went to 0", func() error { return subtract(subtractMessageID, 3) }, data.ErrMessageAlreadyProcessed, 0},
+		{"Duplicate grant after the item went to 0", func() error { return grant(grantMessageID, 3) }, data.ErrMessageAlreadyProcessed, 0},
+		{"Grant again", func() error { return grant(primitive.NewObjectID(), 2) }, nil, 2},
+		{"Duplicate subtract after the item was granted again", func() error { return subtract(subtractMessageID, 3) }, data.ErrMessageAlreadyProcessed, 2},
+		{"Duplicate grant after the item was granted again", func() error { return grant(grantMessageID, 3) }, data.ErrMessageAlreadyProcessed, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			err := tt.apply()
+			if !errors.Is(err, tt.wantedErr) {
+				t.Fatalf("want error %v, but got %v", tt.wantedErr, err)
+			}
+
+			var quantity int64
+
+			item, err := app.InventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": 2, "catalog_item_id": catalogItemIDs[3]})
+			if err == nil {
+				quantity = item.Quantity
+			} else if !errors.Is(err, database.ErrRecordNotFound) {
+				t.Fatal(err)
+			}
+
+			if quantity != tt.wantedQuantity {
+				t.Errorf("want quantity to be %d, but got %d", tt.wantedQuantity, quantity)
+			}
+		})
+	}
+}
+
+func TestProcessedMessagesMigration(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	migratedMessageID := primitive.NewObjectID()
+
+	mongoClient, err := database.NewMongoClient(app.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { mongoClient.Disconnect(ctx) })
+
+	// An inventory item which recorded its processed messages before they were stored in their own collection.
+	// Our current schema does not allow message ids anymore.
+	items := mongoClient.Database(TestDatabase).Collection(constants.InventoryItemsCollection)
+
+	_, err = items.InsertOne(ctx, bson.M{
+		"user_id":         int64(2),
+		"catalog_item_id": catalogItemIDs[3],
+		"quantity":        int64(3),
+		"version":         int32(1),
+		"acquired_date":   time.Now().UTC(),
+		"message_ids":     bson.A{migratedMessageID},
+	}, options.InsertOne().SetBypassDocumentValidation(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Running the migration twice must not fail
+	for i := 0; i < 2; i++ {
+		err = data.CreateProcessedMessagesCollection(mongoClient, TestDatabase)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := items.CountDocuments(ctx, bson.M{"message_ids": bson.M{"$exists": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Errorf("want message ids to be removed from inventory items, but %d inventory items still have some", count)
+	}
+
+	_, _, err = app.InventoryItemsRepository.Grant(ctx, 2, catalogItemIDs[3], 3, time.Time{}, data.MessageSource(migratedMessageID), nil, false)
+	if !errors.Is(err, data.ErrMessageAlreadyProcessed) {
+		t.Errorf("want error %v, but got %v", data.ErrMessageAlreadyProcessed, err)
+	}
+
+	// The migrated inventory item can be updated again
+	item, _, err := app.InventoryItemsRepository.Grant(ctx, 2, catalogItemIDs[3], 2, time.Time{}, data.HTTPSource(1), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Quantity != 5 {
+		t.Errorf("want quantity to be 5, but got %d", item.Quantity)
+	}
+}
+
+func TestIdempotencyKeysRepositoryLease(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+
+	mongoClient, err := database.NewMongoClient(app.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { mongoClient.Disconnect(ctx) })
+
+	keys := mongoClient.Database(TestDatabase).Collection(constants.IdempotencyKeysCollection)
+
+	// expireLease simulates a request which did not complete in time (i.e. its instance crashed)
+	expireLease := func() {
+		_, err := keys.UpdateMany(ctx, bson.M{}, bson.M{"$set": bson.M{"locked_until": time.Now().UTC().Add(-time.Second)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, reserved, err := app.IdempotencyKeysRepository.Reserve(ctx, 1, "grant-request", "hash")
+	if err != nil || !reserved {
+		t.Fatalf("want key to be reserved, but got %t and error %v", reserved, err)
+	}
+
+	tests := []struct {
+		testName       string
+		before         func()
+		requestHash    string
+		wantedReserved bool
+	}{
+		{"Request in progress", nil, "hash", false},
+		{"Request whose lease is over", expireLease, "hash", true},
+		{"Release by the request which lost its lease", func() { app.IdempotencyKeysRepository.Release(ctx, first) }, "hash", false},
+		{"Different request whose lease is over", expireLease, "another-hash", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+
+			idempotencyKey, reserved, err := app.IdempotencyKeysRepository.Reserve(ctx, 1, "grant-request", tt.requestHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reserved != tt.wantedReserved {
+				t.Errorf("want reserved to be %t, but got %t", tt.wantedReserved, reserved)
+			}
+
+			if idempotencyKey.ID != first.ID {
+				t.Errorf("want idempotency key %s, but got %s", first.ID.Hex(), idempotencyKey.ID.Hex())
+			}
+		})
+	}
+
+	// A retry takes the key over once more, and the request which lost it cannot commit its changes
+	second, reserved, err := app.IdempotencyKeysRepository.Reserve(ctx, 1, "grant-request", "hash")
+	if err != nil || !reserved {
+		t.Fatalf("want key to be taken over, but got %t and error %v", reserved, err)
+	}
+
+	grant := func(idempotencyKey data.IdempotencyKey) error {
+		_, _, err := app.InventoryItemsRepository.Grant(ctx, 1, catalogItemIDs[0], 1, time.Time{}, data.HTTPSource(1).WithIdempotencyKey(idempotencyKey), nil, false)
+		return err
+	}
+
+	err = grant(first)
+	if !errors.Is(err, data.ErrIdempotencyKeyLost) {
+		t.Fatalf("want error %v, but got %v", data.ErrIdempotencyKeyLost, err)
+	}
+
+	err = grant(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := app.InventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": catalogItemIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Quantity != 1 {
+		t.Errorf("want the items to be granted once, but got quantity %d", item.Quantity)
+	}
+
+	// A key whose request committed its changes is neither released nor taken over, even once its lease is over
+	err = app.IdempotencyKeysRepository.Release(ctx, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expireLease()
+
+	idempotencyKey, reserved, err := app.IdempotencyKeysRepository.Reserve(ctx, 1, "grant-request", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved || idempotencyKey.ID != first.ID || !idempotencyKey.Committed || idempotencyKey.Response != nil {
+		t.Errorf("want committed key %s without response not to be reserved, but got %+v and %t", first.ID.Hex(), idempotencyKey, reserved)
+	}
+}
+
+func TestInventoryItemsRepositoryLimitsIgnoreExpiredItems(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	expiresAt := time.Now().UTC().Add(time.Second)
+	timeLimitedID := primitive.NewObjectID()
+
+	// Users can own at most 3 Mega Potions
+	_, err := app.CatalogItemsRepository.Upsert(ctx, data.CatalogItem{ID: catalogItemIDs[4], Name: "Mega Potion", Description: "Restores a small big of health", MaxStack: 3, Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grant := func(catalogItemID primitive.ObjectID, quantity int64, expiresAt time.Time) (data.InventoryItem, error) {
+		item, _, err := app.InventoryItemsRepository.Grant(ctx, 3, catalogItemID, quantity, expiresAt, data.HTTPSource(1), nil, false)
+		return item, err
+	}
+
+	// User 3 fills every slot of its inventory, with 3 Mega Potions and another item which expire soon
+	for _, catalogItemID := range catalogItemIDs[:3] {
+		_, err = grant(catalogItemID, 1, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = grant(catalogItemIDs[4], 3, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = grant(timeLimitedID, 1, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = grant(primitive.NewObjectID(), 1, time.Time{})
+	if !errors.Is(err, data.ErrInventoryFull) {
+		t.Fatalf("want error %v, but got %v", data.ErrInventoryFull, err)
+	}
+
+	time.Sleep(time.Until(expiresAt))
+
+	// Expired Mega Potions do not count toward the stack limit
+	item, err := grant(catalogItemIDs[4], 3, time.Time{})
+	if err != nil {
+		t.Fatalf("want expired items not to count toward the stack limit, but got %v", err)
+	}
+
+	if item.Quantity != 3 || len(item.Lots) != 0 {
+		t.Errorf("want 3 Mega Potions without any lot, but got %d in %d lots", item.Quantity, len(item.Lots))
+	}
+
+	// The slot of the item which expired is free
+	_, err = grant(primitive.NewObjectID(), 1, time.Time{})
+	if err != nil {
+		t.Fatalf("want the slot of expired items to be free, but got %v", err)
+	}
+
+	_, err = app.InventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": 3, "catalog_item_id": timeLimitedID})
+	if !errors.Is(err, database.ErrRecordNotFound) {
+		t.Errorf("want the expired item to be removed, but got error %v", err)
+	}
+
+	_, err = grant(primitive.NewObjectID(), 1, time.Time{})
+	if !errors.Is(err, data.ErrInventoryFull) {
+		t.Errorf("want error %v, but got %v", data.ErrInventoryFull, err)
+	}
+}
+
+func TestInventoryItemsRepositoryExpireLotsReservations(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Second)
+
+	// User 2 owns 2 Mega Potions which do not expire and 3 which expire soon, along with 2 Hi-Potions which expire soon
+	grants := []struct {
+		catalogItemID primitive.ObjectID
+		quantity      int64
+		expiresAt     time.Time
+	}{
+		{catalogItemIDs[4], 2, time.Time{}},
+		{catalogItemIDs[4], 3, expiresAt},
+		{catalogItemIDs[3], 2, expiresAt},
+	}
+
+	for _, grant := range grants {
+		_, _, err := app.InventoryItemsRepository.Grant(ctx, 2, grant.catalogItemID, grant.quantity, grant.expiresAt, data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reserve every item, oldest reservations first
+	reservations := []*data.Reservation{
+		{UserID: 2, CatalogItemID: catalogItemIDs[4], Quantity: 1, CreatedAt: now, ExpiresAt: now.Add(time.Minute)},
+		{UserID: 2, CatalogItemID: catalogItemIDs[4], Quantity: 2, CreatedAt: now.Add(time.Millisecond), ExpiresAt: now.Add(time.Minute)},
+		{UserID: 2, CatalogItemID: catalogItemIDs[4], Quantity: 2, CreatedAt: now.Add(2 * time.Millisecond), ExpiresAt: now.Add(time.Minute)},
+		{UserID: 2, CatalogItemID: catalogItemIDs[3], Quantity: 2, CreatedAt: now, ExpiresAt: now.Add(time.Minute)},
+	}
+
+	for _, reservation := range reservations {
+		err := app.InventoryItemsRepository.Reserve(ctx, reservation)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Until(expiresAt))
+
+	expired, err := app.InventoryItemsRepository.ExpireLots(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expired != 2 {
+		t.Errorf("want 2 inventory items to expire, but got %d", expired)
+	}
+
+	// The newest reservations are reduced or released so that they fit in the remaining quantity
+	tests := []struct {
+		testName       string
+		reservation    *data.Reservation
+		wantedQuantity int64
+	}{
+		{"Oldest reservation is kept", reservations[0], 1},
+		{"Reservation is reduced to the remaining quantity", reservations[1], 1},
+		{"Newest reservation is released", reservations[2], 0},
+		{"Reservation of deleted inventory item is released", reservations[3], 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			var quantity int64
+
+			reservation, err := app.ReservationsRepository.Get(ctx, tt.reservation.ID)
+			if err == nil {
+				quantity = reservation.Quantity
+			} else if !errors.Is(err, database.ErrRecordNotFound) {
+				t.Fatal(err)
+			}
+
+			if quantity != tt.wantedQuantity {
+				t.Errorf("want reserved quantity to be %d, but got %d", tt.wantedQuantity, quantity)
+			}
+		})
+	}
+
+	// The remaining items can be confirmed
+	_, remaining, err := app.InventoryItemsRepository.ConfirmReservation(ctx, reservations[1].ID, data.HTTPSource(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining.Quantity != 1 {
+		t.Errorf("want remaining quantity to be 1, but got %d", remaining.Quantity)
+	}
+}
+
+func TestLedgerEntriesRepositorySnapshotExpiredLots(t *testing.T) {
+	app, cleanup, catalogItemIDs := newTestApplication(t)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	expiresAt := time.Now().UTC().Add(time.Second)
+
+	// User 3 owns 3 Antidotes which do not expire, 2 which expire soon and 1 which expires later on
+	grants := []struct {
+		quantity  int64
+		expiresAt time.Time
+	}{
+		{3, time.Time{}},
+		{2, expiresAt},
+		{1, expiresAt.Add(time.Hour)},
+	}
+
+	for _, grant := range grants {
+		_, _, err := app.InventoryItemsRepository.Grant(ctx, 3, catalogItemIDs[2], grant.quantity, grant.expiresAt, data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ledger entries are stored with a millisecond precision
+	time.Sleep(10 * time.Millisecond)
+	beforeExpiry := time.Now().UTC()
+
+	time.Sleep(time.Until(expiresAt.Add(10 * time.Millisecond)))
+	afterExpiry := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+
+	// Expired items cannot be subtracted and items expiring first are subtracted first,
+	// so the subtracted Antidote is the one expiring later on. The expiry is recorded afterwards.
+	_, err := app.InventoryItemsRepository.Subtract(ctx, 3, catalogItemIDs[2], 1, data.HTTPSource(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.InventoryItemsRepository.ExpireLots(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	tests := []struct {
+		testName       string
+		asOf           time.Time
+		wantedQuantity int64
+	}{
+		{"Before expiry", beforeExpiry, 6},
+		{"After expiry before it was recorded", afterExpiry, 4},
+		{"After the expiry was recorded", time.Now().UTC(), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			input := filters.Filters{Page: 1, PageSize: 20, Sort: "_id", SortSafelist: []string{"_id"}}
+
+			items, _, err := app.LedgerEntriesRepository.GetSnapshot(ctx, 3, tt.asOf, bson.M{}, bson.M{}, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(items) != 1 {
+				t.Fatalf("want 1 inventory item, but got %d", len(items))
+			}
+
+			if items[0].Quantity != tt.wantedQuantity {
+				t.Errorf("want quantity to be %d, but got %d", tt.wantedQuantity, items[0].Quantity)
+			}
+		})
+	}
+
+	// Replaying the ledger without a date keeps recorded quantities, so the stored inventory matches it
+	drifts, err := app.InventoryItemsRepository.Reconcile(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drifts) != 0 {
+		t.Errorf("want no drift but got %v", drifts)
+	}
+}
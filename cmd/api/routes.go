@@ -25,9 +25,38 @@ func (app *Application) routes() http.Handler {
 
 	router.Route("/items", func(r chi.Router) {
 		r.Use(app.Authenticate(app.UsersRepository, app.Config.RSA.PublicKey))
+		r.Use(app.requireActivatedUser)
 
 		r.With(app.RequirePermission(app.UsersRepository, "inventory:read")).Get("/", app.getInventoryItemsHandler)
-		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Post("/", app.grantItemsHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:read")).Get("/me", app.getMyInventoryItemsHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:read")).Get("/history", app.getInventoryHistoryHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:read")).Get("/{id}", app.getInventoryItemHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write"), app.idempotent).Post("/", app.grantItemsHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write"), app.idempotent).Post("/batch", app.batchGrantItemsHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Post("/subtract", app.subtractItemsHandler)
+	})
+
+	router.Route("/reservations", func(r chi.Router) {
+		r.Use(app.Authenticate(app.UsersRepository, app.Config.RSA.PublicKey))
+		r.Use(app.requireActivatedUser)
+
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Post("/", app.createReservationHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Post("/{id}/confirm", app.confirmReservationHandler)
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Delete("/{id}", app.releaseReservationHandler)
+	})
+
+	router.Route("/transfers", func(r chi.Router) {
+		r.Use(app.Authenticate(app.UsersRepository, app.Config.RSA.PublicKey))
+		r.Use(app.requireActivatedUser)
+
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:write")).Post("/", app.createTransferHandler)
+	})
+
+	router.Route("/users", func(r chi.Router) {
+		r.Use(app.Authenticate(app.UsersRepository, app.Config.RSA.PublicKey))
+		r.Use(app.requireActivatedUser)
+
+		r.With(app.RequirePermission(app.UsersRepository, "inventory:read")).Get("/{userID}/items/{catalogItemID}", app.getUserInventoryItemHandler)
 	})
 
 	router.Get("/metrics", promhttp.Handler().ServeHTTP)
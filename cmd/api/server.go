@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// serve starts an HTTP server and blocks until the given context is canceled. It then calls
+// beforeShutdown, gracefully shuts down the HTTP server and waits for our background goroutines.
+// It is modeled on the Serve method of our common application struct, which handles signals
+// itself and does not let us stop other components before the HTTP server.
+func (app *Application) serve(ctx context.Context, router http.Handler, beforeShutdown func()) error {
+	// Initialize a tls.Config struct to hold the non-default TLS settings we want
+	// the server to use
+	tlsConfig := &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+
+	// Declare a HTTP server
+	server := &http.Server{
+		Addr:         app.Config.Address,
+		Handler:      router,
+		ErrorLog:     log.New(app.Logger, "", 0),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		TLSConfig:    tlsConfig,
+	}
+
+	// Start server in a background goroutine so that we can wait for the context in the meantime
+	serverError := make(chan error, 1)
+
+	go func() {
+		app.Logger.Info("Starting server", map[string]string{
+			"addr": server.Addr,
+		})
+
+		serverError <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverError:
+		// The server failed to start (i.e. the address is already in use)
+		return err
+	case <-ctx.Done():
+	}
+
+	app.Logger.Info("Shutting down server", map[string]string{
+		"addr": server.Addr,
+	})
+
+	beforeShutdown()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Shutdown() stops accepting new requests and waits for in-flight requests to complete
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+
+	// ListenAndServe() returns http.ErrServerClosed once Shutdown() is called
+	err = <-serverError
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	app.Logger.Info("Completing background tasks", map[string]string{
+		"addr": server.Addr,
+	})
+
+	// Wait for the background goroutines started with app.Background() to complete
+	app.WaitGroup.Wait()
+
+	app.Logger.Info("Stopped server", map[string]string{
+		"addr": server.Addr,
+	})
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	// lotSweepInterval is the time the lot sweeper waits before looking for expired lots again
+	// once it removed all of them
+	lotSweepInterval = time.Minute
+
+	// lotSweepBatchSize is the maximum number of inventory items the lot sweeper updates at once
+	lotSweepBatchSize = 100
+)
+
+// sweepExpiredLots removes the expired lots of inventory items until the given context is canceled.
+// Our reads already leave expired lots out, so they do not need to be removed as soon as they expire.
+func (app *Application) sweepExpiredLots(ctx context.Context) {
+	for {
+		expired, err := app.InventoryItemsRepository.ExpireLots(ctx, lotSweepBatchSize)
+		if err != nil && ctx.Err() == nil {
+			app.Logger.Error(err, nil)
+		}
+
+		if expired != 0 {
+			app.Logger.Info("Removed expired lots", map[string]string{
+				"items": strconv.Itoa(expired),
+			})
+		}
+
+		// Keep going right away if there might be more expired lots waiting
+		if err == nil && expired == lotSweepBatchSize {
+			continue
+		}
+
+		select {
+		case <-time.After(lotSweepInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
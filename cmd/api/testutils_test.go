@@ -41,6 +41,9 @@ const (
 
 	// TestDatabase is a constant that defines the name of the database we use when we run tests
 	TestDatabase = constants.Database + "_test"
+
+	// testSlotCapacity is the number of distinct catalog items an user can own when we run tests
+	testSlotCapacity = 5
 )
 
 var tracerProvider = opentelemetry.SetupTracer(true)
@@ -81,6 +84,42 @@ func newTestApplication(t *testing.T) (*Application, func(), []primitive.ObjectI
 		t.Fatal(err, nil)
 	}
 
+	// Create "outbox_messages" collection in test database
+	err = data.CreateOutboxMessagesCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
+	// Create "idempotency_keys" collection in test database
+	err = data.CreateIdempotencyKeysCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
+	// Create "reservations" collection in test database
+	err = data.CreateReservationsCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
+	// Create "transfers" collection in test database
+	err = data.CreateTransfersCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
+	// Create "ledger_entries" collection in test database
+	err = data.CreateLedgerEntriesCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
+	// Create "processed_messages" collection in test database
+	err = data.CreateProcessedMessagesCollection(mongoClient, TestDatabase)
+	if err != nil {
+		t.Fatal(err, nil)
+	}
+
 	// Create "users" collection
 	err = database.CreateUsersCollection(mongoClient, TestDatabase)
 	if err != nil {
@@ -88,8 +127,8 @@ func newTestApplication(t *testing.T) (*Application, func(), []primitive.ObjectI
 	}
 
 	// Create users and catalog items repositories
-	usersRepository := database.NewMongoRepository[int64, database.User](mongoClient, TestDatabase, database.UsersCollection)
-	catalogItemsRepository := database.NewMongoRepository[primitive.ObjectID, data.CatalogItem](mongoClient, TestDatabase, constants.CatalogItemsCollection)
+	usersRepository := data.NewUsersRepository(mongoClient, TestDatabase)
+	catalogItemsRepository := data.NewCatalogItemsRepository(mongoClient, TestDatabase)
 
 	// Seed users
 	seedUsersCollection(t, usersRepository)
@@ -121,12 +160,25 @@ func newTestApplication(t *testing.T) (*Application, func(), []primitive.ObjectI
 			Logger: logger,
 			Tracer: tracerProvider.Tracer(config.ServiceName),
 		},
-		InventoryItemsRepository: database.NewMongoRepository[primitive.ObjectID, data.InventoryItem](mongoClient, TestDatabase, constants.InventoryItemsCollection),
-		CatalogItemsRepository:   catalogItemsRepository,
-		UsersRepository:          usersRepository,
+		InventoryItemsRepository:  data.NewInventoryItemsRepository(mongoClient, TestDatabase, testSlotCapacity),
+		CatalogItemsRepository:    catalogItemsRepository,
+		IdempotencyKeysRepository: data.NewIdempotencyKeysRepository(mongoClient, TestDatabase),
+		LedgerEntriesRepository:   data.NewLedgerEntriesRepository(mongoClient, TestDatabase),
+		ReservationsRepository:    data.NewReservationsRepository(mongoClient, TestDatabase),
+		UsersRepository:           usersRepository,
 	}, cleanup, catalogItemIDs
 }
 
+// testMessageBroker is a stub used to control the message broker state reported by our application
+type testMessageBroker struct {
+	connected bool
+}
+
+// IsConnected returns whether the stub reports being connected to the message broker
+func (broker testMessageBroker) IsConnected() bool {
+	return broker.connected
+}
+
 // Define a custom testServer type which anonymously embeds a httptest.Server
 // instance.
 type testServer struct {
@@ -141,8 +193,8 @@ func newTestServer(t *testing.T, router http.Handler) *testServer {
 	return &testServer{ts}
 }
 
-// makeRequest is a helper method that creates a request with the given method and body
-func (ts *testServer) makeRequest(t *testing.T, method string, urlPath string, body map[string]any, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
+// makeRequest is a helper method that creates a request with the given method, body and additional headers
+func (ts *testServer) makeRequest(t *testing.T, method string, urlPath string, body map[string]any, headers http.Header, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
 	var requestBody io.Reader
 
 	if len(body) != 0 {
@@ -164,6 +216,10 @@ func (ts *testServer) makeRequest(t *testing.T, method string, urlPath string, b
 
 	req.Header.Set("Content-Type", "application/json")
 
+	for key := range headers {
+		req.Header.Set(key, headers.Get(key))
+	}
+
 	// Set Authorization header if `useAuthHeader` is true
 	if useAuthHeader {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
@@ -189,12 +245,22 @@ func (ts *testServer) makeRequest(t *testing.T, method string, urlPath string, b
 
 // get is a helper method for sending GET requests to the test server
 func (ts *testServer) get(t *testing.T, urlPath string, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
-	return ts.makeRequest(t, "GET", urlPath, map[string]any{}, useAuthHeader, accessToken)
+	return ts.makeRequest(t, "GET", urlPath, map[string]any{}, nil, useAuthHeader, accessToken)
 }
 
 // post is a helper method for sending POST requests to the test server
 func (ts *testServer) post(t *testing.T, urlPath string, body map[string]any, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
-	return ts.makeRequest(t, "POST", urlPath, body, useAuthHeader, accessToken)
+	return ts.makeRequest(t, "POST", urlPath, body, nil, useAuthHeader, accessToken)
+}
+
+// delete is a helper method for sending DELETE requests to the test server
+func (ts *testServer) delete(t *testing.T, urlPath string, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
+	return ts.makeRequest(t, "DELETE", urlPath, map[string]any{}, nil, useAuthHeader, accessToken)
+}
+
+// postWithHeaders is a helper method for sending POST requests with additional headers to the test server
+func (ts *testServer) postWithHeaders(t *testing.T, urlPath string, body map[string]any, headers http.Header, useAuthHeader bool, accessToken string) (int, http.Header, []byte) {
+	return ts.makeRequest(t, "POST", urlPath, body, headers, useAuthHeader, accessToken)
 }
 
 // seedCatalogItemsCollection inserts some catalog items into the database
@@ -265,14 +331,15 @@ func seedUsersCollection(t *testing.T, repository types.MongoRepository[int64, d
 	}
 
 	// Users are already in the database
-	if len(fetchedUsers) == 3 {
+	if len(fetchedUsers) == 4 {
 		return
 	}
 
 	users := []database.User{
-		{ID: 1, Permissions: permissions.Permissions{"inventory:read", "inventory:write"}, Activated: true, Version: 2},
+		{ID: 1, Permissions: permissions.Permissions{"inventory:read", "inventory:write", "inventory:admin"}, Activated: true, Version: 2},
 		{ID: 2, Permissions: permissions.Permissions{"inventory:read"}, Activated: true, Version: 2},
 		{ID: 3, Permissions: permissions.Permissions{"catalog:read"}, Activated: true, Version: 2},
+		{ID: 4, Permissions: permissions.Permissions{}, Activated: false, Version: 1},
 	}
 
 	for i := range users {
@@ -0,0 +1,151 @@
+// Command replay recomputes the inventory items of our users from the inventory ledger and reports the
+// drift between the stored and the recomputed quantities. When run with the -apply flag, it also sets
+// the stored quantities to the recomputed ones.
+//
+// Inventory items granted before the ledger was introduced are replayed from the quantity they had before their
+// first ledger entry. Those which did not change since do not have any ledger entry, so they are reported as
+// untracked and never repaired. Check the report before applying it.
+//
+// Usage:
+//
+//	go run ./cmd/replay [-config config/dev.json] [-user 1] [-apply]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/configuration"
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/settings"
+)
+
+func main() {
+	configPath := flag.String("config", "config/dev.json", "Path of the configuration file")
+	userID := flag.Int64("user", 0, "ID of the user whose inventory is replayed (all users if not set)")
+	apply := flag.Bool("apply", false, "Set the stored quantities to the recomputed ones")
+	flag.Parse()
+
+	// Setup logger
+	logger := logger.New(os.Stderr, logger.LevelInfo)
+
+	// Read configuration
+	config, err := configuration.LoadConfig(*configPath)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
+
+	// Read settings specific to this microservice
+	settings, err := settings.LoadSettings(*configPath)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
+
+	// Start MongoDB
+	mongoClient, err := database.NewMongoClient(config)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
+
+	// Repaired inventory items use a free slot of the inventory of their user when there is one
+	repository := data.NewInventoryItemsRepository(mongoClient, constants.Database, settings.Inventory.SlotCapacity)
+
+	failed, err := replay(context.Background(), repository, *userID, *apply, os.Stdout, logger)
+	if err != nil {
+		logger.Fatal(err, nil)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mongoClient.Disconnect(shutdownCtx); err != nil {
+		logger.Error(err, nil)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replay recomputes the inventory of the given user, or of every user if it is 0, from the inventory ledger
+// and writes a report of the drifts to w. When apply is true, drifted inventory items are repaired.
+// It returns whether some inventory items could not be repaired.
+func replay(ctx context.Context, repository *data.InventoryItemsRepository, userID int64, apply bool, w io.Writer, logger *logger.Logger) (bool, error) {
+	// Replay the inventory of every user unless one was given
+	userIDs := []int64{userID}
+
+	if userID == 0 {
+		var err error
+
+		userIDs, err = repository.UserIDs(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var drifts []data.Drift
+
+	for _, id := range userIDs {
+		userDrifts, err := repository.Reconcile(ctx, id)
+		if err != nil {
+			return false, fmt.Errorf("user %d: %w", id, err)
+		}
+
+		drifts = append(drifts, userDrifts...)
+	}
+
+	// Report drifts
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCATALOG ITEM\tSTORED\tRECOMPUTED\tSTATUS")
+
+	failed := false
+
+	for _, drift := range drifts {
+		status := "drift"
+
+		switch {
+		case drift.Untracked && apply:
+			// Untracked inventory items would be deleted since they do not have any ledger entry
+			status = "untracked, not repaired"
+		case drift.Untracked:
+			status = "untracked"
+		case apply:
+			var err error
+
+			drift, err = repository.Repair(ctx, drift.UserID, drift.CatalogItemID)
+
+			switch {
+			case errors.Is(err, data.ErrNegativeBalance):
+				status = "negative balance, not repaired"
+				failed = true
+			case errors.Is(err, data.ErrUntrackedInventoryItem):
+				status = "untracked, not repaired"
+			case err != nil:
+				status = "repair failed"
+				failed = true
+				logger.Error(err, map[string]string{"user_id": fmt.Sprint(drift.UserID), "catalog_item_id": drift.CatalogItemID.Hex()})
+			case drift.StoredQuantity == drift.RecomputedQuantity:
+				status = "resolved concurrently"
+			default:
+				status = "repaired"
+			}
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\n", drift.UserID, drift.CatalogItemID.Hex(), drift.StoredQuantity, drift.RecomputedQuantity, status)
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d inventory items drifted from the ledger across %d users\n", len(drifts), len(userIDs))
+
+	return failed, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/testutils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testDatabase is a constant that defines the name of the database we use when we run tests
+const testDatabase = constants.Database + "_replay_test"
+
+// newTestDatabase connects to MongoDB and creates the collections of our test database,
+// which is dropped once the test ends
+func newTestDatabase(t *testing.T) *mongo.Client {
+	return testutils.NewTestDatabase(t, testDatabase)
+}
+
+func TestReplay(t *testing.T) {
+	repository := data.NewInventoryItemsRepository(newTestDatabase(t), testDatabase, 4)
+
+	ctx := context.Background()
+	untrackedID := primitive.NewObjectID()
+	preLedgerID := primitive.NewObjectID()
+	timeLimitedID := primitive.NewObjectID()
+	deletedID := primitive.NewObjectID()
+
+	// Inventory items granted before our ledger was introduced, one of which was granted again since
+	for _, catalogItemID := range []primitive.ObjectID{untrackedID, preLedgerID} {
+		_, err := repository.Create(ctx, data.InventoryItem{UserID: 1, CatalogItemID: catalogItemID, Quantity: 5, Version: 1, AcquiredDate: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grants := []struct {
+		catalogItemID primitive.ObjectID
+		expiresAt     time.Time
+	}{
+		{preLedgerID, time.Time{}},
+		{timeLimitedID, time.Now().Add(time.Hour)},
+		{deletedID, time.Time{}},
+	}
+
+	for _, grant := range grants {
+		_, _, err := repository.Grant(ctx, 1, grant.catalogItemID, 2, grant.expiresAt, data.HTTPSource(1), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make the time-limited inventory item drift along with its lots, and delete another one without our ledger
+	timeLimitedItem, err := repository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": timeLimitedID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeLimitedItem.Quantity = 4
+	timeLimitedItem.Lots[0].Quantity = 4
+
+	err = repository.Update(ctx, timeLimitedItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deletedItem, err := repository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": deletedID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repository.Delete(ctx, deletedItem.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	failed, err := replay(ctx, repository, 1, true, &out, logger.New(io.Discard, logger.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed {
+		t.Errorf("want every drift to be handled, but got report %q", out.String())
+	}
+
+	// The untracked inventory item is reported but not repaired
+	wantedCounts := []struct {
+		status string
+		count  int
+	}{
+		{"untracked, not repaired", 1},
+		{"repaired", 3},
+		{"3 inventory items drifted", 1},
+	}
+
+	for _, wanted := range wantedCounts {
+		if count := bytes.Count(out.Bytes(), []byte(wanted.status)); count != wanted.count {
+			t.Errorf("want report %q to contain %q %d times, but got %d", out.String(), wanted.status, wanted.count, count)
+		}
+	}
+
+	tests := []struct {
+		testName       string
+		catalogItemID  primitive.ObjectID
+		wantedQuantity int64
+		wantedLots     int64
+	}{
+		{"Untracked inventory item is kept", untrackedID, 5, 0},
+		{"Inventory item granted before the ledger starts from its previous quantity", preLedgerID, 7, 0},
+		{"Lots are reduced to the recomputed quantity", timeLimitedID, 2, 2},
+		{"Deleted inventory item is recreated", deletedID, 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			item, err := repository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": tt.catalogItemID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if item.Quantity != tt.wantedQuantity {
+				t.Errorf("want quantity to be %d, but got %d", tt.wantedQuantity, item.Quantity)
+			}
+
+			var lots int64
+
+			for _, lot := range item.Lots {
+				lots += lot.Quantity
+			}
+
+			if lots != tt.wantedLots {
+				t.Errorf("want lots to hold %d items, but got %d", tt.wantedLots, lots)
+			}
+		})
+	}
+
+	// The recreated inventory item uses the first free slot, which it used before
+	item, err := repository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": deletedID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Slot == nil || *item.Slot != *deletedItem.Slot {
+		t.Errorf("want slot %v, but got %v", deletedItem.Slot, item.Slot)
+	}
+}
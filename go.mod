@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/PlayEconomy37/Play.Common v1.0.73
 	github.com/go-chi/chi/v5 v5.0.7
+	github.com/knadh/koanf v1.4.3
 	github.com/prometheus/client_golang v1.13.0
 	github.com/riandyrn/otelchi v0.4.0
 	go.mongodb.org/mongo-driver v1.10.2
@@ -25,7 +26,6 @@ require (
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/klauspost/compress v1.15.11 // indirect
-	github.com/knadh/koanf v1.4.3 // indirect
 	github.com/lib/pq v1.10.7 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.2 // indirect
 	github.com/mitchellh/copystructure v1.2.0 // indirect
@@ -34,7 +34,7 @@ require (
 	github.com/montanaflynn/stats v0.6.6 // indirect
 	github.com/pascaldekloe/jwt v1.12.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.37.0 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
 	github.com/rabbitmq/amqp091-go v1.5.0
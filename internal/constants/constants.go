@@ -9,4 +9,22 @@ const (
 
 	// InventoryItemsCollection is a constant that defines the inventory items collection name
 	InventoryItemsCollection = "inventory_items"
+
+	// IdempotencyKeysCollection is a constant that defines the idempotency keys collection name
+	IdempotencyKeysCollection = "idempotency_keys"
+
+	// LedgerEntriesCollection is a constant that defines the ledger entries collection name
+	LedgerEntriesCollection = "ledger_entries"
+
+	// OutboxMessagesCollection is a constant that defines the outbox messages collection name
+	OutboxMessagesCollection = "outbox_messages"
+
+	// ProcessedMessagesCollection is a constant that defines the processed messages collection name
+	ProcessedMessagesCollection = "processed_messages"
+
+	// ReservationsCollection is a constant that defines the reservations collection name
+	ReservationsCollection = "reservations"
+
+	// TransfersCollection is a constant that defines the transfers collection name
+	TransfersCollection = "transfers"
 )
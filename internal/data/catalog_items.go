@@ -2,7 +2,11 @@ package data
 
 import (
 	"context"
+	"errors"
+	"regexp"
 
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/types"
 	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -10,12 +14,19 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// CatalogItem is a struct that defines a catalog item in our application
+// CatalogItem is a struct that defines a catalog item in our application.
+// Names and descriptions are unique in the Catalog microservice, but not in our copy of the catalog:
+// the events of a catalog item renamed after another one may be handled before the events of the other one.
+// MaxStack is the maximum quantity of the catalog item an user can own, and is 0 when it is not limited.
+// Deleted catalog items are kept as tombstones holding their id, their version and Deleted only,
+// so that events older than their deletion cannot bring them back.
 type CatalogItem struct {
 	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Name        string             `json:"name" bson:"name"`
-	Description string             `json:"description" bson:"description"`
+	Name        string             `json:"name" bson:"name,omitempty"`
+	Description string             `json:"description" bson:"description,omitempty"`
+	MaxStack    int64              `json:"maxStack,omitempty" bson:"max_stack,omitempty"`
 	Version     int32              `json:"version" bson:"version"`
+	Deleted     bool               `json:"-" bson:"deleted,omitempty"`
 }
 
 // GetID returns the id of a catalog item.
@@ -38,6 +49,167 @@ func (i CatalogItem) SetVersion(version int32) CatalogItem {
 	return i
 }
 
+// CatalogItemsRepository is a MongoDB repository for catalog items. It embeds our generic
+// repository and adds the version-aware writes used to keep our copy of the catalog in sync.
+type CatalogItemsRepository struct {
+	types.MongoRepository[primitive.ObjectID, CatalogItem]
+	collection *mongo.Collection
+}
+
+// NewCatalogItemsRepository creates a new catalog items repository
+func NewCatalogItemsRepository(client *mongo.Client, databaseName string) *CatalogItemsRepository {
+	return &CatalogItemsRepository{
+		MongoRepository: database.NewMongoRepository[primitive.ObjectID, CatalogItem](client, databaseName, constants.CatalogItemsCollection),
+		collection:      client.Database(databaseName).Collection(constants.CatalogItemsCollection),
+	}
+}
+
+// GetByID retrieves the catalog item with the given id.
+// It returns database.ErrRecordNotFound if the catalog item does not exist or was deleted.
+func (repo *CatalogItemsRepository) GetByID(ctx context.Context, id primitive.ObjectID) (CatalogItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var item CatalogItem
+
+	err := repo.collection.FindOne(ctx, bson.M{"_id": id, "deleted": bson.M{"$ne": true}}).Decode(&item)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return item, database.ErrRecordNotFound
+		}
+
+		return item, err
+	}
+
+	return item, nil
+}
+
+// Upsert inserts the given catalog item or replaces the stored one if the given item has a newer version.
+// Deleted catalog items are brought back by newer versions only.
+// It returns false when the stored catalog item already has the same or a newer version.
+func (repo *CatalogItemsRepository) Upsert(ctx context.Context, item CatalogItem) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":     item.ID,
+		"version": bson.M{"$lt": item.Version},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":        item.Name,
+			"description": item.Description,
+			"version":     item.Version,
+		},
+	}
+
+	unset := bson.M{"deleted": ""}
+
+	// Catalog items without a maximum stack size do not store one
+	if item.MaxStack > 0 {
+		update["$set"].(bson.M)["max_stack"] = item.MaxStack
+	} else {
+		unset["max_stack"] = ""
+	}
+
+	update["$unset"] = unset
+
+	_, err := repo.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		// When the stored item is up to date our filter does not match any document,
+		// so MongoDB tries to insert a new document with an id that already exists
+		if isDuplicateKeyOn(err, "_id_") {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteVersion replaces the catalog item with the given id by a tombstone holding the given version,
+// as long as its stored version is not newer. The tombstone is created if we do not know the catalog item
+// yet, so that its created event is ignored if it arrives after its deleted event.
+// It returns false when the stored catalog item has a newer version.
+func (repo *CatalogItemsRepository) DeleteVersion(ctx context.Context, id primitive.ObjectID, version int32) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":     id,
+		"version": bson.M{"$lte": version},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"deleted": true,
+			"version": version,
+		},
+		"$unset": bson.M{
+			"name":        "",
+			"description": "",
+			"max_stack":   "",
+		},
+	}
+
+	_, err := repo.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		// The stored catalog item has a newer version, so our filter does not match it
+		if isDuplicateKeyOn(err, "_id_") {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SearchIDsByName returns the ids of the catalog items whose name matches the given search.
+// A catalog item matches if its name contains one of the words of the search (using our text index)
+// or if its name starts with the search, ignoring case.
+func (repo *CatalogItemsRepository) SearchIDsByName(ctx context.Context, name string) ([]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// MongoDB does not allow combining a text search with a non indexed condition,
+	// so we run one query per condition
+	searchFilters := []bson.M{
+		{"$text": bson.M{"$search": name}},
+		{"name": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(name), Options: "i"}},
+	}
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+
+	ids := []primitive.ObjectID{}
+	found := map[primitive.ObjectID]bool{}
+
+	for _, filter := range searchFilters {
+		cursor, err := repo.collection.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []CatalogItem
+
+		err = cursor.All(ctx, &items)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			if !found[item.ID] {
+				found[item.ID] = true
+				ids = append(ids, item.ID)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
 // CreateCatalogItemsCollection creates catalog items collection in MongoDB database
 func CreateCatalogItemsCollection(client *mongo.Client, databaseName string) error {
 	db := client.Database(databaseName)
@@ -45,7 +217,7 @@ func CreateCatalogItemsCollection(client *mongo.Client, databaseName string) err
 	// JSON validation schema
 	jsonSchema := bson.M{
 		"bsonType":             "object",
-		"required":             []string{"name", "description", "version"},
+		"required":             []string{"version"},
 		"additionalProperties": false,
 		"properties": bson.M{
 			"_id": bson.M{
@@ -60,11 +232,25 @@ func CreateCatalogItemsCollection(client *mongo.Client, databaseName string) err
 				"bsonType":    "string",
 				"description": "Description of the item",
 			},
+			"max_stack": bson.M{
+				"bsonType":    "long",
+				"minimum":     1,
+				"description": "Maximum quantity of the item an user can own",
+			},
 			"version": bson.M{
 				"bsonType":    "int",
 				"minimum":     1,
 				"description": "Document version",
 			},
+			"deleted": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the item was deleted",
+			},
+		},
+		// Catalog items which are not deleted must have a name and a description
+		"oneOf": bson.A{
+			bson.M{"required": []string{"deleted"}},
+			bson.M{"required": []string{"name", "description"}},
 		},
 	}
 
@@ -72,24 +258,27 @@ func CreateCatalogItemsCollection(client *mongo.Client, databaseName string) err
 		"$jsonSchema": jsonSchema,
 	}
 
-	// Create collection
-	opts := options.CreateCollection().SetValidator(validator)
-	err := db.CreateCollection(context.Background(), constants.CatalogItemsCollection, opts)
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.CatalogItemsCollection, validator)
 	if err != nil {
-		// Returns error if collection already exists so we ignore it
-		return nil
+		return err
 	}
 
-	// Create unique and text indexes
+	// Drop the unique indexes on names and descriptions we used to have, since our copy of the catalog
+	// may temporarily hold several catalog items with the same name or description
+	for _, name := range []string{"name_1", "description_1", "name_unique", "description_unique"} {
+		_, err = db.Collection(constants.CatalogItemsCollection).Indexes().DropOne(context.Background(), name)
+
+		var cmdErr mongo.CommandError
+
+		// IndexNotFound
+		if err != nil && (!errors.As(err, &cmdErr) || cmdErr.Code != 27) {
+			return err
+		}
+	}
+
+	// Create text index
 	indexModels := []mongo.IndexModel{
-		{
-			Keys:    bson.M{"name": 1},
-			Options: options.Index().SetUnique(true),
-		},
-		{
-			Keys:    bson.M{"description": 1},
-			Options: options.Index().SetUnique(true),
-		},
 		{
 			Keys: bson.M{"name": "text"},
 		},
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"context"
+	"errors"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GrantReferences checks that the users and catalog items referenced by granted inventory items exist,
+// so that grants do not create inventory items which our reads then hide.
+// It remembers the result of every check so that each user and catalog item is read once.
+type GrantReferences struct {
+	usersRepository        *UsersRepository
+	catalogItemsRepository *CatalogItemsRepository
+	users                  map[int64]bool
+	catalogItems           map[primitive.ObjectID]bool
+}
+
+// NewGrantReferences returns a new GrantReferences
+func NewGrantReferences(usersRepository *UsersRepository, catalogItemsRepository *CatalogItemsRepository) *GrantReferences {
+	return &GrantReferences{
+		usersRepository:        usersRepository,
+		catalogItemsRepository: catalogItemsRepository,
+		users:                  make(map[int64]bool),
+		catalogItems:           make(map[primitive.ObjectID]bool),
+	}
+}
+
+// Check adds a validation error to v for the user and the catalog item of the given inventory item
+// if they do not exist
+func (refs *GrantReferences) Check(ctx context.Context, v *validator.Validator, item InventoryItem) error {
+	userExists, ok := refs.users[item.UserID]
+	if !ok {
+		_, err := refs.usersRepository.GetByID(ctx, item.UserID)
+		if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+			return err
+		}
+
+		userExists = err == nil
+		refs.users[item.UserID] = userExists
+	}
+
+	catalogItemExists, ok := refs.catalogItems[item.CatalogItemID]
+	if !ok {
+		_, err := refs.catalogItemsRepository.GetByID(ctx, item.CatalogItemID)
+		if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+			return err
+		}
+
+		catalogItemExists = err == nil
+		refs.catalogItems[item.CatalogItemID] = catalogItemExists
+	}
+
+	v.Check(userExists, "userID", "must be an existing user")
+	v.Check(catalogItemExists, "catalogItemID", "must be an existing catalog item")
+
+	return nil
+}
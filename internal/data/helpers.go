@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultTimeout is a constant that defines the default context timeout
+// for database operations
+const defaultTimeout = 3 * time.Second
+
+// isDuplicateKeyOn returns whether err informs of a duplicate key error raised by the index with the given name
+func isDuplicateKeyOn(err error, indexName string) bool {
+	var serverErr mongo.ServerError
+
+	if errors.As(err, &serverErr) {
+		return serverErr.HasErrorCodeWithMessage(11000, fmt.Sprintf("index: %s ", indexName))
+	}
+
+	return false
+}
+
+// createOrUpdateCollection creates the collection with the given name and validator.
+// If the collection already exists, its validator is replaced so that existing databases get our latest schema.
+func createOrUpdateCollection(db *mongo.Database, name string, validator bson.M) error {
+	opts := options.CreateCollection().SetValidator(validator)
+
+	err := db.CreateCollection(context.Background(), name, opts)
+	if err == nil {
+		return nil
+	}
+
+	var cmdErr mongo.CommandError
+
+	// NamespaceExists
+	if !errors.As(err, &cmdErr) || cmdErr.Code != 48 {
+		return err
+	}
+
+	command := bson.D{{Key: "collMod", Value: name}, {Key: "validator", Value: validator}}
+
+	return db.RunCommand(context.Background(), command).Err()
+}
+
+// withTransaction runs fn in a MongoDB transaction, which is committed if fn succeeds and aborted otherwise.
+// The transaction is retried on transient errors (i.e. write conflicts) so fn may run several times.
+func withTransaction(ctx context.Context, client *mongo.Client, fn func(ctx mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+
+	return err
+}
@@ -0,0 +1,312 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// idempotencyKeyRetention is the time during which a request can be retried with the same idempotency key
+const idempotencyKeyRetention = 24 * time.Hour
+
+// idempotencyKeyLease is the time during which a request holds its idempotency key while it is being handled.
+// It must exceed the time our handlers can take. Once it is over, we consider that the instance handling the request
+// crashed and a retry of the request can take the key over.
+const idempotencyKeyLease = time.Minute
+
+// maxReserveAttempts is the number of times we try to reserve an idempotency key which is concurrently
+// deleted or taken over before giving up
+const maxReserveAttempts = 3
+
+// errIdempotencyKeyContention is returned when an idempotency key could not be reserved after maxReserveAttempts
+var errIdempotencyKeyContention = errors.New("idempotency key could not be reserved")
+
+// ErrIdempotencyKeyLost is returned when a request tries to commit its changes after a retry of the request
+// took its idempotency key over
+var ErrIdempotencyKeyLost = errors.New("idempotency key was taken over")
+
+// userIdempotencyKeyIndex is the name of the unique index which guarantees that an user
+// uses an idempotency key at most once
+const userIdempotencyKeyIndex = "user_id_1_key_1"
+
+// IdempotencyKey is a struct that defines an idempotency key sent by an user along with a request.
+// It records a hash of the request and, once the request was handled, its response so that
+// retries of the request are answered with the original response instead of being handled again.
+// While the request is being handled, the key is held until LockedUntil.
+// Committed is set in the same transaction as the changes of the request, so that a key whose request
+// committed its changes is never taken over, even if its response could not be recorded.
+type IdempotencyKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	UserID      int64              `bson:"user_id"`
+	Key         string             `bson:"key"`
+	RequestHash string             `bson:"request_hash"`
+	Response    *StoredResponse    `bson:"response,omitempty"`
+	Committed   bool               `bson:"committed,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	LockedUntil time.Time          `bson:"locked_until"`
+}
+
+// StoredResponse is a struct that defines the HTTP response sent for a request with an idempotency key
+type StoredResponse struct {
+	StatusCode int                 `bson:"status_code"`
+	Headers    map[string][]string `bson:"headers"`
+	Body       []byte              `bson:"body"`
+}
+
+// IdempotencyKeysRepository is a MongoDB repository for idempotency keys
+type IdempotencyKeysRepository struct {
+	collection *mongo.Collection
+}
+
+// NewIdempotencyKeysRepository creates a new idempotency keys repository
+func NewIdempotencyKeysRepository(client *mongo.Client, databaseName string) *IdempotencyKeysRepository {
+	return &IdempotencyKeysRepository{
+		collection: client.Database(databaseName).Collection(constants.IdempotencyKeysCollection),
+	}
+}
+
+// Reserve records that the given user started a request with the given idempotency key and request hash,
+// and holds the key until its lease is over. If the user already used this key, it returns the recorded
+// idempotency key and false instead, unless the key is still in progress with the same request hash,
+// its lease is over and its request did not commit any change, in which case the key is taken over
+// and returned along with true. Keys whose request committed its changes without recording its response
+// are never taken over, since handling the request again would apply the changes twice.
+func (repo *IdempotencyKeysRepository) Reserve(ctx context.Context, userID int64, key string, requestHash string) (IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	for attempt := 1; attempt <= maxReserveAttempts; attempt++ {
+		// MongoDB stores dates with a millisecond precision, and our lease must match the stored one
+		now := time.Now().UTC().Truncate(time.Millisecond)
+
+		idempotencyKey := IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			RequestHash: requestHash,
+			CreatedAt:   now,
+			LockedUntil: now.Add(idempotencyKeyLease),
+		}
+
+		result, err := repo.collection.InsertOne(ctx, idempotencyKey)
+		if err == nil {
+			idempotencyKey.ID = result.InsertedID.(primitive.ObjectID)
+			return idempotencyKey, true, nil
+		}
+
+		if !isDuplicateKeyOn(err, userIdempotencyKeyIndex) {
+			return idempotencyKey, false, err
+		}
+
+		// The key was already used. Take it over if the request holding it did not complete in time
+		// without committing any change. Keys recorded before we had leases do not have one,
+		// so they can be taken over as well.
+		filter := bson.M{
+			"user_id":      userID,
+			"key":          key,
+			"request_hash": requestHash,
+			"response":     bson.M{"$exists": false},
+			"committed":    bson.M{"$ne": true},
+			"locked_until": bson.M{"$not": bson.M{"$gte": now}},
+		}
+
+		update := bson.M{
+			"$set": bson.M{"locked_until": idempotencyKey.LockedUntil},
+		}
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+		err = repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&idempotencyKey)
+		if err == nil {
+			return idempotencyKey, true, nil
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return idempotencyKey, false, err
+		}
+
+		// Otherwise we return the recorded key
+		existingIdempotencyKey := IdempotencyKey{}
+
+		err = repo.collection.FindOne(ctx, bson.M{"user_id": userID, "key": key}).Decode(&existingIdempotencyKey)
+		if err == nil {
+			return existingIdempotencyKey, false, nil
+		}
+
+		// The recorded key was released or expired in the meantime, so we try again
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return existingIdempotencyKey, false, err
+		}
+	}
+
+	return IdempotencyKey{}, false, errIdempotencyKeyContention
+}
+
+// commit records that the request of the given idempotency key committed its changes. It is meant to be
+// called within the transaction of the changes, and does nothing when no idempotency key is given.
+// It returns ErrIdempotencyKeyLost, which aborts the transaction, if the request lost its key to a retry
+// since it did not complete in time.
+func (repo *IdempotencyKeysRepository) commit(ctx context.Context, idempotencyKey *IdempotencyKey) error {
+	if idempotencyKey == nil {
+		return nil
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"committed": true,
+		},
+	}
+
+	result, err := repo.collection.UpdateOne(ctx, leaseFilter(*idempotencyKey), update)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrIdempotencyKeyLost
+	}
+
+	return nil
+}
+
+// Complete records the response sent for the request of the given idempotency key.
+// Nothing is recorded if the request lost its key to a retry since it did not complete in time.
+func (repo *IdempotencyKeysRepository) Complete(ctx context.Context, idempotencyKey IdempotencyKey, response StoredResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	update := bson.M{
+		"$set": bson.M{
+			"response": response,
+		},
+	}
+
+	_, err := repo.collection.UpdateOne(ctx, leaseFilter(idempotencyKey), update)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Release deletes the given idempotency key so that its request can be retried.
+// It is used when the request failed without applying any change.
+// Nothing is deleted if the request lost its key to a retry since it did not complete in time,
+// or if it committed its changes.
+func (repo *IdempotencyKeysRepository) Release(ctx context.Context, idempotencyKey IdempotencyKey) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	filter := leaseFilter(idempotencyKey)
+	filter["committed"] = bson.M{"$ne": true}
+
+	_, err := repo.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// leaseFilter returns the filter which matches the given idempotency key as long as it holds the same lease
+func leaseFilter(idempotencyKey IdempotencyKey) bson.M {
+	return bson.M{
+		"_id":          idempotencyKey.ID,
+		"locked_until": idempotencyKey.LockedUntil,
+	}
+}
+
+// CreateIdempotencyKeysCollection creates idempotency keys collection in MongoDB database
+func CreateIdempotencyKeysCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"user_id", "key", "request_hash", "created_at"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"user_id": bson.M{
+				"bsonType":    "long",
+				"description": "ID of the user who sent the request",
+			},
+			"key": bson.M{
+				"bsonType":    "string",
+				"description": "Idempotency key sent along with the request",
+			},
+			"request_hash": bson.M{
+				"bsonType":    "string",
+				"description": "Hash of the request",
+			},
+			"response": bson.M{
+				"bsonType":    "object",
+				"required":    []string{"status_code", "headers", "body"},
+				"description": "Response sent for the request",
+				"properties": bson.M{
+					"status_code": bson.M{
+						"bsonType":    "int",
+						"description": "HTTP status code of the response",
+					},
+					"headers": bson.M{
+						"bsonType":    "object",
+						"description": "HTTP headers of the response",
+					},
+					"body": bson.M{
+						"bsonType":    "binData",
+						"description": "Body of the response",
+					},
+				},
+			},
+			"committed": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the request committed its changes",
+			},
+			"created_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when request was received",
+			},
+			"locked_until": bson.M{
+				"bsonType":    "date",
+				"description": "Date until which the request holds the key while it is being handled",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.IdempotencyKeysCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	// Create unique index on the user and key, and TTL index which deletes expired idempotency keys
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName(userIdempotencyKeyIndex),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(idempotencyKeyRetention.Seconds())),
+		},
+	}
+
+	_, err = db.Collection(constants.IdempotencyKeysCollection).Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
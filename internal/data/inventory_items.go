@@ -2,25 +2,94 @@ package data
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/filters"
+	"github.com/PlayEconomy37/Play.Common/types"
 	"github.com/PlayEconomy37/Play.Common/validator"
 	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// InventoryItem is a struct that defines an inventory item in our application
+var (
+	// ErrInsufficientQuantity is returned when trying to subtract more items than an user owns
+	ErrInsufficientQuantity = errors.New("insufficient quantity")
+
+	// ErrMessageAlreadyProcessed is returned when the message we are trying to apply was already processed
+	ErrMessageAlreadyProcessed = errors.New("message already processed")
+
+	// ErrBatchRejected is returned when an atomic batch of grants is rejected since some of its
+	// inventory items exceed the limits of inventories
+	ErrBatchRejected = errors.New("batch rejected")
+
+	// ErrPreconditionFailed is returned when the stored inventory item does not match the precondition of a write
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrNegativeBalance is returned when the quantity of an inventory item recomputed from our ledger is negative,
+	// which happens when our ledger misses the entries granting items to the user
+	ErrNegativeBalance = errors.New("negative balance")
+
+	// ErrUntrackedInventoryItem is returned when repairing an inventory item which does not have any ledger entry,
+	// which happens when it was granted before our ledger was introduced and did not change since
+	ErrUntrackedInventoryItem = errors.New("untracked inventory item")
+
+	// errQuantityChanged is returned when the quantity of an inventory item changed while subtracting
+	// items from it, in which case we try again
+	errQuantityChanged = errors.New("quantity changed")
+)
+
+// batchTimeout is the context timeout of the database operations which grant many inventory items at once
+const batchTimeout = 15 * time.Second
+
+// userCatalogItemIndex is the name of the unique index which guarantees that an user
+// has at most one inventory item per catalog item
+const userCatalogItemIndex = "user_id_1_catalog_item_id_1"
+
+// UnknownCatalogItemName is the name given to inventory items whose catalog item we do not know
+// (i.e. we did not receive its created event yet or it was deleted)
+const UnknownCatalogItemName = "Unknown item"
+
+// inventoryItemSortFields maps the sort values of our endpoints to the fields of inventory items
+// when they differ
+var inventoryItemSortFields = map[string]string{
+	"acquiredDate": "acquired_date",
+}
+
+// catalogItemFields holds the fields of FullInventoryItem which come from catalog items.
+// Sorting by one of them requires joining catalog items before sorting.
+var catalogItemFields = map[string]bool{
+	"name":        true,
+	"description": true,
+}
+
+// Drift is a struct that defines an inventory item whose stored quantity differs from the quantity
+// recomputed from our ledger. Quantities are zero for inventory items which do not exist.
+// Untracked inventory items do not have any ledger entry, so their quantity cannot be recomputed.
+type Drift struct {
+	UserID             int64              `json:"userID"`
+	CatalogItemID      primitive.ObjectID `json:"catalogItemID"`
+	StoredQuantity     int64              `json:"storedQuantity"`
+	RecomputedQuantity int64              `json:"recomputedQuantity"`
+	Untracked          bool               `json:"untracked"`
+}
+
+// InventoryItem is a struct that defines an inventory item in our application.
+// Lots hold the part of its quantity which expires, the rest of its quantity does not expire.
 type InventoryItem struct {
-	ID            primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
-	UserID        int64                `json:"userID" bson:"user_id"`
-	CatalogItemID primitive.ObjectID   `json:"catalogItemID" bson:"catalog_item_id"`
-	Quantity      int64                `json:"quantity" bson:"quantity"`
-	Version       int32                `json:"version" bson:"version"`
-	AcquiredDate  time.Time            `json:"-" bson:"acquired_date"`
-	MessageIds    []primitive.ObjectID `json:"messageIDs" bson:"message_ids"`
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID        int64              `json:"userID" bson:"user_id"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Quantity      int64              `json:"quantity" bson:"quantity"`
+	Version       int32              `json:"version" bson:"version"`
+	AcquiredDate  time.Time          `json:"-" bson:"acquired_date"`
+	Lots          []InventoryLot     `json:"lots,omitempty" bson:"lots,omitempty"`
+	Slot          *int               `json:"-" bson:"slot,omitempty"`
 }
 
 // GetID returns the id of an inventory item.
@@ -43,12 +112,1298 @@ func (i InventoryItem) SetVersion(version int32) InventoryItem {
 	return i
 }
 
+// FullInventoryItem is a struct that defines an inventory item along with the details of its catalog item.
+// CatalogItemMissing is set when we do not know its catalog item, in which case its name is UnknownCatalogItemName.
+// AvailableQuantity is the quantity which is not held by reservations.
+// Expired items are left out of its quantity, and Lots only hold the items which did not expire yet.
+type FullInventoryItem struct {
+	ID                 primitive.ObjectID `json:"id" bson:"_id"`
+	UserID             int64              `json:"userID" bson:"user_id"`
+	CatalogItemID      primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Name               string             `json:"name" bson:"name"`
+	Description        string             `json:"description" bson:"description"`
+	Quantity           int64              `json:"quantity" bson:"quantity"`
+	ReservedQuantity   int64              `json:"reservedQuantity" bson:"reserved_quantity"`
+	AvailableQuantity  int64              `json:"availableQuantity" bson:"available_quantity"`
+	CatalogItemMissing bool               `json:"catalogItemMissing" bson:"catalog_item_missing"`
+	Lots               []InventoryLot     `json:"lots" bson:"lots"`
+	Version            int32              `json:"-" bson:"version"`
+	AcquiredDate       time.Time          `json:"-" bson:"acquired_date"`
+}
+
+// Precondition is a struct that defines a condition on the stored inventory item which must hold
+// for a write to be applied. It lets clients make sure that the inventory item did not change since
+// they read it. The inventory item must exist, and match the given id and version when they are set.
+type Precondition struct {
+	ID      primitive.ObjectID
+	Version int32
+}
+
+// apply adds the precondition to the given filter
+func (p *Precondition) apply(filter bson.M) {
+	if p.ID != primitive.NilObjectID {
+		filter["_id"] = p.ID
+	}
+
+	if p.Version != 0 {
+		filter["version"] = p.Version
+	}
+}
+
 // ValidateInventoryItem runs validation checks on the `InventoryItem` struct
 func ValidateInventoryItem(v *validator.Validator, item InventoryItem) {
 	v.Check(item.UserID > 0, "userID", "must be greater than 0")
+	v.Check(item.CatalogItemID != primitive.NilObjectID, "catalogItemID", "must be provided")
 	v.Check(item.Quantity > 0, "quantity", "must be greater than 0")
 }
 
+// InventoryItemsRepository is a MongoDB repository for inventory items. It embeds our generic
+// repository and adds the atomic quantity updates used to grant, subtract, transfer and reserve items.
+// Every quantity update writes a ledger entry and an InventoryItemUpdatedEvent to the outbox in the same transaction.
+// Quantity updates requested by messages record the message as processed in the same transaction as well.
+// Grants are checked against the maximum stack size of catalog items and the slot capacity of inventories,
+// which is the number of distinct catalog items an user can own (0 means that inventories are not limited).
+// Time-limited items are granted in lots which are left out of our reads once they expire, and removed by ExpireLots.
+type InventoryItemsRepository struct {
+	types.MongoRepository[primitive.ObjectID, InventoryItem]
+	client          *mongo.Client
+	collection      *mongo.Collection
+	outbox          *OutboxMessagesRepository
+	processed       *ProcessedMessagesRepository
+	idempotencyKeys *IdempotencyKeysRepository
+	transfers       *TransfersRepository
+	reservations    *ReservationsRepository
+	ledger          *LedgerEntriesRepository
+	catalogItems    *mongo.Collection
+	slotCapacity    int
+}
+
+// NewInventoryItemsRepository creates a new inventory items repository
+func NewInventoryItemsRepository(client *mongo.Client, databaseName string, slotCapacity int) *InventoryItemsRepository {
+	return &InventoryItemsRepository{
+		MongoRepository: database.NewMongoRepository[primitive.ObjectID, InventoryItem](client, databaseName, constants.InventoryItemsCollection),
+		client:          client,
+		collection:      client.Database(databaseName).Collection(constants.InventoryItemsCollection),
+		outbox:          NewOutboxMessagesRepository(client, databaseName),
+		processed:       NewProcessedMessagesRepository(client, databaseName),
+		idempotencyKeys: NewIdempotencyKeysRepository(client, databaseName),
+		transfers:       NewTransfersRepository(client, databaseName),
+		reservations:    NewReservationsRepository(client, databaseName),
+		ledger:          NewLedgerEntriesRepository(client, databaseName),
+		catalogItems:    client.Database(databaseName).Collection(constants.CatalogItemsCollection),
+		slotCapacity:    slotCapacity,
+	}
+}
+
+// GetWithCatalogItem retrieves the inventory item matching the given filter along with the details
+// of its catalog item. It returns database.ErrRecordNotFound if no inventory item matches the filter.
+func (repo *InventoryItemsRepository) GetWithCatalogItem(ctx context.Context, filter bson.M) (FullInventoryItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var item FullInventoryItem
+
+	pipeline := unexpiredStages(filter)
+	pipeline = append(pipeline, bson.D{{Key: "$limit", Value: 1}})
+	pipeline = append(pipeline, reservationLookupStages()...)
+	pipeline = append(pipeline, catalogItemLookupStages()...)
+
+	cursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return item, err
+	}
+
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return item, err
+		}
+
+		return item, database.ErrRecordNotFound
+	}
+
+	err = cursor.Decode(&item)
+	if err != nil {
+		return item, err
+	}
+
+	return item, nil
+}
+
+// GetAllWithCatalogItems retrieves a page of the inventory items matching the given filter along with
+// the details of their catalog items. Catalog items are joined by the database so inventory items can
+// also be sorted by name. Inventory items whose catalog item is missing are kept.
+func (repo *InventoryItemsRepository) GetAllWithCatalogItems(
+	ctx context.Context,
+	filter bson.M,
+	input filters.Filters,
+) ([]FullInventoryItem, filters.Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	items := []FullInventoryItem{}
+
+	pipeline := listPipeline(filter, inventoryItemSortField(input), input.SortDirectionMongo(), nil, input.Offset(), input.Limit())
+
+	cursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &items)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	// Get total number of records that exist in database with given filter.
+	// We count them with our pipeline since inventory items holding nothing but expired lots are left out.
+	countPipeline := append(unexpiredStages(filter), bson.D{{Key: "$count", Value: "count"}})
+
+	countCursor, err := repo.collection.Aggregate(ctx, countPipeline)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	var counts []struct {
+		Count int `bson:"count"`
+	}
+
+	err = countCursor.All(ctx, &counts)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	count := 0
+	if len(counts) != 0 {
+		count = counts[0].Count
+	}
+
+	metadata := filters.CalculateMetadata(count, input.Page, input.PageSize)
+
+	return items, metadata, nil
+}
+
+// GetPageWithCatalogItems retrieves the inventory items matching the given filter which come after
+// the given cursor, along with the details of their catalog items. An empty cursor retrieves the first page.
+// Unlike GetAllWithCatalogItems, pages do not shift when inventory items are added or removed while paging,
+// and we do not need to skip the records of the previous pages. The page number of the given filters is ignored.
+// It returns ErrInvalidCursor if the cursor was not returned by this method for the same sort.
+func (repo *InventoryItemsRepository) GetPageWithCatalogItems(
+	ctx context.Context,
+	filter bson.M,
+	input filters.Filters,
+	encodedCursor string,
+) ([]FullInventoryItem, CursorMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	items := []FullInventoryItem{}
+	metadata := CursorMetadata{PageSize: input.PageSize}
+
+	sortField := inventoryItemSortField(input)
+
+	var after bson.M
+
+	if encodedCursor != "" {
+		cursor, err := decodeCursor(encodedCursor)
+		if err != nil {
+			return items, metadata, err
+		}
+
+		after, err = afterCursor(input.Sort, sortField, input.SortDirectionMongo(), cursor)
+		if err != nil {
+			return items, metadata, err
+		}
+	}
+
+	// Retrieve one more record than requested to know whether there is a next page
+	pipeline := listPipeline(filter, sortField, input.SortDirectionMongo(), after, 0, input.PageSize+1)
+
+	dbCursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return items, metadata, err
+	}
+
+	defer dbCursor.Close(ctx)
+
+	// Keep raw documents so that we can read the value of the sorted field of the last record
+	var documents []bson.Raw
+
+	err = dbCursor.All(ctx, &documents)
+	if err != nil {
+		return items, metadata, err
+	}
+
+	hasNextPage := len(documents) > input.PageSize
+	if hasNextPage {
+		documents = documents[:input.PageSize]
+	}
+
+	for _, document := range documents {
+		var item FullInventoryItem
+
+		err = bson.Unmarshal(document, &item)
+		if err != nil {
+			return items, metadata, err
+		}
+
+		items = append(items, item)
+	}
+
+	if hasNextPage {
+		last := documents[len(documents)-1]
+
+		metadata.NextCursor, err = encodeCursor(pageCursor{
+			Sort:  input.Sort,
+			Value: last.Lookup(sortField),
+			ID:    items[len(items)-1].ID,
+		})
+		if err != nil {
+			return items, metadata, err
+		}
+	}
+
+	return items, metadata, nil
+}
+
+// inventoryItemSortField returns the field of FullInventoryItem to sort by given our filters
+func inventoryItemSortField(input filters.Filters) string {
+	sortField := input.SortColumn()
+	if field, ok := inventoryItemSortFields[sortField]; ok {
+		return field
+	}
+
+	return sortField
+}
+
+// listPipeline returns the aggregation pipeline which retrieves the inventory items matching the given filter
+// along with the details of their catalog items, sorted by the given field and then by id.
+// When given, the after condition selects the records which come after the previous page.
+// Skip and limit are ignored if they are not positive. Unless we sort by a field of catalog items,
+// catalog items are only joined to the inventory items of the requested page. Expired lots are left out
+// before sorting so that inventory items are sorted by the quantity which did not expire.
+func listPipeline(filter bson.M, sortField string, direction int8, after bson.M, skip int, limit int) mongo.Pipeline {
+	// We include a secondary sort on the id to ensure a consistent ordering
+	sort := bson.D{{Key: sortField, Value: direction}}
+	if sortField != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: 1})
+	}
+
+	var pageStages mongo.Pipeline
+
+	if after != nil {
+		pageStages = append(pageStages, bson.D{{Key: "$match", Value: after}})
+	}
+
+	pageStages = append(pageStages, bson.D{{Key: "$sort", Value: sort}})
+
+	if skip > 0 {
+		pageStages = append(pageStages, bson.D{{Key: "$skip", Value: skip}})
+	}
+
+	if limit > 0 {
+		pageStages = append(pageStages, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	pipeline := unexpiredStages(filter)
+
+	if catalogItemFields[sortField] {
+		pipeline = append(pipeline, reservationLookupStages()...)
+		pipeline = append(pipeline, catalogItemLookupStages()...)
+		pipeline = append(pipeline, pageStages...)
+	} else {
+		pipeline = append(pipeline, pageStages...)
+		pipeline = append(pipeline, reservationLookupStages()...)
+		pipeline = append(pipeline, catalogItemLookupStages()...)
+	}
+
+	return pipeline
+}
+
+// catalogItemLookupStages returns the aggregation stages which join inventory items to their catalog item
+// and shape them as FullInventoryItem
+func catalogItemLookupStages() mongo.Pipeline {
+	return append(catalogItemJoinStages(),
+		bson.D{{Key: "$project", Value: bson.M{
+			"user_id":         1,
+			"catalog_item_id": 1,
+			"quantity":        1,
+			"version":         1,
+			"acquired_date":   1,
+			"lots":            1,
+			// The reserved quantity is added by our reservation lookup stages
+			"reserved_quantity":  1,
+			"available_quantity": bson.M{"$subtract": bson.A{"$quantity", "$reserved_quantity"}},
+			"name":               bson.M{"$ifNull": bson.A{"$catalog_item.name", UnknownCatalogItemName}},
+			"description":        bson.M{"$ifNull": bson.A{"$catalog_item.description", ""}},
+			"catalog_item_missing": bson.M{
+				"$eq": bson.A{bson.M{"$type": "$catalog_item"}, "missing"},
+			},
+		}}},
+	)
+}
+
+// catalogItemJoinStages returns the aggregation stages which join documents referencing a catalog item
+// to their catalog item, which is then found in their catalog_item field. Deleted catalog items are not joined.
+func catalogItemJoinStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from": constants.CatalogItemsCollection,
+			"let":  bson.M{"catalog_item_id": "$catalog_item_id"},
+			"pipeline": mongo.Pipeline{
+				{{Key: "$match", Value: bson.M{
+					"$expr":   bson.M{"$eq": bson.A{"$_id", "$$catalog_item_id"}},
+					"deleted": bson.M{"$ne": true},
+				}}},
+			},
+			"as": "catalog_item",
+		}}},
+		// Keep documents without a catalog item
+		{{Key: "$unwind", Value: bson.M{
+			"path":                       "$catalog_item",
+			"preserveNullAndEmptyArrays": true,
+		}}},
+	}
+}
+
+// Grant atomically increments the quantity of the given catalog item owned by the given user,
+// and records the change in our ledger along with its source.
+// The inventory item is created if the user does not own this catalog item yet.
+// When given an expiry date other than the zero time, the items are granted in a new lot which expires at that date.
+// When the source is a message, the message is recorded as processed in the same transaction
+// and ErrMessageAlreadyProcessed is returned if it was already processed before.
+// When the source holds an idempotency key, the key is recorded as committed in the same transaction
+// and ErrIdempotencyKeyLost is returned if its request lost it.
+// When given a precondition, the inventory item is not created and ErrPreconditionFailed is returned
+// if the stored inventory item does not match it.
+// ErrStackLimitReached or ErrInventoryFull is returned if the grant exceeds the limits of inventories, unless
+// allowPartial is true and some of the items can still be granted, in which case only these items are granted.
+// It returns the inventory item after the update along with the granted quantity.
+func (repo *InventoryItemsRepository) Grant(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+	expiresAt time.Time,
+	source Source,
+	precondition *Precondition,
+	allowPartial bool,
+) (InventoryItem, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var item InventoryItem
+	var granted int64
+
+	grant := func(ctx mongo.SessionContext) error {
+		// Messages delivered again must not be rejected by our limits, so we check them first
+		err := repo.processed.add(ctx, source.messageID())
+		if err != nil {
+			return err
+		}
+
+		err = repo.idempotencyKeys.commit(ctx, source.IdempotencyKey)
+		if err != nil {
+			return err
+		}
+
+		lots := newLots(quantity, expiresAt)
+
+		item, granted, err = repo.grant(ctx, userID, catalogItemID, quantity, lots, precondition, allowPartial)
+		if err != nil {
+			return err
+		}
+
+		return repo.recordChange(ctx, userID, catalogItemID, granted, item.Quantity, capLots(lots, granted), source)
+	}
+
+	err := withTransaction(ctx, repo.client, grant)
+
+	// Two concurrent upserts can both try to insert the inventory item, or to insert inventory items
+	// using the same slot. Our unique indexes make one of them fail, and retrying it turns it into a
+	// regular update or makes it use another slot.
+	if isDuplicateKeyOn(err, userCatalogItemIndex) || isDuplicateKeyOn(err, userSlotIndex) {
+		err = withTransaction(ctx, repo.client, grant)
+		if err != nil {
+			return item, granted, err
+		}
+
+		return item, granted, nil
+	}
+
+	if err != nil {
+		return item, granted, err
+	}
+
+	return item, granted, nil
+}
+
+// grant increments the quantity of the given catalog item owned by the given user, or creates the inventory
+// item if the user does not own this catalog item yet and no precondition is given. The given lots hold the part
+// of the quantity which expires. The grant is checked against the limits of inventories.
+// It returns the inventory item after the update along with the granted quantity.
+func (repo *InventoryItemsRepository) grant(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+	lots []InventoryLot,
+	precondition *Precondition,
+	allowPartial bool,
+) (InventoryItem, int64, error) {
+	var item InventoryItem
+
+	quantity, slot, err := repo.newGrantLimits(allowPartial).check(ctx, userID, catalogItemID, quantity)
+	if err != nil {
+		return item, 0, err
+	}
+
+	// Only part of the quantity may be granted
+	filter, update := grantUpdate(userID, catalogItemID, quantity, capLots(lots, quantity), slot)
+
+	if precondition != nil {
+		precondition.apply(filter)
+	}
+
+	// Inventory items are only created when the write is unconditional
+	opts := options.FindOneAndUpdate().SetUpsert(precondition == nil).SetReturnDocument(options.After)
+
+	err = repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return item, 0, ErrPreconditionFailed
+	}
+
+	return item, quantity, err
+}
+
+// grantUpdate returns the filter and the upsert update which increment the quantity of the given catalog item
+// owned by the given user. The given lots are added to the lots of the inventory item, which are kept sorted
+// by expiry date. Created inventory items use the given slot unless it is noSlot.
+func grantUpdate(
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+	lots []InventoryLot,
+	slot int,
+) (bson.M, bson.M) {
+	filter := bson.M{
+		"user_id":         userID,
+		"catalog_item_id": catalogItemID,
+	}
+
+	update := bson.M{
+		"$inc": bson.M{
+			"quantity": quantity,
+			"version":  int32(1),
+		},
+		"$setOnInsert": bson.M{
+			"acquired_date": time.Now().UTC(),
+		},
+	}
+
+	if len(lots) != 0 {
+		update["$push"] = bson.M{
+			"lots": bson.M{
+				"$each": lots,
+				"$sort": bson.M{"expires_at": 1},
+			},
+		}
+	}
+
+	if slot != noSlot {
+		update["$setOnInsert"].(bson.M)["slot"] = slot
+	}
+
+	return filter, update
+}
+
+// GrantMany increments the quantities of the given inventory items, creating the ones users do not own yet,
+// using bulk writes. When atomic is true, either every inventory item is granted or none is, and the error
+// which prevented the grant is returned. Otherwise every inventory item which can be granted is granted and
+// the returned slice holds, at the index of each given inventory item, the error which prevented its grant.
+// Inventory items holding lots are granted as time-limited items, their lots holding their whole quantity.
+// Grants are checked against the limits of inventories as done by Grant. When an atomic batch exceeds them,
+// ErrBatchRejected is returned along with the errors of the inventory items which exceed them.
+// Every grant is recorded in our ledger along with the given source. When the source holds an idempotency key,
+// the key is recorded as committed in the same transaction and ErrIdempotencyKeyLost is returned if its request lost it.
+// It returns the granted quantity of each given inventory item.
+func (repo *InventoryItemsRepository) GrantMany(
+	ctx context.Context,
+	items []InventoryItem,
+	atomic bool,
+	allowPartial bool,
+	source Source,
+) ([]int64, []error, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	granted := make([]int64, len(items))
+	itemErrors := make([]error, len(items))
+
+	// Indexes of the inventory items we still have to grant
+	pending := make([]int, len(items))
+	for i := range items {
+		pending[i] = i
+	}
+
+	for len(pending) != 0 {
+		// Indexes of the inventory items which were written by our bulk write
+		var written []int
+
+		err := withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+			err := repo.idempotencyKeys.commit(ctx, source.IdempotencyKey)
+			if err != nil {
+				return err
+			}
+
+			written, err = repo.grantMany(ctx, items, pending, atomic, allowPartial, source, granted, itemErrors)
+
+			return err
+		})
+		if err == nil {
+			return granted, itemErrors, nil
+		}
+
+		if errors.Is(err, ErrBatchRejected) {
+			return nil, itemErrors, err
+		}
+
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			return nil, nil, err
+		}
+
+		// A failed write aborts our transaction, so we retry without the inventory items which cannot be granted.
+		// Inventory items created by concurrent upserts are granted once we retry since our upserts become updates,
+		// and inventory items whose slot was used by a concurrent upsert use another slot.
+		failed := make(map[int]bool)
+
+		for _, writeErr := range bulkErr.WriteErrors {
+			if isDuplicateKeyOn(writeErr.WriteError, userCatalogItemIndex) || isDuplicateKeyOn(writeErr.WriteError, userSlotIndex) {
+				continue
+			}
+
+			if atomic {
+				return nil, nil, err
+			}
+
+			index := written[writeErr.Index]
+			itemErrors[index] = writeErr.WriteError
+			failed[index] = true
+		}
+
+		remaining := make([]int, 0, len(pending))
+
+		for _, index := range pending {
+			if !failed[index] {
+				remaining = append(remaining, index)
+			}
+		}
+
+		pending = remaining
+	}
+
+	return granted, itemErrors, nil
+}
+
+// grantMany checks the inventory items at the given indexes against the limits of inventories, increments the
+// quantities of the ones which can be granted with a bulk write, and records every grant in our ledger. It writes
+// an InventoryItemUpdatedEvent for each updated inventory item. The granted quantities and the errors of the inventory
+// items which exceed the limits are stored at their index in the given slices, and ErrBatchRejected is returned
+// if there is any when atomic is true. When atomic is true, the bulk write also stops at the first failed write.
+// It returns the indexes of the inventory items which were written by the bulk write.
+func (repo *InventoryItemsRepository) grantMany(
+	ctx context.Context,
+	items []InventoryItem,
+	indexes []int,
+	atomic bool,
+	allowPartial bool,
+	source Source,
+	granted []int64,
+	itemErrors []error,
+) ([]int, error) {
+	limits := repo.newGrantLimits(allowPartial)
+	rejected := false
+
+	written := make([]int, 0, len(indexes))
+	models := make([]mongo.WriteModel, 0, len(indexes))
+	owners := make(bson.A, 0, len(indexes))
+
+	for _, index := range indexes {
+		item := items[index]
+
+		// Our transaction may be retried so we start over
+		granted[index] = 0
+		itemErrors[index] = nil
+
+		quantity, slot, err := limits.check(ctx, item.UserID, item.CatalogItemID, item.Quantity)
+		if errors.Is(err, ErrStackLimitReached) || errors.Is(err, ErrInventoryFull) {
+			itemErrors[index] = err
+			rejected = true
+			continue
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		filter, update := grantUpdate(item.UserID, item.CatalogItemID, quantity, capLots(item.Lots, quantity), slot)
+
+		granted[index] = quantity
+		written = append(written, index)
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+		owners = append(owners, bson.M{"user_id": item.UserID, "catalog_item_id": item.CatalogItemID})
+	}
+
+	if atomic && rejected {
+		return written, ErrBatchRejected
+	}
+
+	if len(models) == 0 {
+		return written, nil
+	}
+
+	_, err := repo.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(atomic))
+	if err != nil {
+		return written, err
+	}
+
+	// Read the updated quantities so that we can write our ledger entries and events.
+	// A single event is written for inventory items granted several times.
+	cursor, err := repo.collection.Find(ctx, bson.M{"$or": owners})
+	if err != nil {
+		return written, err
+	}
+
+	updatedItems := []InventoryItem{}
+
+	err = cursor.All(ctx, &updatedItems)
+	if err != nil {
+		return written, err
+	}
+
+	type owner struct {
+		userID        int64
+		catalogItemID primitive.ObjectID
+	}
+
+	quantities := make(map[owner]int64, len(updatedItems))
+
+	for _, item := range updatedItems {
+		quantities[owner{item.UserID, item.CatalogItemID}] = item.Quantity
+
+		err = repo.addUpdatedEvent(ctx, item.UserID, item.CatalogItemID, item.Quantity)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	// Grants were applied in order, so we compute the quantity after each grant from the last one
+	entries := make([]LedgerEntry, len(written))
+
+	for i := len(written) - 1; i >= 0; i-- {
+		index := written[i]
+		item := items[index]
+		key := owner{item.UserID, item.CatalogItemID}
+
+		entries[i] = LedgerEntry{
+			UserID:        item.UserID,
+			CatalogItemID: item.CatalogItemID,
+			Delta:         granted[index],
+			Quantity:      quantities[key],
+			Lots:          capLots(item.Lots, granted[index]),
+			Source:        source,
+		}
+
+		quantities[key] -= granted[index]
+	}
+
+	return written, repo.ledger.add(ctx, entries...)
+}
+
+// Transfer atomically moves the quantity of the catalog item of the given transfer from the inventory
+// of its source user to the inventory of its target user, and records the transfer for auditing.
+// Time-limited items keep their expiry date in the inventory of the target user.
+// When given a precondition, ErrPreconditionFailed is returned if the inventory item of the source user does not match it.
+// It returns ErrInsufficientQuantity if the source user does not own enough items.
+func (repo *InventoryItemsRepository) Transfer(ctx context.Context, transfer *Transfer, precondition *Precondition) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	for {
+		err := withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+			// Record the transfer first so that our ledger entries can refer to it
+			err := repo.transfers.add(ctx, transfer)
+			if err != nil {
+				return err
+			}
+
+			source := transferSource(transfer)
+
+			remaining, lots, err := repo.subtract(ctx, transfer.FromUserID, transfer.CatalogItemID, transfer.Quantity, precondition)
+			if err != nil {
+				return err
+			}
+
+			err = repo.recordChange(ctx, transfer.FromUserID, transfer.CatalogItemID, -transfer.Quantity, remaining.Quantity, lots, source)
+			if err != nil {
+				return err
+			}
+
+			item, _, err := repo.grant(ctx, transfer.ToUserID, transfer.CatalogItemID, transfer.Quantity, lots, nil, false)
+			if err != nil {
+				return err
+			}
+
+			return repo.recordChange(ctx, transfer.ToUserID, transfer.CatalogItemID, transfer.Quantity, item.Quantity, lots, source)
+		})
+
+		// Retry when the quantity of the source inventory item changed between our writes, or when
+		// a concurrent upsert created the target inventory item or used its slot first
+		if errors.Is(err, errQuantityChanged) || isDuplicateKeyOn(err, userCatalogItemIndex) || isDuplicateKeyOn(err, userSlotIndex) {
+			continue
+		}
+
+		return err
+	}
+}
+
+// Subtract atomically decrements the quantity of the given catalog item owned by the given user,
+// and records the change in our ledger along with its source.
+// The inventory item is deleted once its quantity reaches zero.
+// When the source is a message, the message is recorded as processed in the same transaction
+// and ErrMessageAlreadyProcessed is returned if it was already processed before.
+// When given a precondition, ErrPreconditionFailed is returned if the stored inventory item does not match it.
+// Reserved and expired items cannot be subtracted, and items expiring first are subtracted first.
+// It returns the inventory item after the update, whose quantity is zero once it is deleted,
+// or ErrInsufficientQuantity if the user does not own enough items.
+func (repo *InventoryItemsRepository) Subtract(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+	source Source,
+	precondition *Precondition,
+) (InventoryItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	for {
+		var remaining InventoryItem
+
+		err := withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+			err := repo.processed.add(ctx, source.messageID())
+			if err != nil {
+				return err
+			}
+
+			var lots []InventoryLot
+
+			remaining, lots, err = repo.subtract(ctx, userID, catalogItemID, quantity, precondition)
+			if err != nil {
+				return err
+			}
+
+			return repo.recordChange(ctx, userID, catalogItemID, -quantity, remaining.Quantity, lots, source)
+		})
+		if errors.Is(err, errQuantityChanged) {
+			continue
+		}
+
+		if err != nil {
+			return InventoryItem{}, err
+		}
+
+		return remaining, nil
+	}
+}
+
+// subtract decrements the quantity of the given catalog item owned by the given user, or deletes
+// the inventory item if the user owns exactly the given quantity. It returns the inventory item after the update,
+// whose quantity is zero once it is deleted, along with the lots the subtracted items were taken from.
+func (repo *InventoryItemsRepository) subtract(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+	precondition *Precondition,
+) (InventoryItem, []InventoryLot, error) {
+	// Reserved items cannot be subtracted. Since reservations write the inventory item,
+	// they conflict with our writes if they change the reserved quantity concurrently.
+	reserved, err := repo.reservations.reservedQuantity(ctx, userID, catalogItemID)
+	if err != nil {
+		return InventoryItem{}, nil, err
+	}
+
+	// Decrement the quantity if the user still owns some items afterwards, and at least the reserved ones
+	// along with the expired ones which are left for ExpireLots
+	filter := bson.M{
+		"user_id":         userID,
+		"catalog_item_id": catalogItemID,
+		"quantity":        bson.M{"$gte": quantity + 1},
+		"$expr":           bson.M{"$gte": bson.A{unexpiredQuantityExpr(), quantity + reserved}},
+	}
+
+	update := bson.M{
+		"$inc": bson.M{
+			"quantity": -quantity,
+			"version":  int32(1),
+		},
+	}
+
+	if precondition != nil {
+		precondition.apply(filter)
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var item InventoryItem
+
+	err = repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&item)
+	if err == nil {
+		lots, err := repo.consumeLots(ctx, item, quantity)
+		if err != nil {
+			return InventoryItem{}, nil, err
+		}
+
+		return item, lots, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return InventoryItem{}, nil, err
+	}
+
+	// Otherwise delete the inventory item if the user owns exactly the given quantity and none is reserved.
+	// Our collection schema does not allow inventory items with a quantity of zero.
+	if reserved == 0 {
+		filter["quantity"] = quantity
+
+		err = repo.collection.FindOneAndDelete(ctx, filter).Decode(&item)
+		if err == nil {
+			lots, _ := splitLots(item.Lots, quantity, time.Now().UTC())
+			item.Quantity = 0
+			item.Lots = nil
+
+			return item, lots, nil
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return InventoryItem{}, nil, err
+		}
+	}
+
+	// Check whether our writes did not match because of the precondition
+	if precondition != nil {
+		preconditionFilter := bson.M{
+			"user_id":         userID,
+			"catalog_item_id": catalogItemID,
+		}
+
+		precondition.apply(preconditionFilter)
+
+		count, err := repo.collection.CountDocuments(ctx, preconditionFilter)
+		if err != nil {
+			return InventoryItem{}, nil, err
+		}
+
+		if count == 0 {
+			return InventoryItem{}, nil, ErrPreconditionFailed
+		}
+	}
+
+	// Check whether the user owns enough items which are neither reserved nor expired. If so, the quantity
+	// changed between our two writes and we try again.
+	delete(filter, "quantity")
+
+	count, err := repo.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return InventoryItem{}, nil, err
+	}
+
+	if count == 0 {
+		return InventoryItem{}, nil, ErrInsufficientQuantity
+	}
+
+	return InventoryItem{}, nil, errQuantityChanged
+}
+
+// Reserve holds the quantity of the catalog item of the given reservation in the inventory of its user
+// until the reservation is confirmed, released or expires, and sets the id of the reservation.
+// It returns ErrInsufficientQuantity if the user does not own enough items which are not reserved yet.
+func (repo *InventoryItemsRepository) Reserve(ctx context.Context, reservation *Reservation) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+		// Increment the version of the inventory item since its available quantity changes.
+		// This write also makes concurrent writes to the inventory item conflict with our transaction.
+		item, err := repo.touch(ctx, reservation.UserID, reservation.CatalogItemID)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return ErrInsufficientQuantity
+			}
+
+			return err
+		}
+
+		reserved, err := repo.reservations.reservedQuantity(ctx, reservation.UserID, reservation.CatalogItemID)
+		if err != nil {
+			return err
+		}
+
+		// Expired items cannot be reserved
+		if item.Quantity-item.expiredQuantity(time.Now().UTC())-reserved < reservation.Quantity {
+			return ErrInsufficientQuantity
+		}
+
+		return repo.reservations.add(ctx, reservation)
+	})
+}
+
+// ConfirmReservation deletes the reservation with the given id and subtracts its items,
+// recording the change in our ledger along with the given source.
+// When given a precondition, ErrPreconditionFailed is returned if the inventory item of the reservation does not match it.
+// It returns the reservation along with its inventory item after the update, whose quantity is zero once it is deleted,
+// or database.ErrRecordNotFound if the reservation does not exist or expired.
+func (repo *InventoryItemsRepository) ConfirmReservation(
+	ctx context.Context,
+	id primitive.ObjectID,
+	source Source,
+	precondition *Precondition,
+) (Reservation, InventoryItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	for {
+		var reservation Reservation
+		var remaining InventoryItem
+
+		err := withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+			var err error
+
+			reservation, err = repo.reservations.take(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			// The reserved items are available to our subtraction once the reservation is deleted
+			var lots []InventoryLot
+
+			remaining, lots, err = repo.subtract(ctx, reservation.UserID, reservation.CatalogItemID, reservation.Quantity, precondition)
+			if err != nil {
+				return err
+			}
+
+			return repo.recordChange(ctx, reservation.UserID, reservation.CatalogItemID, -reservation.Quantity, remaining.Quantity, lots, source)
+		})
+		if errors.Is(err, errQuantityChanged) {
+			continue
+		}
+
+		if err != nil {
+			return reservation, InventoryItem{}, err
+		}
+
+		return reservation, remaining, nil
+	}
+}
+
+// ReleaseReservation deletes the reservation with the given id so that its items are available again.
+// It returns database.ErrRecordNotFound if the reservation does not exist or expired.
+func (repo *InventoryItemsRepository) ReleaseReservation(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+		reservation, err := repo.reservations.take(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// Increment the version of the inventory item since its available quantity changes
+		_, err = repo.touch(ctx, reservation.UserID, reservation.CatalogItemID)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// touch increments the version of the inventory item of the given user and catalog item and returns it
+func (repo *InventoryItemsRepository) touch(ctx context.Context, userID int64, catalogItemID primitive.ObjectID) (InventoryItem, error) {
+	filter := bson.M{
+		"user_id":         userID,
+		"catalog_item_id": catalogItemID,
+	}
+
+	update := bson.M{
+		"$inc": bson.M{"version": int32(1)},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var item InventoryItem
+
+	err := repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&item)
+
+	return item, err
+}
+
+// UserIDs returns the ids of the users who own inventory items or have ledger entries
+func (repo *InventoryItemsRepository) UserIDs(ctx context.Context) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	seen := make(map[int64]bool)
+	userIDs := []int64{}
+
+	for _, collection := range []*mongo.Collection{repo.collection, repo.ledger.collection} {
+		values, err := collection.Distinct(ctx, "user_id", bson.M{})
+		if err != nil {
+			return userIDs, err
+		}
+
+		for _, value := range values {
+			userID, ok := value.(int64)
+			if ok && !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+
+	return userIDs, nil
+}
+
+// Reconcile recomputes the inventory of the given user from our ledger and returns the inventory items
+// whose stored quantity differs from the recomputed one. It does not update any inventory item.
+func (repo *InventoryItemsRepository) Reconcile(ctx context.Context, userID int64) ([]Drift, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	drifts := []Drift{}
+
+	balances, err := repo.ledger.balances(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return drifts, err
+	}
+
+	cursor, err := repo.collection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return drifts, err
+	}
+
+	items := []InventoryItem{}
+
+	err = cursor.All(ctx, &items)
+	if err != nil {
+		return drifts, err
+	}
+
+	storedQuantities := make(map[primitive.ObjectID]int64, len(items))
+
+	for _, item := range items {
+		storedQuantities[item.CatalogItemID] = item.Quantity
+	}
+
+	for _, balance := range balances {
+		storedQuantity := storedQuantities[balance.CatalogItemID]
+		delete(storedQuantities, balance.CatalogItemID)
+
+		if storedQuantity != balance.Quantity {
+			drifts = append(drifts, Drift{
+				UserID:             userID,
+				CatalogItemID:      balance.CatalogItemID,
+				StoredQuantity:     storedQuantity,
+				RecomputedQuantity: balance.Quantity,
+			})
+		}
+	}
+
+	// The remaining inventory items do not have any ledger entry
+	for _, item := range items {
+		if storedQuantity, ok := storedQuantities[item.CatalogItemID]; ok {
+			drifts = append(drifts, Drift{
+				UserID:         userID,
+				CatalogItemID:  item.CatalogItemID,
+				StoredQuantity: storedQuantity,
+				Untracked:      true,
+			})
+		}
+	}
+
+	return drifts, nil
+}
+
+// Repair sets the quantity of the inventory item of the given user and catalog item to the quantity recomputed
+// from our ledger, creating or deleting the inventory item if needed, and writes an InventoryItemUpdatedEvent.
+// Lots are reduced so that they do not hold more than the recomputed quantity, and created inventory items use
+// a free slot when there is one. Since the ledger prevails over the limits of inventories, they are created
+// without a slot when the inventory is full.
+// Ledger entries and quantities are read in the same transaction so that concurrent changes are taken into account.
+// It returns the drift which was repaired, whose quantities are equal if there was nothing to repair,
+// ErrNegativeBalance if the recomputed quantity is negative, or ErrUntrackedInventoryItem if the inventory item
+// does not have any ledger entry.
+func (repo *InventoryItemsRepository) Repair(ctx context.Context, userID int64, catalogItemID primitive.ObjectID) (Drift, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var drift Drift
+
+	err := withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+		drift = Drift{UserID: userID, CatalogItemID: catalogItemID}
+
+		filter := bson.M{
+			"user_id":         userID,
+			"catalog_item_id": catalogItemID,
+		}
+
+		balances, err := repo.ledger.balances(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		balance := LedgerBalance{UserID: userID, CatalogItemID: catalogItemID, AcquiredDate: time.Now().UTC()}
+		if len(balances) != 0 {
+			balance = balances[0]
+		}
+
+		drift.RecomputedQuantity = balance.Quantity
+
+		var item InventoryItem
+
+		err = repo.collection.FindOne(ctx, filter).Decode(&item)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		drift.StoredQuantity = item.Quantity
+
+		// Without any ledger entry, we cannot tell which quantity the inventory item should have
+		if len(balances) == 0 && !item.ID.IsZero() {
+			drift.Untracked = true
+			return ErrUntrackedInventoryItem
+		}
+
+		switch {
+		case drift.StoredQuantity == drift.RecomputedQuantity:
+			return nil
+		case balance.Quantity < 0:
+			return ErrNegativeBalance
+		case balance.Quantity == 0:
+			_, err = repo.collection.DeleteOne(ctx, filter)
+		case item.ID.IsZero():
+			item, err = repo.repairedItem(ctx, balance)
+			if err != nil {
+				return err
+			}
+
+			_, err = repo.collection.InsertOne(ctx, item)
+		default:
+			_, err = repo.collection.UpdateOne(ctx, filter, bson.M{
+				"$set": bson.M{
+					"quantity": balance.Quantity,
+					"lots":     capLots(item.Lots, balance.Quantity),
+				},
+				"$inc": bson.M{"version": int32(1)},
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return repo.addUpdatedEvent(ctx, userID, catalogItemID, balance.Quantity)
+	})
+
+	return drift, err
+}
+
+// repairedItem returns the inventory item to create for the given balance recomputed from our ledger.
+// It uses the first free slot of the inventory of its user, if inventories have a capacity and one is free.
+// Slots still used by inventory items holding nothing but expired lots are freed by removing these inventory items.
+func (repo *InventoryItemsRepository) repairedItem(ctx context.Context, balance LedgerBalance) (InventoryItem, error) {
+	item := InventoryItem{
+		UserID:        balance.UserID,
+		CatalogItemID: balance.CatalogItemID,
+		Quantity:      balance.Quantity,
+		Version:       1,
+		AcquiredDate:  balance.AcquiredDate,
+	}
+
+	if repo.slotCapacity == 0 {
+		return item, nil
+	}
+
+	limits := repo.newGrantLimits(false)
+
+	inventory, err := limits.inventory(ctx, balance.UserID)
+	if err != nil {
+		return item, err
+	}
+
+	slot, err := limits.claimSlot(ctx, inventory)
+	if err != nil {
+		return item, err
+	}
+
+	if slot != noSlot {
+		item.Slot = &slot
+	}
+
+	return item, nil
+}
+
+// recordChange writes a ledger entry and an InventoryItemUpdatedEvent for the given change of the quantity
+// of an inventory item, which added or removed the given lots. It must be called within the transaction
+// which updated the quantity of the inventory item.
+func (repo *InventoryItemsRepository) recordChange(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	delta int64,
+	quantity int64,
+	lots []InventoryLot,
+	source Source,
+) error {
+	entry := LedgerEntry{
+		UserID:        userID,
+		CatalogItemID: catalogItemID,
+		Delta:         delta,
+		Quantity:      quantity,
+		Lots:          lots,
+		Source:        source,
+	}
+
+	err := repo.ledger.add(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	return repo.addUpdatedEvent(ctx, userID, catalogItemID, quantity)
+}
+
+// addUpdatedEvent writes an InventoryItemUpdatedEvent to the outbox. It must be called
+// within the transaction which updated the quantity of the inventory item.
+func (repo *InventoryItemsRepository) addUpdatedEvent(
+	ctx context.Context,
+	userID int64,
+	catalogItemID primitive.ObjectID,
+	quantity int64,
+) error {
+	event := events.InventoryItemUpdatedEvent{
+		UserID:        userID,
+		CatalogItemID: catalogItemID,
+		Quantity:      quantity,
+	}
+
+	return repo.outbox.add(ctx, events.InventoryItemUpdatedEventType, event)
+}
+
 // CreateInventoryItemsCollection creates inventory items collection in MongoDB database
 func CreateInventoryItemsCollection(client *mongo.Client, databaseName string) error {
 	db := client.Database(databaseName)
@@ -56,7 +1411,7 @@ func CreateInventoryItemsCollection(client *mongo.Client, databaseName string) e
 	// JSON validation schema
 	jsonSchema := bson.M{
 		"bsonType":             "object",
-		"required":             []string{"user_id", "catalog_item_id", "quantity", "version", "acquired_date", "message_ids"},
+		"required":             []string{"user_id", "catalog_item_id", "quantity", "version", "acquired_date"},
 		"additionalProperties": false,
 		"properties": bson.M{
 			"_id": bson.M{
@@ -85,9 +1440,30 @@ func CreateInventoryItemsCollection(client *mongo.Client, databaseName string) e
 				"bsonType":    "date",
 				"description": "Date when item was acquired",
 			},
-			"message_ids": bson.M{
+			"lots": bson.M{
 				"bsonType":    "array",
-				"description": "Array of message broker message ids",
+				"description": "Lots of items which expire, sorted by expiry date",
+				"items": bson.M{
+					"bsonType":             "object",
+					"required":             []string{"quantity", "expires_at"},
+					"additionalProperties": false,
+					"properties": bson.M{
+						"quantity": bson.M{
+							"bsonType":    "long",
+							"minimum":     1,
+							"description": "Quantity of items in the lot",
+						},
+						"expires_at": bson.M{
+							"bsonType":    "date",
+							"description": "Date when items of the lot expire",
+						},
+					},
+				},
+			},
+			"slot": bson.M{
+				"bsonType":    "int",
+				"minimum":     0,
+				"description": "Slot used by the item in the inventory of the user",
 			},
 		},
 	}
@@ -96,12 +1472,36 @@ func CreateInventoryItemsCollection(client *mongo.Client, databaseName string) e
 		"$jsonSchema": jsonSchema,
 	}
 
-	// Create collection
-	opts := options.CreateCollection().SetValidator(validator)
-	err := db.CreateCollection(context.Background(), constants.InventoryItemsCollection, opts)
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.InventoryItemsCollection, validator)
 	if err != nil {
-		// Returns error if collection already exists so we ignore it
-		return nil
+		return err
+	}
+
+	// Create unique index on user and catalog item.
+	// We create indexes even if the collection already exists so that existing databases
+	// get new indexes as well. Creating an index that already exists is a no-op.
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "catalog_item_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName(userCatalogItemIndex),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "slot", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetName(userSlotIndex).
+				SetPartialFilterExpression(bson.M{"slot": bson.M{"$exists": true}}),
+		},
+		// Used to look for expired lots
+		{
+			Keys: bson.D{{Key: "lots.expires_at", Value: 1}},
+		},
+	}
+
+	_, err = db.Collection(constants.InventoryItemsCollection).Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
 	}
 
 	return nil
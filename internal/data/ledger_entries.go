@@ -0,0 +1,471 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/filters"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Types of the sources of quantity changes
+const (
+	SourceHTTP     = "http"
+	SourceMessage  = "message"
+	SourceTransfer = "transfer"
+	SourceExpiry   = "expiry"
+)
+
+// Source is a struct that defines where a quantity change comes from. Changes are either requested
+// through our HTTP API by an actor, received as a message from another microservice, made by a transfer,
+// or made when time-limited items expire.
+// IdempotencyKey is the idempotency key of the HTTP request which requested the change, if any.
+// It is not recorded in our ledger.
+type Source struct {
+	Type           string              `json:"type" bson:"type"`
+	ActorID        int64               `json:"actorID,omitempty" bson:"actor_id,omitempty"`
+	MessageID      *primitive.ObjectID `json:"messageID,omitempty" bson:"message_id,omitempty"`
+	TransferID     *primitive.ObjectID `json:"transferID,omitempty" bson:"transfer_id,omitempty"`
+	IdempotencyKey *IdempotencyKey     `json:"-" bson:"-"`
+}
+
+// HTTPSource returns the source of the changes requested through our HTTP API by the given user
+func HTTPSource(actorID int64) Source {
+	return Source{Type: SourceHTTP, ActorID: actorID}
+}
+
+// WithIdempotencyKey returns the source along with the given idempotency key of its HTTP request
+func (s Source) WithIdempotencyKey(idempotencyKey IdempotencyKey) Source {
+	s.IdempotencyKey = &idempotencyKey
+
+	return s
+}
+
+// MessageSource returns the source of the changes requested by the message with the given id
+func MessageSource(messageID primitive.ObjectID) Source {
+	return Source{Type: SourceMessage, MessageID: &messageID}
+}
+
+// transferSource returns the source of the changes made by the given transfer
+func transferSource(transfer *Transfer) Source {
+	return Source{Type: SourceTransfer, ActorID: transfer.InitiatedBy, TransferID: &transfer.ID}
+}
+
+// expirySource returns the source of the changes made when time-limited items expire
+func expirySource() Source {
+	return Source{Type: SourceExpiry}
+}
+
+// messageID returns the id of the message which requested the change, or primitive.NilObjectID
+// if the change was not requested by a message
+func (s Source) messageID() primitive.ObjectID {
+	if s.MessageID == nil {
+		return primitive.NilObjectID
+	}
+
+	return *s.MessageID
+}
+
+// LedgerEntry is a struct that defines a change of the quantity of an inventory item.
+// Lots are the lots of time-limited items which were added by the change, or removed when its delta is negative,
+// so that we know which items expired at any point in time.
+// Ledger entries are immutable and written in the same transaction as the change they record.
+type LedgerEntry struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID        int64              `json:"userID" bson:"user_id"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Delta         int64              `json:"delta" bson:"delta"`
+	Quantity      int64              `json:"quantity" bson:"quantity"`
+	Lots          []InventoryLot     `json:"lots,omitempty" bson:"lots,omitempty"`
+	Source        Source             `json:"source" bson:"source"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"created_at"`
+}
+
+// LedgerEntriesRepository is a MongoDB repository for ledger entries.
+// It does not expose any way to update or delete ledger entries.
+type LedgerEntriesRepository struct {
+	collection *mongo.Collection
+}
+
+// NewLedgerEntriesRepository creates a new ledger entries repository
+func NewLedgerEntriesRepository(client *mongo.Client, databaseName string) *LedgerEntriesRepository {
+	return &LedgerEntriesRepository{
+		collection: client.Database(databaseName).Collection(constants.LedgerEntriesCollection),
+	}
+}
+
+// add inserts the given ledger entries.
+// It is meant to be called within the transaction of the changes recorded by the entries.
+func (repo *LedgerEntriesRepository) add(ctx context.Context, entries ...LedgerEntry) error {
+	documents := make([]any, len(entries))
+
+	for i, entry := range entries {
+		entry.CreatedAt = time.Now().UTC()
+		documents[i] = entry
+	}
+
+	_, err := repo.collection.InsertMany(ctx, documents)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetAll returns the ledger entries matching the given filter along with the pagination metadata
+func (repo *LedgerEntriesRepository) GetAll(ctx context.Context, filter bson.M, input filters.Filters) ([]LedgerEntry, filters.Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	entries := []LedgerEntry{}
+
+	sort := bson.D{{Key: input.SortColumn(), Value: input.SortDirectionMongo()}}
+
+	opts := options.Find().SetSort(sort).SetSkip(int64(input.Offset())).SetLimit(int64(input.Limit()))
+
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return entries, filters.Metadata{}, err
+	}
+
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return entries, filters.Metadata{}, err
+	}
+
+	// Get total number of records that exist in database with given filter
+	count, err := repo.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return entries, filters.Metadata{}, err
+	}
+
+	metadata := filters.CalculateMetadata(int(count), input.Page, input.PageSize)
+
+	return entries, metadata, nil
+}
+
+// LedgerBalance is a struct that defines the quantity of an inventory item recomputed from our ledger.
+// AcquiredDate is the date of the first ledger entry of the inventory item.
+type LedgerBalance struct {
+	UserID        int64              `bson:"user_id"`
+	CatalogItemID primitive.ObjectID `bson:"catalog_item_id"`
+	Quantity      int64              `bson:"quantity"`
+	AcquiredDate  time.Time          `bson:"acquired_date"`
+}
+
+// InventoryItemSnapshot is a struct that defines an inventory item as it was at a point in time,
+// recomputed from our ledger, along with the current details of its catalog item.
+type InventoryItemSnapshot struct {
+	UserID             int64              `json:"userID" bson:"user_id"`
+	CatalogItemID      primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Name               string             `json:"name" bson:"name"`
+	Description        string             `json:"description" bson:"description"`
+	Quantity           int64              `json:"quantity" bson:"quantity"`
+	CatalogItemMissing bool               `json:"catalogItemMissing" bson:"catalog_item_missing"`
+	AcquiredDate       time.Time          `json:"-" bson:"acquired_date"`
+}
+
+// balances returns the quantities of the inventory items recomputed from the ledger entries matching the given filter.
+// Inventory items whose quantity went back to zero are included.
+func (repo *LedgerEntriesRepository) balances(ctx context.Context, filter bson.M) ([]LedgerBalance, error) {
+	balances := []LedgerBalance{}
+
+	cursor, err := repo.collection.Aggregate(ctx, balancePipeline(filter, time.Time{}))
+	if err != nil {
+		return balances, err
+	}
+
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &balances)
+	if err != nil {
+		return balances, err
+	}
+
+	return balances, nil
+}
+
+// GetSnapshot retrieves a page of the inventory items of the given user as they were at the given date, along with
+// the details of their catalog items. The entries filter selects the ledger entries to replay and the snapshot filter
+// selects the recomputed inventory items. Items which expired at that date are left out of the quantities, and inventory items
+// which were not owned by the user at that date are left out. Ledger entries written before we recorded lots do not tell
+// which items expired, so items granted by them are counted as if they never expired.
+func (repo *LedgerEntriesRepository) GetSnapshot(
+	ctx context.Context,
+	userID int64,
+	asOf time.Time,
+	entriesFilter bson.M,
+	snapshotFilter bson.M,
+	input filters.Filters,
+) ([]InventoryItemSnapshot, filters.Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	items := []InventoryItemSnapshot{}
+
+	filter := bson.M{
+		"user_id":    userID,
+		"created_at": bson.M{"$lte": asOf},
+	}
+
+	for key, value := range entriesFilter {
+		filter[key] = value
+	}
+
+	// Users did not own inventory items whose quantity was zero at that date
+	match := bson.M{"quantity": bson.M{"$gt": 0}}
+
+	if len(snapshotFilter) != 0 {
+		match = bson.M{"$and": bson.A{match, snapshotFilter}}
+	}
+
+	// We include a secondary sort on the catalog item id to ensure a consistent ordering
+	sortField := inventoryItemSortField(input)
+	if sortField == "_id" {
+		sortField = "catalog_item_id"
+	}
+
+	sort := bson.D{{Key: sortField, Value: input.SortDirectionMongo()}}
+	if sortField != "catalog_item_id" {
+		sort = append(sort, bson.E{Key: "catalog_item_id", Value: 1})
+	}
+
+	page := catalogItemJoinStages()
+	page = append(page,
+		bson.D{{Key: "$project", Value: bson.M{
+			"_id":             0,
+			"user_id":         1,
+			"catalog_item_id": 1,
+			"quantity":        1,
+			"acquired_date":   1,
+			"name":            bson.M{"$ifNull": bson.A{"$catalog_item.name", UnknownCatalogItemName}},
+			"description":     bson.M{"$ifNull": bson.A{"$catalog_item.description", ""}},
+			"catalog_item_missing": bson.M{
+				"$eq": bson.A{bson.M{"$type": "$catalog_item"}, "missing"},
+			},
+		}}},
+		bson.D{{Key: "$sort", Value: sort}},
+		bson.D{{Key: "$skip", Value: input.Offset()}},
+	)
+
+	if input.Limit() > 0 {
+		page = append(page, bson.D{{Key: "$limit", Value: input.Limit()}})
+	}
+
+	// Count the recomputed inventory items along with retrieving the requested page
+	pipeline := balancePipeline(filter, asOf)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$facet", Value: bson.M{
+			"items": page,
+			"count": bson.A{bson.M{"$count": "count"}},
+		}}},
+	)
+
+	cursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Items []InventoryItemSnapshot `bson:"items"`
+		Count []struct {
+			Count int `bson:"count"`
+		} `bson:"count"`
+	}
+
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return items, filters.Metadata{}, err
+	}
+
+	count := 0
+
+	if len(result) != 0 {
+		items = append(items, result[0].Items...)
+
+		if len(result[0].Count) != 0 {
+			count = result[0].Count[0].Count
+		}
+	}
+
+	metadata := filters.CalculateMetadata(count, input.Page, input.PageSize)
+
+	return items, metadata, nil
+}
+
+// balancePipeline returns the aggregation pipeline which replays the ledger entries matching the given filter
+// and sums their deltas per inventory item, shaping them as LedgerBalance. Inventory items granted before our
+// ledger was introduced start from the quantity they had before their first ledger entry.
+// Unless expiredAt is the zero time, items of the lots which expired at that date are left out of the quantities,
+// even if their expiry was recorded later on.
+func balancePipeline(filter bson.M, expiredAt time.Time) mongo.Pipeline {
+	quantity := bson.M{"$add": bson.A{"$opening_quantity", "$deltas"}}
+
+	if !expiredAt.IsZero() {
+		// Lots left by the ledger entries once replayed hold the items which did not expire yet,
+		// along with the ones which expired and whose expiry was not recorded yet
+		quantity = bson.M{"$subtract": bson.A{
+			quantity,
+			bson.M{"$max": bson.A{0, bson.M{"$min": bson.A{"$expired_quantity", quantity}}}},
+		}}
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		// Ledger entries are sorted by creation so that we can read the first one
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":              bson.M{"user_id": "$user_id", "catalog_item_id": "$catalog_item_id"},
+			"opening_quantity": bson.M{"$first": bson.M{"$subtract": bson.A{"$quantity", "$delta"}}},
+			"deltas":           bson.M{"$sum": "$delta"},
+			"expired_quantity": bson.M{"$sum": expiredLotsDeltaExpr(expiredAt)},
+			"acquired_date":    bson.M{"$first": "$created_at"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":             0,
+			"user_id":         "$_id.user_id",
+			"catalog_item_id": "$_id.catalog_item_id",
+			"quantity":        quantity,
+			"acquired_date":   1,
+		}}},
+	}
+}
+
+// expiredLotsDeltaExpr returns the aggregation expression which computes the change a ledger entry made
+// to the quantity of the lots which expired at the given date
+func expiredLotsDeltaExpr(expiredAt time.Time) bson.M {
+	expired := bson.M{"$sum": bson.M{
+		"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$lots", bson.A{}}},
+				"cond":  bson.M{"$lte": bson.A{"$$this.expires_at", expiredAt}},
+			}},
+			"in": "$$this.quantity",
+		},
+	}}
+
+	return bson.M{"$cond": bson.A{
+		bson.M{"$lt": bson.A{"$delta", 0}},
+		bson.M{"$multiply": bson.A{-1, expired}},
+		expired,
+	}}
+}
+
+// CreateLedgerEntriesCollection creates ledger entries collection in MongoDB database
+func CreateLedgerEntriesCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"user_id", "catalog_item_id", "delta", "quantity", "source", "created_at"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"user_id": bson.M{
+				"bsonType":    "long",
+				"description": "ID of user who owns the item",
+			},
+			"catalog_item_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "ID of the catalog item",
+			},
+			"delta": bson.M{
+				"bsonType":    "long",
+				"description": "Change of the quantity of the inventory item",
+			},
+			"quantity": bson.M{
+				"bsonType":    "long",
+				"minimum":     0,
+				"description": "Quantity of the inventory item after the change",
+			},
+			"lots": bson.M{
+				"bsonType":    "array",
+				"description": "Lots of items which expire added or removed by the change",
+				"items": bson.M{
+					"bsonType":             "object",
+					"required":             []string{"quantity", "expires_at"},
+					"additionalProperties": false,
+					"properties": bson.M{
+						"quantity": bson.M{
+							"bsonType":    "long",
+							"minimum":     1,
+							"description": "Quantity of items in the lot",
+						},
+						"expires_at": bson.M{
+							"bsonType":    "date",
+							"description": "Date when items of the lot expire",
+						},
+					},
+				},
+			},
+			"source": bson.M{
+				"bsonType":             "object",
+				"required":             []string{"type"},
+				"additionalProperties": false,
+				"description":          "Source of the change",
+				"properties": bson.M{
+					"type": bson.M{
+						"enum":        []string{SourceHTTP, SourceMessage, SourceTransfer, SourceExpiry},
+						"description": "Type of the source of the change",
+					},
+					"actor_id": bson.M{
+						"bsonType":    "long",
+						"description": "ID of user who requested the change",
+					},
+					"message_id": bson.M{
+						"bsonType":    "objectId",
+						"description": "ID of the message which requested the change",
+					},
+					"transfer_id": bson.M{
+						"bsonType":    "objectId",
+						"description": "ID of the transfer which made the change",
+					},
+				},
+			},
+			"created_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when change was made",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.LedgerEntriesCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	// Create indexes used to read the history of an user and to replay it up to a date
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "catalog_item_id", Value: 1}, {Key: "_id", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}},
+		},
+	}
+
+	_, err = db.Collection(constants.LedgerEntriesCollection).Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
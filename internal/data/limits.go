@@ -0,0 +1,255 @@
+package data
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrStackLimitReached is returned when a grant would make an user own more items of a catalog item
+	// than the maximum stack size of the catalog item
+	ErrStackLimitReached = errors.New("stack limit reached")
+
+	// ErrInventoryFull is returned when a grant would make an user own more distinct catalog items
+	// than the slot capacity of inventories
+	ErrInventoryFull = errors.New("inventory full")
+)
+
+// userSlotIndex is the name of the unique index which guarantees that two inventory items of an user
+// do not use the same slot
+const userSlotIndex = "user_id_1_slot_1"
+
+// noSlot is the slot of inventory items which are not created or when inventories do not have a capacity
+const noSlot = -1
+
+// userInventory holds the quantities and the used slots of the inventory of an user, as read by grantLimits.
+// Like our reads, it leaves out expired items: quantities do not include them, and inventory items holding
+// nothing but expired lots neither count as owned nor use their slot. Until ExpireLots removes these inventory
+// items, they are kept in expiredItems and expiredSlots so that they can be removed before a grant needs them.
+type userInventory struct {
+	quantities   map[primitive.ObjectID]int64
+	usedSlots    map[int]bool
+	expiredItems map[primitive.ObjectID]primitive.ObjectID
+	expiredSlots map[int]primitive.ObjectID
+}
+
+// freeSlot returns the first slot of the inventory which is not used, or noSlot if every slot is used
+func (inventory *userInventory) freeSlot(slotCapacity int) int {
+	for i := 0; i < slotCapacity; i++ {
+		if !inventory.usedSlots[i] {
+			return i
+		}
+	}
+
+	return noSlot
+}
+
+// grantLimits checks the grants made within a transaction against the maximum stack size of catalog items
+// and the slot capacity of inventories. It reads the stored inventory of an user once and keeps track of the
+// grants it allows, so that the grants of a batch are checked against each other.
+type grantLimits struct {
+	repo         *InventoryItemsRepository
+	maxStacks    map[primitive.ObjectID]int64
+	inventories  map[int64]*userInventory
+	allowPartial bool
+}
+
+// newGrantLimits returns a new grantLimits. When allowPartial is true, grants exceeding the maximum stack size
+// of their catalog item are reduced to the quantity which can still be granted.
+func (repo *InventoryItemsRepository) newGrantLimits(allowPartial bool) *grantLimits {
+	return &grantLimits{
+		repo:         repo,
+		maxStacks:    make(map[primitive.ObjectID]int64),
+		inventories:  make(map[int64]*userInventory),
+		allowPartial: allowPartial,
+	}
+}
+
+// check returns the quantity of the given catalog item which can be granted to the given user, along with the slot
+// the inventory item must use if it is created, or noSlot if inventories do not have a capacity. It returns
+// ErrStackLimitReached or ErrInventoryFull if the items cannot be granted. Expired items do not count toward
+// these limits, and the inventory items holding nothing but expired lots which are in the way are removed.
+func (limits *grantLimits) check(ctx context.Context, userID int64, catalogItemID primitive.ObjectID, quantity int64) (int64, int, error) {
+	maxStack, err := limits.maxStack(ctx, catalogItemID)
+	if err != nil {
+		return 0, noSlot, err
+	}
+
+	inventory, err := limits.inventory(ctx, userID)
+	if err != nil {
+		return 0, noSlot, err
+	}
+
+	// An inventory item holding nothing but expired lots is removed so that the grant creates a new one
+	if id, ok := inventory.expiredItems[catalogItemID]; ok {
+		err = limits.expire(ctx, inventory, id)
+		if err != nil {
+			return 0, noSlot, err
+		}
+	}
+
+	owned, exists := inventory.quantities[catalogItemID]
+
+	if maxStack > 0 && owned+quantity > maxStack {
+		if !limits.allowPartial || owned >= maxStack {
+			return 0, noSlot, ErrStackLimitReached
+		}
+
+		quantity = maxStack - owned
+	}
+
+	slot := noSlot
+
+	if !exists && limits.repo.slotCapacity > 0 {
+		if len(inventory.quantities) >= limits.repo.slotCapacity {
+			return 0, noSlot, ErrInventoryFull
+		}
+
+		// Inventory items created before inventories had a capacity do not use any slot,
+		// so we may not find a free one even though the inventory is not full
+		slot, err = limits.claimSlot(ctx, inventory)
+		if err != nil {
+			return 0, noSlot, err
+		}
+
+		if slot == noSlot {
+			return 0, noSlot, ErrInventoryFull
+		}
+	}
+
+	inventory.quantities[catalogItemID] = owned + quantity
+
+	return quantity, slot, nil
+}
+
+// maxStack returns the maximum stack size of the given catalog item, which is 0 if it does not have any.
+// Catalog items we do not know do not have a maximum stack size.
+func (limits *grantLimits) maxStack(ctx context.Context, catalogItemID primitive.ObjectID) (int64, error) {
+	if maxStack, ok := limits.maxStacks[catalogItemID]; ok {
+		return maxStack, nil
+	}
+
+	var item CatalogItem
+
+	opts := options.FindOne().SetProjection(bson.M{"max_stack": 1})
+
+	err := limits.repo.catalogItems.FindOne(ctx, bson.M{"_id": catalogItemID}, opts).Decode(&item)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+
+	limits.maxStacks[catalogItemID] = item.MaxStack
+
+	return item.MaxStack, nil
+}
+
+// claimSlot returns the first free slot of the given inventory and marks it as used, or returns noSlot if every
+// slot is used. A slot still used by an inventory item holding nothing but expired lots is freed by removing it.
+func (limits *grantLimits) claimSlot(ctx context.Context, inventory *userInventory) (int, error) {
+	slot := inventory.freeSlot(limits.repo.slotCapacity)
+	if slot == noSlot {
+		return noSlot, nil
+	}
+
+	if id, ok := inventory.expiredSlots[slot]; ok {
+		err := limits.expire(ctx, inventory, id)
+		if err != nil {
+			return noSlot, err
+		}
+	}
+
+	inventory.usedSlots[slot] = true
+
+	return slot, nil
+}
+
+// expire removes the expired lots of the inventory item with the given id, which holds nothing but expired lots,
+// so that it is deleted along with its slot. It must be called within the transaction of our grant.
+func (limits *grantLimits) expire(ctx context.Context, inventory *userInventory, id primitive.ObjectID) error {
+	_, err := limits.repo.expireLots(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for catalogItemID, expiredID := range inventory.expiredItems {
+		if expiredID == id {
+			delete(inventory.expiredItems, catalogItemID)
+		}
+	}
+
+	for slot, expiredID := range inventory.expiredSlots {
+		if expiredID == id {
+			delete(inventory.expiredSlots, slot)
+		}
+	}
+
+	return nil
+}
+
+// inventory returns the stored inventory of the given user
+func (limits *grantLimits) inventory(ctx context.Context, userID int64) (*userInventory, error) {
+	if inventory, ok := limits.inventories[userID]; ok {
+		return inventory, nil
+	}
+
+	// Read the quantity of each inventory item which did not expire
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$project", Value: bson.M{
+			"catalog_item_id": 1,
+			"slot":            1,
+			"quantity":        unexpiredQuantityExpr(),
+		}}},
+	}
+
+	cursor, err := limits.repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []struct {
+		ID            primitive.ObjectID `bson:"_id"`
+		CatalogItemID primitive.ObjectID `bson:"catalog_item_id"`
+		Quantity      int64              `bson:"quantity"`
+		Slot          *int               `bson:"slot"`
+	}
+
+	err = cursor.All(ctx, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &userInventory{
+		quantities:   make(map[primitive.ObjectID]int64, len(items)),
+		usedSlots:    make(map[int]bool, len(items)),
+		expiredItems: make(map[primitive.ObjectID]primitive.ObjectID),
+		expiredSlots: make(map[int]primitive.ObjectID),
+	}
+
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			inventory.expiredItems[item.CatalogItemID] = item.ID
+
+			if item.Slot != nil {
+				inventory.expiredSlots[*item.Slot] = item.ID
+			}
+
+			continue
+		}
+
+		inventory.quantities[item.CatalogItemID] = item.Quantity
+
+		if item.Slot != nil {
+			inventory.usedSlots[*item.Slot] = true
+		}
+	}
+
+	limits.inventories[userID] = inventory
+
+	return inventory, nil
+}
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InventoryLot is a struct that defines a quantity of an inventory item which expires at a given date.
+// Items granted with different expiry dates are kept in separate lots so that their quantities do not merge.
+// The quantity of an inventory item includes the quantity of its lots.
+type InventoryLot struct {
+	Quantity  int64     `json:"quantity" bson:"quantity"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expires_at"`
+}
+
+// ValidateExpiry runs validation checks on the expiry date of granted items, which is the zero time
+// when the items do not expire. The expiry date must be after the given date when the items were requested.
+func ValidateExpiry(v *validator.Validator, expiresAt time.Time, requestedAt time.Time) {
+	v.Check(expiresAt.IsZero() || expiresAt.After(requestedAt), "expiresAt", "must be in the future")
+}
+
+// newLots returns the lots holding the given quantity of items which expire at the given date.
+// Items which do not expire are not held by any lot.
+func newLots(quantity int64, expiresAt time.Time) []InventoryLot {
+	if expiresAt.IsZero() {
+		return nil
+	}
+
+	return []InventoryLot{{Quantity: quantity, ExpiresAt: expiresAt.UTC()}}
+}
+
+// capLots returns the given lots reduced so that they do not hold more than the given quantity altogether
+func capLots(lots []InventoryLot, quantity int64) []InventoryLot {
+	capped := []InventoryLot{}
+
+	for _, lot := range lots {
+		if quantity == 0 {
+			break
+		}
+
+		if lot.Quantity > quantity {
+			lot.Quantity = quantity
+		}
+
+		quantity -= lot.Quantity
+		capped = append(capped, lot)
+	}
+
+	return capped
+}
+
+// splitLots takes up to the given quantity from the lots which did not expire at the given date, starting with
+// the lots which expire first. It returns the taken lots along with the lots which are left.
+func splitLots(lots []InventoryLot, quantity int64, now time.Time) ([]InventoryLot, []InventoryLot) {
+	taken := []InventoryLot{}
+	left := []InventoryLot{}
+
+	for _, lot := range lots {
+		if quantity > 0 && lot.ExpiresAt.After(now) {
+			takenQuantity := lot.Quantity
+			if takenQuantity > quantity {
+				takenQuantity = quantity
+			}
+
+			taken = append(taken, InventoryLot{Quantity: takenQuantity, ExpiresAt: lot.ExpiresAt})
+			lot.Quantity -= takenQuantity
+			quantity -= takenQuantity
+		}
+
+		if lot.Quantity > 0 {
+			left = append(left, lot)
+		}
+	}
+
+	return taken, left
+}
+
+// expiredQuantity returns the quantity of the lots of the inventory item which expired at the given date
+func (i InventoryItem) expiredQuantity(now time.Time) int64 {
+	var quantity int64
+
+	for _, lot := range i.Lots {
+		if !lot.ExpiresAt.After(now) {
+			quantity += lot.Quantity
+		}
+	}
+
+	return quantity
+}
+
+// consumeLots takes the subtracted quantity from the lots of the given inventory item, as read after the
+// subtraction, so that its lots do not hold more than its quantity. Items expiring first are subtracted first.
+// It returns the taken lots.
+func (repo *InventoryItemsRepository) consumeLots(ctx context.Context, item InventoryItem, quantity int64) ([]InventoryLot, error) {
+	taken, left := splitLots(item.Lots, quantity, time.Now().UTC())
+	if len(taken) == 0 {
+		return taken, nil
+	}
+
+	_, err := repo.collection.UpdateOne(ctx, bson.M{"_id": item.ID}, bson.M{"$set": bson.M{"lots": left}})
+	if err != nil {
+		return nil, err
+	}
+
+	return taken, nil
+}
+
+// ExpireLots removes the expired lots of up to limit inventory items, deleting the inventory items which
+// are left empty. Every removal is recorded in our ledger and writes an InventoryItemUpdatedEvent and an
+// InventoryItemsExpiredEvent. Reservations which held expired items are reduced or released, newest first,
+// so that they do not hold more than the remaining quantity. It returns the number of inventory items whose
+// lots were removed.
+func (repo *InventoryItemsRepository) ExpireLots(ctx context.Context, limit int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	filter := bson.M{"lots.expires_at": bson.M{"$lte": time.Now().UTC()}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(int64(limit))
+
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var items []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+
+	err = cursor.All(ctx, &items)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+
+	for _, item := range items {
+		var removed bool
+
+		err = withTransaction(ctx, repo.client, func(ctx mongo.SessionContext) error {
+			var err error
+
+			removed, err = repo.expireLots(ctx, item.ID)
+
+			return err
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		if removed {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+// expireLots removes the expired lots of the inventory item with the given id along with their quantity,
+// and fits its reservations in the remaining quantity. The inventory item is read in our transaction so that
+// concurrent subtractions and reservations are taken into account.
+// It returns whether any lot was removed.
+func (repo *InventoryItemsRepository) expireLots(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	var item InventoryItem
+
+	err := repo.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&item)
+	if err != nil {
+		// The inventory item was deleted since we looked for expired lots
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	now := time.Now().UTC()
+
+	expiredQuantity := item.expiredQuantity(now)
+	if expiredQuantity == 0 {
+		return false, nil
+	}
+
+	// Lots do not hold more than the quantity of their inventory item, unless it was repaired from our ledger
+	if expiredQuantity > item.Quantity {
+		expiredQuantity = item.Quantity
+	}
+
+	left := []InventoryLot{}
+	expired := []InventoryLot{}
+
+	for _, lot := range item.Lots {
+		if lot.ExpiresAt.After(now) {
+			left = append(left, lot)
+		} else {
+			expired = append(expired, lot)
+		}
+	}
+
+	remaining := item.Quantity - expiredQuantity
+
+	// Our collection schema does not allow inventory items with a quantity of zero
+	if remaining == 0 {
+		_, err = repo.collection.DeleteOne(ctx, bson.M{"_id": id})
+	} else {
+		_, err = repo.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+			"$set": bson.M{"lots": left},
+			"$inc": bson.M{
+				"quantity": -expiredQuantity,
+				"version":  int32(1),
+			},
+		})
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// Reservations cannot hold more items than the user owns
+	err = repo.reservations.fit(ctx, item.UserID, item.CatalogItemID, remaining)
+	if err != nil {
+		return false, err
+	}
+
+	err = repo.recordChange(ctx, item.UserID, item.CatalogItemID, -expiredQuantity, remaining, capLots(expired, expiredQuantity), expirySource())
+	if err != nil {
+		return false, err
+	}
+
+	event := events.InventoryItemsExpiredEvent{
+		UserID:            item.UserID,
+		CatalogItemID:     item.CatalogItemID,
+		ExpiredQuantity:   expiredQuantity,
+		RemainingQuantity: remaining,
+	}
+
+	err = repo.outbox.add(ctx, events.InventoryItemsExpiredEventType, event)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// expiredQuantityExpr returns the aggregation expression which computes the quantity of the lots
+// of an inventory item which expired
+func expiredQuantityExpr() bson.M {
+	return bson.M{"$sum": bson.M{
+		"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$lots", bson.A{}}},
+				"cond":  bson.M{"$lte": bson.A{"$$this.expires_at", "$$NOW"}},
+			}},
+			"in": "$$this.quantity",
+		},
+	}}
+}
+
+// unexpiredQuantityExpr returns the aggregation expression which computes the quantity of an inventory item
+// which did not expire
+func unexpiredQuantityExpr() bson.M {
+	return bson.M{"$subtract": bson.A{"$quantity", expiredQuantityExpr()}}
+}
+
+// unexpiredStages returns the aggregation stages which retrieve the inventory items matching the given filter
+// without the quantity of their expired lots. Expired lots are removed by ExpireLots, so until it runs, we leave
+// out inventory items holding nothing but expired lots. Quantity conditions of the filter apply to the quantity
+// which did not expire.
+func unexpiredStages(filter bson.M) mongo.Pipeline {
+	itemFilter := bson.M{}
+	quantityFilter := bson.A{bson.M{"quantity": bson.M{"$gt": 0}}}
+
+	for key, value := range filter {
+		if key == "quantity" {
+			quantityFilter = append(quantityFilter, bson.M{"quantity": value})
+			continue
+		}
+
+		itemFilter[key] = value
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: itemFilter}},
+		{{Key: "$addFields", Value: bson.M{
+			"quantity": unexpiredQuantityExpr(),
+			"lots": bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$lots", bson.A{}}},
+				"cond":  bson.M{"$gt": bson.A{"$$this.expires_at", "$$NOW"}},
+			}},
+		}}},
+		{{Key: "$match", Value: bson.M{"$and": quantityFilter}}},
+	}
+}
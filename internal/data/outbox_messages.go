@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// publishedOutboxMessageRetention is the time we keep outbox messages once they are published
+const publishedOutboxMessageRetention = 7 * 24 * time.Hour
+
+// unpublishedOutboxMessagesIndex is the name of the partial index of the outbox messages which were not published yet
+const unpublishedOutboxMessagesIndex = "_id_unpublished"
+
+// OutboxMessage is a struct that defines a message waiting to be published to our message broker.
+// Outbox messages are written in the same transaction as the change they describe so that
+// a change is never committed without its message, nor the other way around.
+// Published tells whether the message was published, so that unpublished messages can be found
+// with a partial index: MongoDB partial indexes cannot select documents where a field does not exist.
+type OutboxMessage struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Type        string             `json:"type" bson:"type"`
+	Payload     []byte             `json:"payload" bson:"payload"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"created_at"`
+	Published   bool               `json:"published" bson:"published"`
+	PublishedAt *time.Time         `json:"publishedAt,omitempty" bson:"published_at,omitempty"`
+}
+
+// OutboxMessagesRepository is a MongoDB repository for outbox messages
+type OutboxMessagesRepository struct {
+	collection *mongo.Collection
+}
+
+// NewOutboxMessagesRepository creates a new outbox messages repository
+func NewOutboxMessagesRepository(client *mongo.Client, databaseName string) *OutboxMessagesRepository {
+	return &OutboxMessagesRepository{
+		collection: client.Database(databaseName).Collection(constants.OutboxMessagesCollection),
+	}
+}
+
+// add encodes the given event to JSON and inserts it as an outbox message of the given type.
+// It is meant to be called within the transaction of the change described by the event.
+func (repo *OutboxMessagesRepository) add(ctx context.Context, messageType string, event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	message := OutboxMessage{
+		Type:      messageType,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	_, err = repo.collection.InsertOne(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUnpublished returns up to limit outbox messages which were not published yet, by ascending id.
+// Ids are assigned before their transaction commits, so a message may be committed, and returned,
+// after messages with a greater id were already returned.
+func (repo *OutboxMessagesRepository) GetUnpublished(ctx context.Context, limit int64) ([]OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	filter := bson.M{
+		"published": false,
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []OutboxMessage{}
+
+	err = cursor.All(ctx, &messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkPublished records that the outbox message with the given id was published.
+// Published messages are deleted once their retention period is over.
+func (repo *OutboxMessagesRepository) MarkPublished(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	update := bson.M{
+		"$set": bson.M{
+			"published":    true,
+			"published_at": time.Now().UTC(),
+		},
+	}
+
+	_, err := repo.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateOutboxMessagesCollection creates outbox messages collection in MongoDB database
+func CreateOutboxMessagesCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"type", "payload", "created_at", "published"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"type": bson.M{
+				"bsonType":    "string",
+				"description": "Type of the message",
+			},
+			"payload": bson.M{
+				"bsonType":    "binData",
+				"description": "JSON encoded message",
+			},
+			"created_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when message was created",
+			},
+			"published": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether message was published",
+			},
+			"published_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when message was published",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.OutboxMessagesCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	collection := db.Collection(constants.OutboxMessagesCollection)
+
+	// Messages written before we recorded whether they were published only have a published date once published
+	_, err = collection.UpdateMany(
+		context.Background(),
+		bson.M{"published": bson.M{"$exists": false}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"published": bson.M{"$ne": bson.A{bson.M{"$type": "$published_at"}, "missing"}},
+			}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Create TTL index which deletes published messages.
+	// Messages which were not published yet do not have a published date and are never deleted.
+	// Create partial index of the messages which were not published yet, so that the relay does not scan
+	// the published ones, which are kept during their retention period.
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "published_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(publishedOutboxMessageRetention.Seconds())),
+		},
+		{
+			Keys: bson.D{{Key: "_id", Value: 1}},
+			Options: options.Index().
+				SetName(unpublishedOutboxMessagesIndex).
+				SetPartialFilterExpression(bson.M{"published": false}),
+		},
+	}
+
+	_, err = collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded or was not created for the requested sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursorValueTypes maps the fields we sort by to the BSON type of their values. Cursors holding a value
+// of another type were not created by us, and would match records of other types instead of failing.
+var cursorValueTypes = map[string]bsontype.Type{
+	"quantity":      bsontype.Int64,
+	"acquired_date": bsontype.DateTime,
+	"name":          bsontype.String,
+	"description":   bsontype.String,
+}
+
+// CursorMetadata is a struct that holds the pagination metadata of cursor based pagination.
+// NextCursor is empty once there are no more records.
+type CursorMetadata struct {
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageCursor is a struct that holds the position of the last record of a page.
+// It records the sort it was created for, the value of the sorted field and the id of the record,
+// which we use as a secondary sort to ensure a consistent ordering.
+type pageCursor struct {
+	Sort  string             `bson:"s"`
+	Value bson.RawValue      `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+// encodeCursor returns the opaque representation of the given cursor sent to clients
+func encodeCursor(cursor pageCursor) (string, error) {
+	bytes, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// decodeCursor decodes the given opaque cursor
+func decodeCursor(encodedCursor string) (pageCursor, error) {
+	var cursor pageCursor
+
+	bytes, err := base64.RawURLEncoding.DecodeString(encodedCursor)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+
+	err = bson.Unmarshal(bytes, &cursor)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// afterCursor returns the condition matching the records which come after the given cursor
+// when sorting by the given field and direction, and then by id in ascending order.
+// It returns ErrInvalidCursor if the cursor was not created for the given sort
+// or if its value does not have the type of the values of the sorted field.
+func afterCursor(sort string, field string, direction int8, cursor pageCursor) (bson.M, error) {
+	if cursor.Sort != sort || cursor.ID.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+
+	operator := "$gt"
+	if direction < 0 {
+		operator = "$lt"
+	}
+
+	if field == "_id" {
+		return bson.M{"_id": bson.M{operator: cursor.ID}}, nil
+	}
+
+	valueType, ok := cursorValueTypes[field]
+	if !ok || cursor.Value.Type != valueType {
+		return nil, ErrInvalidCursor
+	}
+
+	return bson.M{
+		"$or": bson.A{
+			bson.M{field: bson.M{operator: cursor.Value}},
+			bson.M{field: cursor.Value, "_id": bson.M{"$gt": cursor.ID}},
+		},
+	}, nil
+}
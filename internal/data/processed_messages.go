@@ -0,0 +1,274 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// messageIDIndex is the name of the unique index which guarantees that a message is processed at most once
+const messageIDIndex = "message_id_1"
+
+// processedAtIndex is the name of the TTL index which used to delete old processed messages
+const processedAtIndex = "processed_at_1"
+
+// migrationBatchSize is the number of message ids we move at once from inventory items to our processed messages
+const migrationBatchSize = 1000
+
+// ProcessedMessage is a struct that defines a message whose changes were applied to our inventory items,
+// or which was rejected, in which case Rejection holds the reason why it was rejected.
+// Processed messages are stored apart from inventory items so that they outlive the inventory items they changed,
+// and they are never deleted since messages can be delivered again at any time (e.g. replayed from a dead letter queue).
+type ProcessedMessage struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	MessageID   primitive.ObjectID `bson:"message_id"`
+	ProcessedAt time.Time          `bson:"processed_at"`
+	Rejection   string             `bson:"rejection,omitempty"`
+}
+
+// ProcessedMessagesRepository is a MongoDB repository for processed messages
+type ProcessedMessagesRepository struct {
+	collection *mongo.Collection
+}
+
+// NewProcessedMessagesRepository creates a new processed messages repository
+func NewProcessedMessagesRepository(client *mongo.Client, databaseName string) *ProcessedMessagesRepository {
+	return &ProcessedMessagesRepository{
+		collection: client.Database(databaseName).Collection(constants.ProcessedMessagesCollection),
+	}
+}
+
+// GetByMessageID retrieves the processed message with the given message id.
+// It returns database.ErrRecordNotFound if the message was not processed.
+func (repo *ProcessedMessagesRepository) GetByMessageID(ctx context.Context, messageID primitive.ObjectID) (ProcessedMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var message ProcessedMessage
+
+	err := repo.collection.FindOne(ctx, bson.M{"message_id": messageID}).Decode(&message)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return message, database.ErrRecordNotFound
+		}
+
+		return message, err
+	}
+
+	return message, nil
+}
+
+// Reject records that the message with the given id was rejected for the given reason, so that its changes
+// are not applied if it is delivered again. It returns ErrMessageAlreadyProcessed if the message was already processed.
+func (repo *ProcessedMessagesRepository) Reject(ctx context.Context, messageID primitive.ObjectID, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return repo.insert(ctx, ProcessedMessage{
+		MessageID:   messageID,
+		ProcessedAt: time.Now().UTC(),
+		Rejection:   reason,
+	})
+}
+
+// add records that the message with the given id was processed. It must be called in the transaction applying
+// the changes of the message so that they are recorded together. It returns ErrMessageAlreadyProcessed if the
+// message was already processed, and does nothing when given primitive.NilObjectID.
+func (repo *ProcessedMessagesRepository) add(ctx context.Context, messageID primitive.ObjectID) error {
+	if messageID == primitive.NilObjectID {
+		return nil
+	}
+
+	return repo.insert(ctx, ProcessedMessage{
+		MessageID:   messageID,
+		ProcessedAt: time.Now().UTC(),
+	})
+}
+
+// insert inserts the given processed message. It returns ErrMessageAlreadyProcessed if its message was already processed.
+func (repo *ProcessedMessagesRepository) insert(ctx context.Context, message ProcessedMessage) error {
+	_, err := repo.collection.InsertOne(ctx, message)
+	if err != nil {
+		if isDuplicateKeyOn(err, messageIDIndex) {
+			return ErrMessageAlreadyProcessed
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// CreateProcessedMessagesCollection creates processed messages collection in MongoDB database, and moves
+// the message ids recorded by inventory items to it. It must run after the inventory items collection is created.
+func CreateProcessedMessagesCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"message_id", "processed_at"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"message_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "ID of the processed message",
+			},
+			"processed_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when message was processed",
+			},
+			"rejection": bson.M{
+				"bsonType":    "string",
+				"description": "Reason why the message was rejected",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	err := createOrUpdateCollection(db, constants.ProcessedMessagesCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	collection := db.Collection(constants.ProcessedMessagesCollection)
+
+	// Processed messages used to expire. Dropping an index that does not exist fails, so we ignore
+	// the IndexNotFound error.
+	_, err = collection.Indexes().DropOne(context.Background(), processedAtIndex)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != 27 {
+			return err
+		}
+	}
+
+	// Create unique index on the message id
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "message_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName(messageIDIndex),
+		},
+	}
+
+	_, err = collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return migrateMessageIds(db)
+}
+
+// migrateMessageIds moves the message ids which used to be recorded by inventory items to our processed messages,
+// so that the messages they processed are still detected once delivered again. Inventory items are read one at a time
+// and their message ids are moved in batches of about migrationBatchSize, so that the migration does not hold every
+// message id in memory. Messages are recorded before their ids are removed from inventory items, so the migration
+// can safely run again if it is interrupted.
+func migrateMessageIds(db *mongo.Database) error {
+	ctx := context.Background()
+	items := db.Collection(constants.InventoryItemsCollection)
+	processed := db.Collection(constants.ProcessedMessagesCollection)
+
+	opts := options.Find().SetProjection(bson.M{"message_ids": 1}).SetBatchSize(migrationBatchSize)
+
+	cursor, err := items.Find(ctx, bson.M{"message_ids": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return err
+	}
+
+	defer cursor.Close(ctx)
+
+	var itemIDs []primitive.ObjectID
+	var messages []interface{}
+
+	// flush records the messages of the current batch and removes their ids from their inventory items
+	flush := func() error {
+		err := insertProcessedMessages(ctx, processed, messages)
+		if err != nil {
+			return err
+		}
+
+		_, err = items.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": itemIDs}}, bson.M{"$unset": bson.M{"message_ids": ""}})
+		if err != nil {
+			return err
+		}
+
+		itemIDs = itemIDs[:0]
+		messages = messages[:0]
+
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var item struct {
+			ID         primitive.ObjectID   `bson:"_id"`
+			MessageIds []primitive.ObjectID `bson:"message_ids"`
+		}
+
+		err = cursor.Decode(&item)
+		if err != nil {
+			return err
+		}
+
+		itemIDs = append(itemIDs, item.ID)
+
+		for _, messageID := range item.MessageIds {
+			messages = append(messages, ProcessedMessage{MessageID: messageID, ProcessedAt: time.Now().UTC()})
+		}
+
+		if len(messages) >= migrationBatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return err
+	}
+
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	return flush()
+}
+
+// insertProcessedMessages inserts the given processed messages into the given collection,
+// ignoring the ones which were already recorded (i.e. by a previous run of our migration)
+func insertProcessedMessages(ctx context.Context, collection *mongo.Collection, messages []interface{}) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	_, err := collection.InsertMany(ctx, messages, options.InsertMany().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !isDuplicateKeyOn(writeErr.WriteError, messageIDIndex) {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return err
+}
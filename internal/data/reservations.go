@@ -0,0 +1,285 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultReservationDuration is the time after which a reservation expires when its duration is not given
+	DefaultReservationDuration = 15 * time.Minute
+
+	// MaxReservationDuration is the maximum time after which a reservation expires
+	MaxReservationDuration = 24 * time.Hour
+)
+
+// Reservation is a struct that defines a quantity of a catalog item held in the inventory of an user
+// while a deal is pending. Reserved items cannot be subtracted, transferred nor reserved again until the
+// reservation is confirmed, which subtracts them, released or expired.
+type Reservation struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID        int64              `json:"userID" bson:"user_id"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Quantity      int64              `json:"quantity" bson:"quantity"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"created_at"`
+	ExpiresAt     time.Time          `json:"expiresAt" bson:"expires_at"`
+}
+
+// ValidateReservation runs validation checks on the `Reservation` struct
+func ValidateReservation(v *validator.Validator, reservation Reservation) {
+	v.Check(reservation.UserID > 0, "userID", "must be greater than 0")
+	v.Check(reservation.CatalogItemID != primitive.NilObjectID, "catalogItemID", "must be provided")
+	v.Check(reservation.Quantity > 0, "quantity", "must be greater than 0")
+}
+
+// ReservationsRepository is a MongoDB repository for reservations.
+// Expired reservations are ignored, and deleted by a TTL index.
+type ReservationsRepository struct {
+	collection *mongo.Collection
+}
+
+// NewReservationsRepository creates a new reservations repository
+func NewReservationsRepository(client *mongo.Client, databaseName string) *ReservationsRepository {
+	return &ReservationsRepository{
+		collection: client.Database(databaseName).Collection(constants.ReservationsCollection),
+	}
+}
+
+// Get retrieves the reservation with the given id.
+// It returns database.ErrRecordNotFound if the reservation does not exist or expired.
+func (repo *ReservationsRepository) Get(ctx context.Context, id primitive.ObjectID) (Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var reservation Reservation
+
+	err := repo.collection.FindOne(ctx, activeReservationFilter(bson.M{"_id": id})).Decode(&reservation)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return reservation, database.ErrRecordNotFound
+		}
+
+		return reservation, err
+	}
+
+	return reservation, nil
+}
+
+// add inserts the given reservation and sets its id.
+// It is meant to be called within the transaction which checked that enough items are available.
+func (repo *ReservationsRepository) add(ctx context.Context, reservation *Reservation) error {
+	reservation.ID = primitive.NewObjectID()
+
+	_, err := repo.collection.InsertOne(ctx, reservation)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// take deletes the reservation with the given id and returns it.
+// It returns database.ErrRecordNotFound if the reservation does not exist or expired.
+func (repo *ReservationsRepository) take(ctx context.Context, id primitive.ObjectID) (Reservation, error) {
+	var reservation Reservation
+
+	err := repo.collection.FindOneAndDelete(ctx, activeReservationFilter(bson.M{"_id": id})).Decode(&reservation)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return reservation, database.ErrRecordNotFound
+		}
+
+		return reservation, err
+	}
+
+	return reservation, nil
+}
+
+// fit reduces or deletes the newest reservations of the given catalog item in the inventory of the given user
+// so that they do not hold more than the given quantity altogether. Older reservations are kept as they are.
+// It is meant to be called within the transaction which reduced the quantity of the inventory item.
+func (repo *ReservationsRepository) fit(ctx context.Context, userID int64, catalogItemID primitive.ObjectID, quantity int64) error {
+	filter := activeReservationFilter(bson.M{
+		"user_id":         userID,
+		"catalog_item_id": catalogItemID,
+	})
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+
+	var reservations []Reservation
+
+	err = cursor.All(ctx, &reservations)
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		switch {
+		case reservation.Quantity <= quantity:
+			quantity -= reservation.Quantity
+			continue
+		case quantity > 0:
+			_, err = repo.collection.UpdateByID(ctx, reservation.ID, bson.M{"$set": bson.M{"quantity": quantity}})
+			quantity = 0
+		default:
+			_, err = repo.collection.DeleteOne(ctx, bson.M{"_id": reservation.ID})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reservedQuantity returns the quantity of the given catalog item reserved in the inventory of the given user
+func (repo *ReservationsRepository) reservedQuantity(ctx context.Context, userID int64, catalogItemID primitive.ObjectID) (int64, error) {
+	filter := activeReservationFilter(bson.M{
+		"user_id":         userID,
+		"catalog_item_id": catalogItemID,
+	})
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      nil,
+			"quantity": bson.M{"$sum": "$quantity"},
+		}}},
+	}
+
+	cursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+
+	var results []struct {
+		Quantity int64 `bson:"quantity"`
+	}
+
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) == 0 {
+		return 0, nil
+	}
+
+	return results[0].Quantity, nil
+}
+
+// activeReservationFilter adds to the given filter the condition matching reservations which did not expire.
+// Our TTL index does not delete expired reservations right away.
+func activeReservationFilter(filter bson.M) bson.M {
+	filter["expires_at"] = bson.M{"$gt": time.Now().UTC()}
+	return filter
+}
+
+// reservationLookupStages returns the aggregation stages which add the quantity reserved in inventory items
+func reservationLookupStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from": constants.ReservationsCollection,
+			"let":  bson.M{"user_id": "$user_id", "catalog_item_id": "$catalog_item_id"},
+			"pipeline": mongo.Pipeline{
+				{{Key: "$match", Value: bson.M{
+					"$expr": bson.M{
+						"$and": bson.A{
+							bson.M{"$eq": bson.A{"$user_id", "$$user_id"}},
+							bson.M{"$eq": bson.A{"$catalog_item_id", "$$catalog_item_id"}},
+							bson.M{"$gt": bson.A{"$expires_at", "$$NOW"}},
+						},
+					},
+				}}},
+				{{Key: "$project", Value: bson.M{"quantity": 1}}},
+			},
+			"as": "reservations",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"reserved_quantity": bson.M{"$sum": "$reservations.quantity"},
+		}}},
+	}
+}
+
+// CreateReservationsCollection creates reservations collection in MongoDB database
+func CreateReservationsCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"user_id", "catalog_item_id", "quantity", "created_at", "expires_at"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"user_id": bson.M{
+				"bsonType":    "long",
+				"description": "ID of user who owns the reserved items",
+			},
+			"catalog_item_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "ID of the catalog item",
+			},
+			"quantity": bson.M{
+				"bsonType":    "long",
+				"minimum":     1,
+				"description": "Quantity of items reserved",
+			},
+			"created_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when reservation was created",
+			},
+			"expires_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when reservation expires",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.ReservationsCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	// Create index used to sum the reserved quantity of inventory items,
+	// and TTL index which deletes reservations once they expire
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "catalog_item_id", Value: 1}, {Key: "expires_at", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+
+	_, err = db.Collection(constants.ReservationsCollection).Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transfer is a struct that defines a quantity of a catalog item moved from the inventory
+// of one user to the inventory of another user. Transfers are recorded for auditing.
+type Transfer struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FromUserID    int64              `json:"fromUserID" bson:"from_user_id"`
+	ToUserID      int64              `json:"toUserID" bson:"to_user_id"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID" bson:"catalog_item_id"`
+	Quantity      int64              `json:"quantity" bson:"quantity"`
+	InitiatedBy   int64              `json:"initiatedBy" bson:"initiated_by"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"created_at"`
+}
+
+// ValidateTransfer runs validation checks on the `Transfer` struct
+func ValidateTransfer(v *validator.Validator, transfer Transfer) {
+	v.Check(transfer.FromUserID > 0, "fromUserID", "must be greater than 0")
+	v.Check(transfer.ToUserID > 0, "toUserID", "must be greater than 0")
+	v.Check(transfer.ToUserID != transfer.FromUserID, "toUserID", "must be different from fromUserID")
+	v.Check(!transfer.CatalogItemID.IsZero(), "catalogItemID", "must be provided")
+	v.Check(transfer.Quantity > 0, "quantity", "must be greater than 0")
+}
+
+// TransfersRepository is a MongoDB repository for transfers
+type TransfersRepository struct {
+	collection *mongo.Collection
+}
+
+// NewTransfersRepository creates a new transfers repository
+func NewTransfersRepository(client *mongo.Client, databaseName string) *TransfersRepository {
+	return &TransfersRepository{
+		collection: client.Database(databaseName).Collection(constants.TransfersCollection),
+	}
+}
+
+// add inserts the given transfer and sets its id and creation date.
+// It is meant to be called within the transaction which moved the transferred items.
+func (repo *TransfersRepository) add(ctx context.Context, transfer *Transfer) error {
+	transfer.ID = primitive.NewObjectID()
+	transfer.CreatedAt = time.Now().UTC()
+
+	_, err := repo.collection.InsertOne(ctx, transfer)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateTransfersCollection creates transfers collection in MongoDB database
+func CreateTransfersCollection(client *mongo.Client, databaseName string) error {
+	db := client.Database(databaseName)
+
+	// JSON validation schema
+	jsonSchema := bson.M{
+		"bsonType":             "object",
+		"required":             []string{"from_user_id", "to_user_id", "catalog_item_id", "quantity", "initiated_by", "created_at"},
+		"additionalProperties": false,
+		"properties": bson.M{
+			"_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "Document ID",
+			},
+			"from_user_id": bson.M{
+				"bsonType":    "long",
+				"description": "ID of user who gave the items",
+			},
+			"to_user_id": bson.M{
+				"bsonType":    "long",
+				"description": "ID of user who received the items",
+			},
+			"catalog_item_id": bson.M{
+				"bsonType":    "objectId",
+				"description": "ID of the catalog item",
+			},
+			"quantity": bson.M{
+				"bsonType":    "long",
+				"minimum":     1,
+				"description": "Quantity of items transferred",
+			},
+			"initiated_by": bson.M{
+				"bsonType":    "long",
+				"description": "ID of user who requested the transfer",
+			},
+			"created_at": bson.M{
+				"bsonType":    "date",
+				"description": "Date when transfer was made",
+			},
+		},
+	}
+
+	validator := bson.M{
+		"$jsonSchema": jsonSchema,
+	}
+
+	// Create collection, or update its validator if it already exists
+	err := createOrUpdateCollection(db, constants.TransfersCollection, validator)
+	if err != nil {
+		return err
+	}
+
+	// Create indexes used to look up the transfers of an user
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "from_user_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "to_user_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+	}
+
+	_, err = db.Collection(constants.TransfersCollection).Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
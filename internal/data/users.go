@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsersRepository is a MongoDB repository for users. It embeds our generic repository
+// and adds the version-aware writes used to keep our copy of the users in sync.
+type UsersRepository struct {
+	types.MongoRepository[int64, database.User]
+	collection *mongo.Collection
+}
+
+// NewUsersRepository creates a new users repository
+func NewUsersRepository(client *mongo.Client, databaseName string) *UsersRepository {
+	return &UsersRepository{
+		MongoRepository: database.NewMongoRepository[int64, database.User](client, databaseName, database.UsersCollection),
+		collection:      client.Database(databaseName).Collection(database.UsersCollection),
+	}
+}
+
+// Upsert inserts the given user or replaces the stored one if the given user has a newer version.
+// User updated events carry the whole state of the user, so permissions and activation status
+// are always replaced so that they can be revoked. Users without permissions are sent with null
+// permissions, which revokes every permission as well.
+// It returns false when the stored user already has the same or a newer version.
+func (repo *UsersRepository) Upsert(ctx context.Context, user database.User) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// Our collection schema requires permissions to be an array
+	permissions := user.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	filter := bson.M{
+		"_id":     user.ID,
+		"version": bson.M{"$lt": user.Version},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"permissions": permissions,
+			"activated":   user.Activated,
+			"version":     user.Version,
+		},
+	}
+
+	_, err := repo.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		// When the stored user is up to date our filter does not match any document,
+		// so MongoDB tries to insert a new document with an id that already exists
+		if isDuplicateKeyOn(err, "_id_") {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,20 @@
+package events
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// CatalogItemUpsertedEvent is the event sent by the Catalog microservice whenever a catalog item is created or updated.
+// It carries the whole state of the catalog item.
+// MaxStack is the maximum quantity of the catalog item an user can own, and is 0 when it is not limited.
+type CatalogItemUpsertedEvent struct {
+	ID          primitive.ObjectID `json:"id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	MaxStack    int64              `json:"maxStack"`
+	Version     int32              `json:"version"`
+}
+
+// CatalogItemDeletedEvent is the event sent by the Catalog microservice whenever a catalog item is deleted
+type CatalogItemDeletedEvent struct {
+	ID      primitive.ObjectID `json:"id"`
+	Version int32              `json:"version"`
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GrantItemsCommand is the command sent by other microservices (i.e. a purchase saga) to grant items to an user.
+// ExpiresAt is the date when the granted items expire, and is the zero time when they do not expire.
+type GrantItemsCommand struct {
+	UserID        int64              `json:"userID"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+	Quantity      int64              `json:"quantity"`
+	ExpiresAt     time.Time          `json:"expiresAt"`
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+}
+
+// SubtractItemsCommand is the command sent by other microservices (i.e. a purchase saga) to subtract items from an user
+type SubtractItemsCommand struct {
+	UserID        int64              `json:"userID"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+	Quantity      int64              `json:"quantity"`
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+}
+
+// InventoryItemsGrantedEvent is the event sent whenever the items of a GrantItemsCommand are granted
+type InventoryItemsGrantedEvent struct {
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+}
+
+// InventoryItemsSubtractedEvent is the event sent whenever the items of a SubtractItemsCommand are subtracted
+type InventoryItemsSubtractedEvent struct {
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+}
+
+// InventoryItemsGrantRejectedEvent is the event sent whenever the items of a GrantItemsCommand cannot be granted.
+// Reason describes why they were rejected.
+type InventoryItemsGrantRejectedEvent struct {
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+	Reason        string             `json:"reason"`
+}
+
+// InventoryItemsSubtractRejectedEvent is the event sent whenever the items of a SubtractItemsCommand cannot be subtracted.
+// Reason describes why they were rejected.
+type InventoryItemsSubtractRejectedEvent struct {
+	CorrelationID primitive.ObjectID `json:"correlationID"`
+	Reason        string             `json:"reason"`
+}
+
+// InventoryItemUpdatedEventType is the type of the outbox messages holding an InventoryItemUpdatedEvent
+const InventoryItemUpdatedEventType = "inventory-item-updated"
+
+// InventoryItemUpdatedEvent is the event sent whenever the quantity of an inventory item changes.
+// Quantity is the quantity owned by the user after the change and is 0 once the user owns none.
+// Events are delivered at least once and may arrive out of order, so the last event received
+// does not necessarily hold the current quantity.
+type InventoryItemUpdatedEvent struct {
+	UserID        int64              `json:"userID"`
+	CatalogItemID primitive.ObjectID `json:"catalogItemID"`
+	Quantity      int64              `json:"quantity"`
+}
+
+// InventoryItemsExpiredEventType is the type of the outbox messages holding an InventoryItemsExpiredEvent
+const InventoryItemsExpiredEventType = "inventory-items-expired"
+
+// InventoryItemsExpiredEvent is the event sent whenever time-limited items expire and are removed from an inventory.
+// RemainingQuantity is the quantity owned by the user afterwards and is 0 once the user owns none.
+// Like InventoryItemUpdatedEvent, it is delivered at least once and may arrive out of order.
+type InventoryItemsExpiredEvent struct {
+	UserID            int64              `json:"userID"`
+	CatalogItemID     primitive.ObjectID `json:"catalogItemID"`
+	ExpiredQuantity   int64              `json:"expiredQuantity"`
+	RemainingQuantity int64              `json:"remainingQuantity"`
+}
@@ -0,0 +1,75 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// CatalogItemDeletedConsumer is the consumer for catalog item deleted event
+type CatalogItemDeletedConsumer struct {
+	baseConsumer
+	catalogItemsRepository *data.CatalogItemsRepository
+}
+
+// NewCatalogItemDeletedConsumer returns a new CatalogItemDeletedConsumer
+func NewCatalogItemDeletedConsumer(
+	catalogItemsRepository *data.CatalogItemsRepository,
+	serviceName string,
+	options ConsumerOptions,
+	logger *logger.Logger,
+) *CatalogItemDeletedConsumer {
+	consumer := CatalogItemDeletedConsumer{
+		baseConsumer: baseConsumer{
+			exchangeName: "Play.Catalog:catalog-item-deleted",
+			routingKey:   "",
+			consumerTag:  "",
+			queueName:    fmt.Sprintf("%s-catalog-item-deleted", serviceName),
+			options:      options,
+			partitionKey: partitionByJSONField("id"),
+			logger:       logger,
+		},
+		catalogItemsRepository: catalogItemsRepository,
+	}
+
+	return &consumer
+}
+
+// StartConsumer starts up consumer and keeps it listening for messages
+func (consumer *CatalogItemDeletedConsumer) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	return consumer.consume(ctx, conn, func(ctx context.Context, msg amqp.Delivery) error {
+		var event events.CatalogItemDeletedEvent
+
+		err := json.Unmarshal(msg.Body, &event)
+		if err != nil {
+			return permanent(err)
+		}
+
+		return consumer.handleEvent(ctx, event)
+	})
+}
+
+func (consumer *CatalogItemDeletedConsumer) handleEvent(ctx context.Context, event events.CatalogItemDeletedEvent) error {
+	// Replace catalog item by a tombstone unless we already have a newer version of it
+	deleted, err := consumer.catalogItemsRepository.DeleteVersion(ctx, event.ID, event.Version)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		staleEventsTotal.WithLabelValues(consumer.queueName).Inc()
+
+		consumer.logger.Info("Ignoring stale catalog item deleted event", map[string]string{
+			"id":      event.ID.Hex(),
+			"version": fmt.Sprint(event.Version),
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// CatalogItemCreatedEvent is the name of the event sent by the Catalog microservice whenever a catalog item is created
+	CatalogItemCreatedEvent = "catalog-item-created"
+
+	// CatalogItemUpdatedEvent is the name of the event sent by the Catalog microservice whenever a catalog item is updated
+	CatalogItemUpdatedEvent = "catalog-item-updated"
+)
+
+// CatalogItemUpsertedConsumer is the consumer for the events carrying the whole state of a catalog item,
+// which are catalog item created and catalog item updated events
+type CatalogItemUpsertedConsumer struct {
+	baseConsumer
+	catalogItemsRepository *data.CatalogItemsRepository
+}
+
+// NewCatalogItemUpsertedConsumer returns a new CatalogItemUpsertedConsumer for the given event of the Catalog microservice
+func NewCatalogItemUpsertedConsumer(
+	catalogItemsRepository *data.CatalogItemsRepository,
+	eventName string,
+	serviceName string,
+	options ConsumerOptions,
+	logger *logger.Logger,
+) *CatalogItemUpsertedConsumer {
+	consumer := CatalogItemUpsertedConsumer{
+		baseConsumer: baseConsumer{
+			exchangeName: fmt.Sprintf("Play.Catalog:%s", eventName),
+			routingKey:   "",
+			consumerTag:  "",
+			queueName:    fmt.Sprintf("%s-%s", serviceName, eventName),
+			options:      options,
+			partitionKey: partitionByJSONField("id"),
+			logger:       logger,
+		},
+		catalogItemsRepository: catalogItemsRepository,
+	}
+
+	return &consumer
+}
+
+// StartConsumer starts up consumer and keeps it listening for messages
+func (consumer *CatalogItemUpsertedConsumer) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	return consumer.consume(ctx, conn, func(ctx context.Context, msg amqp.Delivery) error {
+		var event events.CatalogItemUpsertedEvent
+
+		err := json.Unmarshal(msg.Body, &event)
+		if err != nil {
+			return permanent(err)
+		}
+
+		return consumer.handleEvent(ctx, event)
+	})
+}
+
+func (consumer *CatalogItemUpsertedConsumer) handleEvent(ctx context.Context, event events.CatalogItemUpsertedEvent) error {
+	item := data.CatalogItem{
+		ID:          event.ID,
+		Name:        event.Name,
+		Description: event.Description,
+		MaxStack:    event.MaxStack,
+		Version:     event.Version,
+	}
+
+	// Create or update catalog item, unless we already have this version (or a newer one) of it.
+	// Created and updated events arrive on different queues, so an updated event can be handled
+	// before the created event of its catalog item, which is then ignored.
+	applied, err := consumer.catalogItemsRepository.Upsert(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	if !applied {
+		staleEventsTotal.WithLabelValues(consumer.queueName).Inc()
+
+		consumer.logger.Info("Ignoring stale catalog item event", map[string]string{
+			"queue":   consumer.queueName,
+			"id":      event.ID.Hex(),
+			"version": fmt.Sprint(event.Version),
+		})
+	}
+
+	return nil
+}
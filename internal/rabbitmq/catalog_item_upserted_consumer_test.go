@@ -0,0 +1,70 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCatalogItemUpsertedConsumerHandleEvent(t *testing.T) {
+	catalogItemsRepository := data.NewCatalogItemsRepository(newTestDatabase(t), testDatabase)
+	logger := newTestConsumer(1).logger
+	created := NewCatalogItemUpsertedConsumer(catalogItemsRepository, CatalogItemCreatedEvent, "test", ConsumerOptions{}, logger)
+	updated := NewCatalogItemUpsertedConsumer(catalogItemsRepository, CatalogItemUpdatedEvent, "test", ConsumerOptions{}, logger)
+	id := primitive.NewObjectID()
+
+	if created.queueName != "test-catalog-item-created" || created.exchangeName != "Play.Catalog:catalog-item-created" {
+		t.Errorf("want created events to be consumed from their own queue and exchange, but got %q and %q", created.queueName, created.exchangeName)
+	}
+
+	tests := []struct {
+		testName            string
+		consumer            *CatalogItemUpsertedConsumer
+		event               events.CatalogItemUpsertedEvent
+		wantedStale         bool
+		wantedName          string
+		wantedStoredVersion int32
+	}{
+		{"Update before creation", updated, events.CatalogItemUpsertedEvent{ID: id, Name: "Potion", Description: "Heals", MaxStack: 10, Version: 2}, false, "Potion", 2},
+		{"Delayed creation", created, events.CatalogItemUpsertedEvent{ID: id, Name: "Old potion", Description: "Heals", Version: 1}, true, "Potion", 2},
+		{"Same version", updated, events.CatalogItemUpsertedEvent{ID: id, Name: "Other potion", Description: "Heals", Version: 2}, true, "Potion", 2},
+		{"Newer version", updated, events.CatalogItemUpsertedEvent{ID: id, Name: "Hi-Potion", Description: "Heals", Version: 3}, false, "Hi-Potion", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			staleEvents := staleEventsTotal.WithLabelValues(tt.consumer.queueName)
+			staleBefore := counterValue(t, staleEvents)
+
+			err := tt.consumer.handleEvent(context.Background(), tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantedStaleEvents := staleBefore
+			if tt.wantedStale {
+				wantedStaleEvents++
+			}
+
+			if staleAfter := counterValue(t, staleEvents); staleAfter != wantedStaleEvents {
+				t.Errorf("want stale_events_total to be %v, but got %v", wantedStaleEvents, staleAfter)
+			}
+
+			item, err := catalogItemsRepository.GetByID(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if item.Version != tt.wantedStoredVersion {
+				t.Errorf("want version %d, but got %d", tt.wantedStoredVersion, item.Version)
+			}
+
+			if item.Name != tt.wantedName {
+				t.Errorf("want name %q, but got %q", tt.wantedName, item.Name)
+			}
+		})
+	}
+}
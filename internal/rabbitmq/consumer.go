@@ -0,0 +1,480 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// maxDeliveryAttempts is the number of times a consumer tries to handle a message
+	// before sending it to its dead-letter exchange
+	maxDeliveryAttempts = 5
+
+	// initialRetryBackoff is the time a consumer waits before handling a message again
+	// after a failure. It doubles after every failed attempt.
+	initialRetryBackoff = 200 * time.Millisecond
+
+	// consumerDrainTimeout is the maximum time a consumer waits for the messages
+	// being handled once it is stopped
+	consumerDrainTimeout = 10 * time.Second
+)
+
+// errChannelClosed is returned by consumers when their channel closes
+var errChannelClosed = errors.New("channel closed")
+
+// Consumer is the interface implemented by all of our message consumers
+type Consumer interface {
+	// CreateChannel declares the topology of the consumer using the given connection
+	CreateChannel(conn *amqp.Connection) error
+
+	// StartConsumer consumes messages using the given connection until its channel closes
+	// or the given context is canceled
+	StartConsumer(ctx context.Context, conn *amqp.Connection) error
+}
+
+// ConsumerOptions is a struct that holds the settings of the worker pool of a consumer
+type ConsumerOptions struct {
+	// Workers is the number of messages handled in parallel
+	Workers int
+
+	// Prefetch is the maximum number of unacknowledged messages RabbitMQ delivers to the consumer
+	Prefetch int
+}
+
+// permanentError wraps errors which cannot be fixed by handling the same message again
+// (i.e. malformed messages). Messages failing with such an error are dead-lettered right away.
+type permanentError struct {
+	err error
+}
+
+// Error returns the message of the wrapped error
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks the given error as a permanent error
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// baseConsumer holds the fields shared by all of our consumers and implements
+// the logic to declare their topology and receive their messages
+type baseConsumer struct {
+	exchangeName string
+	routingKey   string
+	consumerTag  string
+	queueName    string
+	options      ConsumerOptions
+	partitionKey partitionKeyFunc
+	logger       *logger.Logger
+}
+
+// partitionKeyFunc returns the key of the given message. Messages with the same key are handled
+// by the same worker, one at a time and in the order they were delivered.
+type partitionKeyFunc func(msg amqp.Delivery) string
+
+// partitionByJSONField returns a partitionKeyFunc which reads the given field of JSON messages.
+// Messages which cannot be decoded all get the same key and are handled by the same worker.
+func partitionByJSONField(field string) partitionKeyFunc {
+	return func(msg amqp.Delivery) string {
+		var body map[string]json.RawMessage
+
+		err := json.Unmarshal(msg.Body, &body)
+		if err != nil {
+			return ""
+		}
+
+		return string(body[field])
+	}
+}
+
+// deadLetterExchangeName returns the name of the exchange (and queue) where the consumer
+// sends the messages it fails to handle
+func (consumer *baseConsumer) deadLetterExchangeName() string {
+	return fmt.Sprintf("%s-dead-letter", consumer.queueName)
+}
+
+// CreateChannel declares an exchange and a queue using consumer fields and binds the two together.
+// It also declares the dead-letter exchange and queue of the consumer.
+func (consumer *baseConsumer) CreateChannel(conn *amqp.Connection) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	defer channel.Close()
+
+	// Declare exchange
+	err = channel.ExchangeDeclare(
+		consumer.exchangeName,
+		"fanout", // Exchange type
+		true,     // durable?
+		false,    // auto-delete?
+		false,    // internal exchange
+		false,    // no wait?
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	// Declare dead-letter exchange
+	err = channel.ExchangeDeclare(
+		consumer.deadLetterExchangeName(),
+		"fanout", // Exchange type
+		true,     // durable?
+		false,    // auto-delete?
+		false,    // internal exchange
+		false,    // no wait?
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	// Declare dead-letter queue
+	deadLetterQueue, err := channel.QueueDeclare(
+		consumer.deadLetterExchangeName(),
+		true,  // durable?
+		false, // delete when unused?
+		false, // exclusive channel?
+		false, // no wait?
+		nil,   // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	// Bind dead-letter exchange to the dead-letter queue
+	err = channel.QueueBind(
+		deadLetterQueue.Name,
+		"",
+		consumer.deadLetterExchangeName(),
+		false, // no wait?
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Declare queue.
+	// Messages rejected without being requeued are routed to the dead-letter exchange.
+	queue, err := channel.QueueDeclare(
+		consumer.queueName,
+		true,  // durable?
+		false, // delete when unused?
+		false, // exclusive channel?
+		false, // no wait?
+		amqp.Table{
+			"x-dead-letter-exchange": consumer.deadLetterExchangeName(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Bind exchange to the queue
+	err = channel.QueueBind(
+		queue.Name,
+		consumer.routingKey,
+		consumer.exchangeName,
+		false, // no wait?
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// messageHandler is the function called by consumers to handle a message
+type messageHandler func(ctx context.Context, msg amqp.Delivery) error
+
+// consume receives messages from the consumer's queue and dispatches them to a pool of workers.
+// Messages with the same partition key always go to the same worker so that they are handled in order,
+// while messages with different keys are handled in parallel. The number of messages waiting
+// to be handled is bounded by the prefetch count of the channel.
+// It keeps listening for messages until its channel closes or the given context is canceled.
+// Messages are acknowledged once handleMessage succeeds. Failed messages are retried
+// with an exponential backoff and sent to the dead-letter exchange when they keep failing.
+// Once the context is canceled, it stops receiving messages and waits for the messages
+// being handled, giving up after consumerDrainTimeout.
+func (consumer *baseConsumer) consume(ctx context.Context, conn *amqp.Connection, handleMessage messageHandler) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	defer channel.Close()
+
+	// Limit the number of unacknowledged messages RabbitMQ delivers to us
+	err = channel.Qos(consumer.options.Prefetch, 0, false)
+	if err != nil {
+		return err
+	}
+
+	// We need a consumer tag to be able to cancel our subscription
+	consumerTag := consumer.consumerTag
+	if consumerTag == "" {
+		consumerTag = fmt.Sprintf("%s-%s", consumer.queueName, primitive.NewObjectID().Hex())
+	}
+
+	// Receive messages
+	messages, err := channel.Consume(
+		consumer.queueName,
+		consumerTag,
+		false, // auto-ack?
+		false, // exclusive?
+		false, // no local?
+		false, // no wait?
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Stop receiving messages once the context is canceled. This closes the messages channel.
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			err := channel.Cancel(consumerTag, false)
+			if err != nil {
+				consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+			}
+		case <-stopped:
+		}
+	}()
+
+	// Messages being handled are not bound to the consumer's context so that they can complete
+	// during a graceful shutdown. Their context is canceled if they do not complete in time.
+	handlersCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
+	// The messages channel is closed once our channel or our connection closes,
+	// or once we cancel our subscription
+	handlersDone := consumer.dispatch(messages, func(msg amqp.Delivery) {
+		consumer.handleDelivery(handlersCtx, channel, msg, handleMessage)
+	})
+
+	// Wait for the messages being handled
+	select {
+	case <-handlersDone:
+	case <-time.After(consumerDrainTimeout):
+		consumer.logger.Warning("Timed out waiting for messages being handled", map[string]string{"queue": consumer.queueName})
+		cancelHandlers()
+		<-handlersDone
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", consumer.queueName, errChannelClosed)
+}
+
+// dispatch hands the given messages to a pool of workers which call handle for each of them, until the messages
+// channel is closed. Messages with the same partition key always go to the same worker so that they are handled
+// in order. It returns a channel which is closed once the workers handled every message.
+func (consumer *baseConsumer) dispatch(messages <-chan amqp.Delivery, handle func(msg amqp.Delivery)) <-chan struct{} {
+	// Start workers. Their queues can hold every prefetched message so that a busy worker
+	// never blocks the dispatch of messages to the other workers.
+	var handlers sync.WaitGroup
+
+	workers := consumer.options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	workerQueues := make([]chan amqp.Delivery, workers)
+
+	for i := range workerQueues {
+		workerQueues[i] = make(chan amqp.Delivery, consumer.options.Prefetch)
+
+		handlers.Add(1)
+
+		go func(queue <-chan amqp.Delivery) {
+			defer handlers.Done()
+
+			for msg := range queue {
+				handle(msg)
+			}
+		}(workerQueues[i])
+	}
+
+	for msg := range messages {
+		workerQueues[consumer.workerIndex(msg, workers)] <- msg
+	}
+
+	// Stop workers once they handled the messages in their queue
+	for _, queue := range workerQueues {
+		close(queue)
+	}
+
+	handlersDone := make(chan struct{})
+
+	go func() {
+		handlers.Wait()
+		close(handlersDone)
+	}()
+
+	return handlersDone
+}
+
+// workerIndex returns the index of the worker which handles the given message
+func (consumer *baseConsumer) workerIndex(msg amqp.Delivery, workers int) int {
+	if consumer.partitionKey == nil || workers == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(consumer.partitionKey(msg)))
+
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// deadLetterPublisher is the interface used to publish messages to dead-letter exchanges,
+// which is implemented by *amqp.Channel
+type deadLetterPublisher interface {
+	Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error
+}
+
+// handleDelivery handles the given message, retrying it on failure, and acknowledges it
+// or sends it to the dead-letter exchange. Messages are requeued if the context is canceled
+// before they could be handled.
+func (consumer *baseConsumer) handleDelivery(ctx context.Context, channel deadLetterPublisher, msg amqp.Delivery, handleMessage messageHandler) {
+	var err error
+
+	attempt := 1
+	backoff := initialRetryBackoff
+
+	for ; ; attempt++ {
+		err = handleMessage(ctx, msg)
+		if err == nil {
+			err = msg.Ack(false)
+			if err != nil {
+				consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+			}
+
+			return
+		}
+
+		var permanentErr *permanentError
+
+		if errors.As(err, &permanentErr) || attempt == maxDeliveryAttempts {
+			break
+		}
+
+		consumer.logger.Warning("Failed to handle message, retrying", map[string]string{
+			"queue":   consumer.queueName,
+			"attempt": fmt.Sprint(attempt),
+			"error":   err.Error(),
+		})
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			// Give the message back to the broker so that it is handled again later
+			err = msg.Nack(false, true)
+			if err != nil {
+				consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+			}
+
+			return
+		}
+	}
+
+	consumer.logger.Error(err, map[string]string{
+		"queue":    consumer.queueName,
+		"attempts": fmt.Sprint(attempt),
+	})
+
+	consumer.deadLetter(channel, msg, err, attempt)
+}
+
+// deadLetter publishes the given message to the consumer's dead-letter exchange with the reason
+// of the failure in its headers and then acknowledges it
+func (consumer *baseConsumer) deadLetter(channel deadLetterPublisher, msg amqp.Delivery, reason error, attempts int) {
+	headers := amqp.Table{}
+
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+
+	headers["x-failure-reason"] = reason.Error()
+	headers["x-failure-attempts"] = int32(attempts)
+	headers["x-failed-at"] = time.Now().UTC()
+	headers["x-original-exchange"] = msg.Exchange
+	headers["x-original-queue"] = consumer.queueName
+
+	err := channel.Publish(
+		consumer.deadLetterExchangeName(),
+		"",    // routing key
+		false, // mandatory?
+		false, // immediate?
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			MessageId:     msg.MessageId,
+			Timestamp:     msg.Timestamp,
+			Type:          msg.Type,
+			Body:          msg.Body,
+		},
+	)
+	if err != nil {
+		consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+
+		// Rejecting the message still routes it to the dead-letter exchange, only without our headers
+		err = msg.Nack(false, false)
+		if err != nil {
+			consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+		}
+
+		return
+	}
+
+	err = msg.Ack(false)
+	if err != nil {
+		consumer.logger.Error(err, map[string]string{"queue": consumer.queueName})
+	}
+}
+
+// messageObjectID returns the message id of the given delivery as an ObjectID so that it can
+// be recorded by our inventory items. Message ids which are not ObjectIDs are hashed into one.
+func messageObjectID(msg amqp.Delivery) (primitive.ObjectID, error) {
+	if msg.MessageId == "" {
+		return primitive.NilObjectID, errors.New("message does not have a message id")
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(msg.MessageId)
+	if err == nil {
+		return objectID, nil
+	}
+
+	hash := sha256.Sum256([]byte(msg.MessageId))
+	copy(objectID[:], hash[:])
+
+	return objectID, nil
+}
@@ -0,0 +1,352 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/configuration"
+	"github.com/PlayEconomy37/Play.Common/events"
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testAcknowledger records the acknowledgements of the messages it is attached to
+type testAcknowledger struct {
+	acks     int
+	nacks    int
+	requeued bool
+}
+
+// Ack records that the message was acknowledged
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+// Nack records that the message was rejected
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	a.requeued = requeue
+	return nil
+}
+
+// Reject records that the message was rejected
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// testPublisher records the messages published to dead-letter exchanges
+type testPublisher struct {
+	exchanges   []string
+	publishings []amqp.Publishing
+}
+
+// Publish records the given message
+func (p *testPublisher) Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+	p.exchanges = append(p.exchanges, exchange)
+	p.publishings = append(p.publishings, msg)
+	return nil
+}
+
+// newTestConsumer returns a consumer which logs nothing and partitions JSON messages by their id
+func newTestConsumer(workers int) *baseConsumer {
+	return &baseConsumer{
+		queueName:    "test-queue",
+		options:      ConsumerOptions{Workers: workers, Prefetch: 100},
+		partitionKey: partitionByJSONField("id"),
+		logger:       logger.New(io.Discard, logger.LevelOff),
+	}
+}
+
+func TestHandleDelivery(t *testing.T) {
+	errTransient := errors.New("transient error")
+
+	tests := []struct {
+		testName          string
+		failures          int
+		err               error
+		wantedAttempts    int
+		wantedAcks        int
+		wantedDeadLetters int
+	}{
+		{"Handled message", 0, nil, 1, 1, 0},
+		{"Message handled after a transient error", 2, errTransient, 3, 1, 0},
+		{"Permanent error", 1, permanent(errTransient), 1, 1, 1},
+		{"Transient error until the attempts limit", maxDeliveryAttempts, errTransient, maxDeliveryAttempts, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			consumer := newTestConsumer(1)
+			acknowledger := &testAcknowledger{}
+			publisher := &testPublisher{}
+			attempts := 0
+
+			msg := amqp.Delivery{Acknowledger: acknowledger, Exchange: "test-exchange", Body: []byte(`{"id":1}`)}
+
+			consumer.handleDelivery(context.Background(), publisher, msg, func(ctx context.Context, msg amqp.Delivery) error {
+				attempts++
+
+				if attempts <= tt.failures {
+					return tt.err
+				}
+
+				return nil
+			})
+
+			if attempts != tt.wantedAttempts {
+				t.Errorf("want %d attempts, but got %d", tt.wantedAttempts, attempts)
+			}
+
+			if acknowledger.acks != tt.wantedAcks || acknowledger.nacks != 0 {
+				t.Errorf("want %d acks and no nacks, but got %d acks and %d nacks", tt.wantedAcks, acknowledger.acks, acknowledger.nacks)
+			}
+
+			if len(publisher.publishings) != tt.wantedDeadLetters {
+				t.Fatalf("want %d dead-lettered messages, but got %d", tt.wantedDeadLetters, len(publisher.publishings))
+			}
+
+			if tt.wantedDeadLetters == 0 {
+				return
+			}
+
+			if publisher.exchanges[0] != consumer.deadLetterExchangeName() {
+				t.Errorf("want message to be dead-lettered to %q, but got %q", consumer.deadLetterExchangeName(), publisher.exchanges[0])
+			}
+
+			headers := publisher.publishings[0].Headers
+
+			if headers["x-failure-attempts"] != int32(tt.wantedAttempts) {
+				t.Errorf("want x-failure-attempts header to be %d, but got %v", tt.wantedAttempts, headers["x-failure-attempts"])
+			}
+
+			if headers["x-failure-reason"] != errTransient.Error() {
+				t.Errorf("want x-failure-reason header to be %q, but got %v", errTransient.Error(), headers["x-failure-reason"])
+			}
+		})
+	}
+}
+
+func TestHandleDeliveryCanceled(t *testing.T) {
+	consumer := newTestConsumer(1)
+	acknowledger := &testAcknowledger{}
+	publisher := &testPublisher{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msg := amqp.Delivery{Acknowledger: acknowledger}
+
+	consumer.handleDelivery(ctx, publisher, msg, func(ctx context.Context, msg amqp.Delivery) error {
+		return errors.New("transient error")
+	})
+
+	if acknowledger.nacks != 1 || !acknowledger.requeued {
+		t.Errorf("want message to be requeued, but got %d nacks (requeued: %t)", acknowledger.nacks, acknowledger.requeued)
+	}
+
+	if len(publisher.publishings) != 0 {
+		t.Errorf("want no dead-lettered message, but got %d", len(publisher.publishings))
+	}
+}
+
+func TestPartitionByJSONField(t *testing.T) {
+	partitionKey := partitionByJSONField("userID")
+
+	tests := []struct {
+		testName  string
+		body      string
+		wantedKey string
+	}{
+		{"Number field", `{"userID":42,"quantity":1}`, "42"},
+		{"String field", `{"userID":"abc"}`, `"abc"`},
+		{"Missing field", `{"quantity":1}`, ""},
+		{"Malformed message", `not json`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			key := partitionKey(amqp.Delivery{Body: []byte(tt.body)})
+			if key != tt.wantedKey {
+				t.Errorf("want key %q, but got %q", tt.wantedKey, key)
+			}
+		})
+	}
+}
+
+func TestWorkerIndex(t *testing.T) {
+	consumer := newTestConsumer(4)
+
+	first := consumer.workerIndex(amqp.Delivery{Body: []byte(`{"id":7,"quantity":1}`)}, 4)
+	second := consumer.workerIndex(amqp.Delivery{Body: []byte(`{"quantity":2,"id":7}`)}, 4)
+
+	if first != second {
+		t.Errorf("want messages with the same key to go to the same worker, but got workers %d and %d", first, second)
+	}
+
+	for id := 0; id < 100; id++ {
+		index := consumer.workerIndex(amqp.Delivery{Body: []byte(fmt.Sprintf(`{"id":%d}`, id))}, 4)
+		if index < 0 || index >= 4 {
+			t.Fatalf("want worker index between 0 and 3, but got %d", index)
+		}
+	}
+
+	if index := newTestConsumer(1).workerIndex(amqp.Delivery{Body: []byte(`{"id":7}`)}, 1); index != 0 {
+		t.Errorf("want single worker to get every message, but got worker %d", index)
+	}
+}
+
+func TestDispatchOrdering(t *testing.T) {
+	consumer := newTestConsumer(4)
+
+	const keys = 10
+	const messagesPerKey = 50
+
+	messages := make(chan amqp.Delivery, keys*messagesPerKey)
+
+	for sequence := 0; sequence < messagesPerKey; sequence++ {
+		for key := 0; key < keys; key++ {
+			messages <- amqp.Delivery{Body: []byte(fmt.Sprintf(`{"id":%d,"sequence":%d}`, key, sequence))}
+		}
+	}
+
+	close(messages)
+
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	partitionKey := partitionByJSONField("id")
+	sequenceOf := partitionByJSONField("sequence")
+
+	done := consumer.dispatch(messages, func(msg amqp.Delivery) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := partitionKey(msg)
+		handled[key] = append(handled[key], sequenceOf(msg))
+	})
+
+	<-done
+
+	if len(handled) != keys {
+		t.Fatalf("want messages of %d keys to be handled, but got %d", keys, len(handled))
+	}
+
+	for key, sequences := range handled {
+		if len(sequences) != messagesPerKey {
+			t.Fatalf("want %d messages with key %s to be handled, but got %d", messagesPerKey, key, len(sequences))
+		}
+
+		for i, sequence := range sequences {
+			if sequence != fmt.Sprint(i) {
+				t.Fatalf("want messages with key %s to be handled in order, but got %v", key, sequences)
+			}
+		}
+	}
+}
+
+func TestConsumeDrainsOnCancel(t *testing.T) {
+	config, err := configuration.LoadConfig("../../config/dev.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := events.NewRabbitMQConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	consumer := newTestConsumer(1)
+	consumer.exchangeName = "test-drain"
+	consumer.queueName = fmt.Sprintf("test-drain-%s", primitive.NewObjectID().Hex())
+
+	err = consumer.CreateChannel(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		channel.QueueDelete(consumer.queueName, false, false, false)
+		channel.QueueDelete(consumer.deadLetterExchangeName(), false, false, false)
+		channel.ExchangeDelete(consumer.deadLetterExchangeName(), false, false)
+		channel.ExchangeDelete(consumer.exchangeName, false, false)
+		channel.Close()
+	}()
+
+	err = channel.PublishWithContext(context.Background(), consumer.exchangeName, "", false, false, amqp.Publishing{Body: []byte(`{"id":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handling := make(chan struct{})
+	returned := make(chan error, 1)
+
+	var handled atomic.Bool
+
+	go func() {
+		returned <- consumer.consume(ctx, conn, func(handlerCtx context.Context, msg amqp.Delivery) error {
+			close(handling)
+
+			// Keep handling the message after the consumer is stopped
+			<-ctx.Done()
+			time.Sleep(200 * time.Millisecond)
+
+			if handlerCtx.Err() != nil {
+				return handlerCtx.Err()
+			}
+
+			handled.Store(true)
+
+			return nil
+		})
+	}()
+
+	select {
+	case <-handling:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for message to be handled")
+	}
+
+	cancel()
+
+	select {
+	case err = <-returned:
+	case <-time.After(consumerDrainTimeout + 5*time.Second):
+		t.Fatal("timed out waiting for consumer to stop")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !handled.Load() {
+		t.Fatal("want message being handled to complete before consumer stops")
+	}
+
+	// Our channel is closed once the consumer stops, so the message would be back in the queue if it was not acknowledged
+	queue, err := channel.QueueInspect(consumer.queueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queue.Messages != 0 {
+		t.Errorf("want message to be acknowledged, but got %d messages in queue", queue.Messages)
+	}
+}
@@ -0,0 +1,201 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// errUnknownReferences is returned when a grant items command references a user or a catalog item we do not know yet
+var errUnknownReferences = errors.New("grant items command references unknown records")
+
+// GrantItemsConsumer is the consumer for grant items command.
+// It replies with an InventoryItemsGrantedEvent once the items are granted, or with an
+// InventoryItemsGrantRejectedEvent when they cannot be granted.
+type GrantItemsConsumer struct {
+	baseConsumer
+	inventoryItemsRepository    *data.InventoryItemsRepository
+	processedMessagesRepository *data.ProcessedMessagesRepository
+	usersRepository             *data.UsersRepository
+	catalogItemsRepository      *data.CatalogItemsRepository
+	grantedPublisher            eventPublisher
+	rejectedPublisher           eventPublisher
+}
+
+// NewGrantItemsConsumer returns a new GrantItemsConsumer
+func NewGrantItemsConsumer(
+	inventoryItemsRepository *data.InventoryItemsRepository,
+	processedMessagesRepository *data.ProcessedMessagesRepository,
+	usersRepository *data.UsersRepository,
+	catalogItemsRepository *data.CatalogItemsRepository,
+	serviceName string,
+	options ConsumerOptions,
+	logger *logger.Logger,
+) *GrantItemsConsumer {
+	consumer := GrantItemsConsumer{
+		baseConsumer: baseConsumer{
+			exchangeName: "Play.Inventory:grant-items",
+			routingKey:   "",
+			consumerTag:  "",
+			queueName:    fmt.Sprintf("%s-grant-items", serviceName),
+			options:      options,
+			partitionKey: partitionByJSONField("userID"),
+			logger:       logger,
+		},
+		inventoryItemsRepository:    inventoryItemsRepository,
+		processedMessagesRepository: processedMessagesRepository,
+		usersRepository:             usersRepository,
+		catalogItemsRepository:      catalogItemsRepository,
+		grantedPublisher:            NewPublisher("Play.Inventory:inventory-items-granted"),
+		rejectedPublisher:           NewPublisher("Play.Inventory:inventory-items-grant-rejected"),
+	}
+
+	return &consumer
+}
+
+// CreateChannel declares the topology of the consumer and opens the channels used to reply
+// once items are granted or rejected
+func (consumer *GrantItemsConsumer) CreateChannel(conn *amqp.Connection) error {
+	err := consumer.grantedPublisher.CreateChannel(conn)
+	if err != nil {
+		return err
+	}
+
+	err = consumer.rejectedPublisher.CreateChannel(conn)
+	if err != nil {
+		return err
+	}
+
+	return consumer.baseConsumer.CreateChannel(conn)
+}
+
+// StartConsumer starts up consumer and keeps it listening for messages
+func (consumer *GrantItemsConsumer) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	return consumer.consume(ctx, conn, func(ctx context.Context, msg amqp.Delivery) error {
+		var command events.GrantItemsCommand
+
+		err := json.Unmarshal(msg.Body, &command)
+		if err != nil {
+			return permanent(err)
+		}
+
+		messageID, err := messageObjectID(msg)
+		if err != nil {
+			return permanent(err)
+		}
+
+		// Messages delivered late or again are validated as of when the command was sent
+		sentAt := msg.Timestamp
+		if sentAt.IsZero() {
+			sentAt = time.Now()
+		}
+
+		return consumer.handleCommand(ctx, command, messageID, sentAt)
+	})
+}
+
+// handleCommand grants the items of the given command and replies to its sender.
+// Commands which cannot be applied are rejected and acknowledged, while invalid commands
+// are rejected and sent to the dead-letter exchange. Commands referencing a user or a catalog item
+// we do not know yet are retried, and sent to the dead-letter exchange if they never appear.
+func (consumer *GrantItemsConsumer) handleCommand(ctx context.Context, command events.GrantItemsCommand, messageID primitive.ObjectID, sentAt time.Time) error {
+	properties := map[string]string{
+		"correlationID": command.CorrelationID.Hex(),
+		"messageID":     messageID.Hex(),
+	}
+
+	// Perform validation checks
+	v := validator.New()
+
+	item := data.InventoryItem{UserID: command.UserID, CatalogItemID: command.CatalogItemID, Quantity: command.Quantity}
+
+	data.ValidateInventoryItem(v, item)
+	data.ValidateExpiry(v, command.ExpiresAt, sentAt)
+
+	if v.HasErrors() {
+		err := fmt.Errorf("invalid grant items command: %v", v.Errors)
+
+		rejectErr := consumer.reject(ctx, command, messageID, err)
+		if rejectErr != nil {
+			return rejectErr
+		}
+
+		return permanent(err)
+	}
+
+	// Check that the user and the catalog item exist. Our copies of users and catalog items are
+	// updated by events, so a missing one may not have arrived yet and the command is not rejected.
+	refs := validator.New()
+
+	err := data.NewGrantReferences(consumer.usersRepository, consumer.catalogItemsRepository).Check(ctx, refs, item)
+	if err != nil {
+		return err
+	}
+
+	if refs.HasErrors() {
+		return fmt.Errorf("%w: %v", errUnknownReferences, refs.Errors)
+	}
+
+	// Increment the quantity of the inventory item and record the message id so that
+	// the command is not applied twice if the message is delivered again
+	_, _, err = consumer.inventoryItemsRepository.Grant(ctx, command.UserID, command.CatalogItemID, command.Quantity, command.ExpiresAt, data.MessageSource(messageID), nil, false)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMessageAlreadyProcessed):
+			// We still reply since we might have failed to do so the first time
+			consumer.logger.Info("Ignoring grant items command which was already processed", properties)
+
+			return consumer.replyProcessed(ctx, command, messageID)
+		case errors.Is(err, data.ErrStackLimitReached), errors.Is(err, data.ErrInventoryFull):
+			// Delivering the message again must not change the outcome we replied with
+			consumer.logger.Info("Rejecting grant items command which exceeds inventory limits", properties)
+
+			return consumer.reject(ctx, command, messageID, err)
+		default:
+			return err
+		}
+	}
+
+	return consumer.grantedPublisher.Publish(ctx, events.InventoryItemsGrantedEvent{CorrelationID: command.CorrelationID})
+}
+
+// reject records that the message of the given command was rejected for the given reason
+// so that it is not applied if it is delivered again, and replies to its sender
+func (consumer *GrantItemsConsumer) reject(ctx context.Context, command events.GrantItemsCommand, messageID primitive.ObjectID, reason error) error {
+	err := consumer.processedMessagesRepository.Reject(ctx, messageID, reason.Error())
+	if errors.Is(err, data.ErrMessageAlreadyProcessed) {
+		return consumer.replyProcessed(ctx, command, messageID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return consumer.rejectedPublisher.Publish(ctx, events.InventoryItemsGrantRejectedEvent{CorrelationID: command.CorrelationID, Reason: reason.Error()})
+}
+
+// replyProcessed replies to the sender of the given command, whose message was already processed,
+// with the outcome of its first delivery
+func (consumer *GrantItemsConsumer) replyProcessed(ctx context.Context, command events.GrantItemsCommand, messageID primitive.ObjectID) error {
+	message, err := consumer.processedMessagesRepository.GetByMessageID(ctx, messageID)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		return err
+	}
+
+	if message.Rejection != "" {
+		return consumer.rejectedPublisher.Publish(ctx, events.InventoryItemsGrantRejectedEvent{CorrelationID: command.CorrelationID, Reason: message.Rejection})
+	}
+
+	return consumer.grantedPublisher.Publish(ctx, events.InventoryItemsGrantedEvent{CorrelationID: command.CorrelationID})
+}
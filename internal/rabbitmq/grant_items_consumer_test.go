@@ -0,0 +1,137 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestGrantItemsConsumerHandleCommand(t *testing.T) {
+	mongoClient := newTestDatabase(t)
+	inventoryItemsRepository := data.NewInventoryItemsRepository(mongoClient, testDatabase, 0)
+	processedMessagesRepository := data.NewProcessedMessagesRepository(mongoClient, testDatabase)
+	catalogItemsRepository := data.NewCatalogItemsRepository(mongoClient, testDatabase)
+	usersRepository := data.NewUsersRepository(mongoClient, testDatabase)
+
+	consumer := NewGrantItemsConsumer(inventoryItemsRepository, processedMessagesRepository, usersRepository, catalogItemsRepository, "test", ConsumerOptions{}, newTestConsumer(1).logger)
+	grantedPublisher := &testEventPublisher{}
+	rejectedPublisher := &testEventPublisher{}
+	consumer.grantedPublisher = grantedPublisher
+	consumer.rejectedPublisher = rejectedPublisher
+
+	ctx := context.Background()
+	catalogItemID := primitive.NewObjectID()
+	grantMessageID := primitive.NewObjectID()
+	rejectedMessageID := primitive.NewObjectID()
+
+	_, err := usersRepository.Upsert(ctx, database.User{ID: 1, Permissions: []string{}, Activated: true, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Users can own at most 3 Potions
+	_, err = catalogItemsRepository.Upsert(ctx, data.CatalogItem{ID: catalogItemID, Name: "Potion", Description: "Restores a small amount of health", MaxStack: 3, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName        string
+		messageID       primitive.ObjectID
+		userID          int64
+		catalogItemID   primitive.ObjectID
+		quantity        int64
+		subtractBefore  int64
+		wantedPermanent bool
+		wantedRetried   bool
+		wantedGranted   bool
+		wantedRejected  bool
+		wantedQuantity  int64
+	}{
+		{"Grant", grantMessageID, 1, catalogItemID, 2, 0, false, false, true, false, 2},
+		{"Message delivered again", grantMessageID, 1, catalogItemID, 2, 0, false, false, true, false, 2},
+		{"Stack limit reached", rejectedMessageID, 1, catalogItemID, 2, 0, false, false, false, true, 2},
+		{"Rejected message delivered again once it fits", rejectedMessageID, 1, catalogItemID, 2, 2, false, false, false, true, 0},
+		{"Invalid command", primitive.NewObjectID(), 1, catalogItemID, 0, 0, true, false, false, true, 0},
+		{"Unknown user", primitive.NewObjectID(), 2, catalogItemID, 1, 0, false, true, false, false, 0},
+		{"Unknown catalog item", primitive.NewObjectID(), 1, primitive.NewObjectID(), 1, 0, false, true, false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			if tt.subtractBefore != 0 {
+				_, err := inventoryItemsRepository.Subtract(ctx, 1, catalogItemID, tt.subtractBefore, data.HTTPSource(1), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			grantedBefore := len(grantedPublisher.events)
+			rejectedBefore := len(rejectedPublisher.events)
+			correlationID := primitive.NewObjectID()
+
+			command := events.GrantItemsCommand{UserID: tt.userID, CatalogItemID: tt.catalogItemID, Quantity: tt.quantity, CorrelationID: correlationID}
+
+			err := consumer.handleCommand(ctx, command, tt.messageID, time.Now())
+
+			var permanentErr *permanentError
+
+			switch {
+			case tt.wantedPermanent && !errors.As(err, &permanentErr):
+				t.Fatalf("want permanent error, but got %v", err)
+			case tt.wantedRetried && (!errors.Is(err, errUnknownReferences) || errors.As(err, &permanentErr)):
+				t.Fatalf("want error retrying the command, but got %v", err)
+			case !tt.wantedPermanent && !tt.wantedRetried && err != nil:
+				t.Fatal(err)
+			}
+
+			// Retried commands are not recorded, so that they are applied once their references arrive
+			if tt.wantedRetried {
+				_, err = processedMessagesRepository.GetByMessageID(ctx, tt.messageID)
+				if !errors.Is(err, database.ErrRecordNotFound) {
+					t.Errorf("want retried message not to be recorded, but got error %v", err)
+				}
+			}
+
+			if granted := len(grantedPublisher.events) > grantedBefore; granted != tt.wantedGranted {
+				t.Errorf("want granted reply to be published to be %t, but got %t", tt.wantedGranted, granted)
+			}
+
+			rejected := len(rejectedPublisher.events) > rejectedBefore
+			if rejected != tt.wantedRejected {
+				t.Errorf("want rejected reply to be published to be %t, but got %t", tt.wantedRejected, rejected)
+			}
+
+			if rejected {
+				event := rejectedPublisher.events[len(rejectedPublisher.events)-1].(events.InventoryItemsGrantRejectedEvent)
+				if event.CorrelationID != correlationID || event.Reason == "" {
+					t.Errorf("want rejected reply with correlation id %s and a reason, but got %+v", correlationID.Hex(), event)
+				}
+			}
+
+			// No inventory item is created for unknown users or catalog items
+			orphanFilter := bson.M{"$or": bson.A{bson.M{"user_id": bson.M{"$ne": 1}}, bson.M{"catalog_item_id": bson.M{"$ne": catalogItemID}}}}
+
+			_, err = inventoryItemsRepository.GetByFilter(ctx, orphanFilter)
+			if !errors.Is(err, database.ErrRecordNotFound) {
+				t.Errorf("want no orphan inventory item, but got error %v", err)
+			}
+
+			item, err := inventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": catalogItemID})
+			if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+				t.Fatal(err)
+			}
+
+			if item.Quantity != tt.wantedQuantity {
+				t.Errorf("want quantity to be %d, but got %d", tt.wantedQuantity, item.Quantity)
+			}
+		})
+	}
+}
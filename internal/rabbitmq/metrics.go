@@ -0,0 +1,17 @@
+package rabbitmq
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// staleEventsTotal counts the events dropped by our consumers because we already applied
+// the same or a newer version of the entity they describe
+var staleEventsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "inventory",
+		Name:      "stale_events_total",
+		Help:      "Number of events dropped because a newer version was already applied",
+	},
+	[]string{"queue"},
+)
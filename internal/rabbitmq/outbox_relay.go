@@ -0,0 +1,190 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// outboxPollInterval is the time the outbox relay waits before looking for new outbox messages
+	// once it published all of them
+	outboxPollInterval = time.Second
+
+	// outboxBatchSize is the maximum number of outbox messages the relay reads at once
+	outboxBatchSize = 100
+)
+
+// errPublishNotConfirmed is returned when RabbitMQ does not confirm that it received a message
+var errPublishNotConfirmed = errors.New("publish not confirmed")
+
+// OutboxRelay publishes the messages written to our outbox to their fanout exchange.
+// Messages are only marked as published once RabbitMQ confirms it received them, so every
+// message is published at least once, even across restarts.
+// Messages are not guaranteed to be published in the order their changes were committed:
+// ids are assigned before the transaction commits, and every instance of our service runs its own relay,
+// so a message can also be published twice. Consumers must not depend on the order of our events.
+// It implements the Consumer interface so that it is managed by our supervisor.
+type OutboxRelay struct {
+	outboxMessagesRepository *data.OutboxMessagesRepository
+	exchangeNames            map[string]string
+	logger                   *logger.Logger
+}
+
+// NewOutboxRelay returns a new OutboxRelay
+func NewOutboxRelay(outboxMessagesRepository *data.OutboxMessagesRepository, logger *logger.Logger) *OutboxRelay {
+	relay := OutboxRelay{
+		outboxMessagesRepository: outboxMessagesRepository,
+		exchangeNames: map[string]string{
+			events.InventoryItemUpdatedEventType:  "Play.Inventory:inventory-item-updated",
+			events.InventoryItemsExpiredEventType: "Play.Inventory:inventory-items-expired",
+		},
+		logger: logger,
+	}
+
+	return &relay
+}
+
+// CreateChannel declares the exchanges of the outbox messages using the given connection
+func (relay *OutboxRelay) CreateChannel(conn *amqp.Connection) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	defer channel.Close()
+
+	for _, exchangeName := range relay.exchangeNames {
+		// Declare exchange
+		err = channel.ExchangeDeclare(
+			exchangeName,
+			"fanout", // Exchange type
+			true,     // durable?
+			false,    // auto-delete?
+			false,    // internal exchange
+			false,    // no wait?
+			nil,      // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartConsumer publishes outbox messages using the given connection until its channel closes
+// or the given context is canceled
+func (relay *OutboxRelay) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	defer channel.Close()
+
+	// Ask RabbitMQ to confirm every message it receives
+	err = channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		published, err := relay.publishBatch(ctx, func(ctx context.Context, message data.OutboxMessage) error {
+			return relay.publish(ctx, channel, message)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if channel.IsClosed() {
+				return fmt.Errorf("outbox relay: %w", errChannelClosed)
+			}
+
+			relay.logger.Error(err, nil)
+		}
+
+		// Keep going right away if there might be more messages waiting
+		if err == nil && published == outboxBatchSize {
+			continue
+		}
+
+		select {
+		case <-time.After(outboxPollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publishFunc publishes the given outbox message and returns once RabbitMQ confirmed it received it
+type publishFunc func(ctx context.Context, message data.OutboxMessage) error
+
+// publishBatch publishes the outbox messages which were not published yet with the given function, by ascending id,
+// one at a time. Messages are marked as published once publish succeeds,
+// and it stops at the first message which could not be published. It returns the number of messages it published.
+func (relay *OutboxRelay) publishBatch(ctx context.Context, publish publishFunc) (int, error) {
+	messages, err := relay.outboxMessagesRepository.GetUnpublished(ctx, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, message := range messages {
+		err = publish(ctx, message)
+		if err != nil {
+			return i, err
+		}
+
+		// If we fail to record that the message was published, it is published again later
+		err = relay.outboxMessagesRepository.MarkPublished(ctx, message.ID)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// publish publishes the given outbox message to the exchange of its type
+// and waits for RabbitMQ to confirm it received it
+func (relay *OutboxRelay) publish(ctx context.Context, channel *amqp.Channel, message data.OutboxMessage) error {
+	exchangeName, ok := relay.exchangeNames[message.Type]
+	if !ok {
+		return fmt.Errorf("unknown outbox message type %q", message.Type)
+	}
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchangeName,
+		"",    // routing key
+		false, // mandatory?
+		false, // immediate?
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    message.ID.Hex(),
+			Timestamp:    message.CreatedAt,
+			Type:         message.Type,
+			Body:         message.Payload,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Wait returns false if RabbitMQ rejects the message, if the channel closes
+	// or if the context is canceled
+	if !confirmation.Wait() {
+		return fmt.Errorf("outbox message %s: %w", message.ID.Hex(), errPublishNotConfirmed)
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// getUnpublished returns the outbox messages which were not published yet, by ascending id
+func getUnpublished(t *testing.T, repository *data.OutboxMessagesRepository) []data.OutboxMessage {
+	messages, err := repository.GetUnpublished(context.Background(), outboxBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return messages
+}
+
+func TestOutboxMessagesTransactions(t *testing.T) {
+	mongoClient := newTestDatabase(t)
+	inventoryItemsRepository := data.NewInventoryItemsRepository(mongoClient, testDatabase, 0)
+	outboxMessagesRepository := data.NewOutboxMessagesRepository(mongoClient, testDatabase)
+	catalogItemsRepository := data.NewCatalogItemsRepository(mongoClient, testDatabase)
+
+	ctx := context.Background()
+	catalogItemID := primitive.NewObjectID()
+	messageID := primitive.NewObjectID()
+
+	// Users can own at most 3 Potions
+	_, err := catalogItemsRepository.Upsert(ctx, data.CatalogItem{ID: catalogItemID, Name: "Potion", Description: "Restores a small amount of health", MaxStack: 3, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grant := func(userID int64, quantity int64, source data.Source) error {
+		_, _, err := inventoryItemsRepository.Grant(ctx, userID, catalogItemID, quantity, time.Time{}, source, nil, false)
+		return err
+	}
+
+	subtract := func(userID int64, quantity int64) error {
+		_, err := inventoryItemsRepository.Subtract(ctx, userID, catalogItemID, quantity, data.HTTPSource(userID), nil)
+		return err
+	}
+
+	transfer := func(fromUserID int64, toUserID int64, quantity int64) error {
+		return inventoryItemsRepository.Transfer(ctx, &data.Transfer{FromUserID: fromUserID, ToUserID: toUserID, CatalogItemID: catalogItemID, Quantity: quantity, InitiatedBy: fromUserID}, nil)
+	}
+
+	tests := []struct {
+		testName          string
+		apply             func() error
+		wantedErr         error
+		wantedNewMessages int
+		wantedQuantities  map[int64]int64
+	}{
+		{"Grant", func() error { return grant(1, 2, data.HTTPSource(1)) }, nil, 1, map[int64]int64{1: 2}},
+		{"Grant from a message", func() error { return grant(2, 3, data.MessageSource(messageID)) }, nil, 1, map[int64]int64{2: 3}},
+		{"Message delivered again", func() error { return grant(2, 3, data.MessageSource(messageID)) }, data.ErrMessageAlreadyProcessed, 0, map[int64]int64{2: 3}},
+		{"Subtract", func() error { return subtract(1, 1) }, nil, 1, map[int64]int64{1: 1}},
+		{"Subtract more than owned", func() error { return subtract(1, 2) }, data.ErrInsufficientQuantity, 0, map[int64]int64{1: 1}},
+		{"Transfer rolled back after subtracting items", func() error { return transfer(1, 2, 1) }, data.ErrStackLimitReached, 0, map[int64]int64{1: 1, 2: 3}},
+		{"Transfer", func() error { return transfer(2, 1, 2) }, nil, 2, map[int64]int64{1: 3, 2: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			before := getUnpublished(t, outboxMessagesRepository)
+
+			err := tt.apply()
+			if !errors.Is(err, tt.wantedErr) {
+				t.Fatalf("want error %v, but got %v", tt.wantedErr, err)
+			}
+
+			after := getUnpublished(t, outboxMessagesRepository)
+
+			if len(after)-len(before) != tt.wantedNewMessages {
+				t.Fatalf("want %d new outbox messages, but got %d", tt.wantedNewMessages, len(after)-len(before))
+			}
+
+			// Every new message describes the quantity of an inventory item after the change
+			for _, message := range after[len(before):] {
+				if message.Type != events.InventoryItemUpdatedEventType {
+					t.Errorf("want outbox message of type %q, but got %q", events.InventoryItemUpdatedEventType, message.Type)
+				}
+			}
+
+			for userID, wantedQuantity := range tt.wantedQuantities {
+				item, err := inventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": userID, "catalog_item_id": catalogItemID})
+				if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+					t.Fatal(err)
+				}
+
+				if item.Quantity != wantedQuantity {
+					t.Errorf("want quantity of user %d to be %d, but got %d", userID, wantedQuantity, item.Quantity)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxRelayPublishBatch(t *testing.T) {
+	mongoClient := newTestDatabase(t)
+	inventoryItemsRepository := data.NewInventoryItemsRepository(mongoClient, testDatabase, 0)
+	outboxMessagesRepository := data.NewOutboxMessagesRepository(mongoClient, testDatabase)
+	relay := NewOutboxRelay(outboxMessagesRepository, newTestConsumer(1).logger)
+
+	ctx := context.Background()
+
+	for userID := int64(1); userID <= 2; userID++ {
+		_, _, err := inventoryItemsRepository.Grant(ctx, userID, primitive.NewObjectID(), 1, time.Time{}, data.HTTPSource(userID), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := getUnpublished(t, outboxMessagesRepository)
+	if len(messages) != 2 {
+		t.Fatalf("want 2 outbox messages, but got %d", len(messages))
+	}
+
+	tests := []struct {
+		testName          string
+		confirmed         int
+		wantedPublished   int
+		wantedErr         error
+		wantedAttempted   []primitive.ObjectID
+		wantedUnpublished []primitive.ObjectID
+	}{
+		{"No confirm", 0, 0, errPublishNotConfirmed, []primitive.ObjectID{messages[0].ID}, []primitive.ObjectID{messages[0].ID, messages[1].ID}},
+		{"First message confirmed", 1, 1, errPublishNotConfirmed, []primitive.ObjectID{messages[0].ID, messages[1].ID}, []primitive.ObjectID{messages[1].ID}},
+		{"Every message confirmed", 2, 1, nil, []primitive.ObjectID{messages[1].ID}, []primitive.ObjectID{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			attempted := []primitive.ObjectID{}
+
+			// Fail like relay.publish does when RabbitMQ does not confirm a message
+			published, err := relay.publishBatch(ctx, func(ctx context.Context, message data.OutboxMessage) error {
+				attempted = append(attempted, message.ID)
+
+				if len(attempted) > tt.confirmed {
+					return errPublishNotConfirmed
+				}
+
+				return nil
+			})
+			if !errors.Is(err, tt.wantedErr) {
+				t.Fatalf("want error %v, but got %v", tt.wantedErr, err)
+			}
+
+			if published != tt.wantedPublished {
+				t.Errorf("want %d published messages, but got %d", tt.wantedPublished, published)
+			}
+
+			if !equalIDs(attempted, tt.wantedAttempted) {
+				t.Errorf("want messages %v to be published in order, but got %v", tt.wantedAttempted, attempted)
+			}
+
+			unpublished := []primitive.ObjectID{}
+
+			for _, message := range getUnpublished(t, outboxMessagesRepository) {
+				unpublished = append(unpublished, message.ID)
+			}
+
+			if !equalIDs(unpublished, tt.wantedUnpublished) {
+				t.Errorf("want messages %v to be left unpublished, but got %v", tt.wantedUnpublished, unpublished)
+			}
+		})
+	}
+}
+
+// equalIDs returns whether the given slices hold the same ids in the same order
+func equalIDs(a []primitive.ObjectID, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
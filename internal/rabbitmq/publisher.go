@@ -0,0 +1,111 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// errNotConnected is returned when trying to publish a message while disconnected from RabbitMQ
+var errNotConnected = errors.New("not connected to RabbitMQ")
+
+// eventPublisher is the interface used by consumers to publish their replies, which is implemented by *Publisher
+type eventPublisher interface {
+	CreateChannel(conn *amqp.Connection) error
+	Publish(ctx context.Context, event any) error
+}
+
+// Publisher publishes events to a fanout exchange
+type Publisher struct {
+	exchangeName string
+	conn         *amqp.Connection
+	channel      *amqp.Channel
+	mutex        sync.Mutex
+}
+
+// NewPublisher returns a new Publisher for the given exchange
+func NewPublisher(exchangeName string) *Publisher {
+	return &Publisher{
+		exchangeName: exchangeName,
+	}
+}
+
+// CreateChannel opens the channel used by the publisher on the given connection and declares its exchange
+func (publisher *Publisher) CreateChannel(conn *amqp.Connection) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	publisher.conn = conn
+
+	return publisher.openChannel()
+}
+
+// openChannel opens a channel on the publisher's connection and declares its exchange.
+// It must be called while holding the publisher's mutex.
+func (publisher *Publisher) openChannel() error {
+	channel, err := publisher.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	// Declare exchange
+	err = channel.ExchangeDeclare(
+		publisher.exchangeName,
+		"fanout", // Exchange type
+		true,     // durable?
+		false,    // auto-delete?
+		false,    // internal exchange
+		false,    // no wait?
+		nil,      // arguments
+	)
+	if err != nil {
+		channel.Close()
+		return err
+	}
+
+	publisher.channel = channel
+
+	return nil
+}
+
+// Publish encodes the given event to JSON and publishes it to the publisher's exchange
+func (publisher *Publisher) Publish(ctx context.Context, event any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// AMQP channels must not be used to publish from several goroutines at once
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	if publisher.conn == nil || publisher.conn.IsClosed() {
+		return errNotConnected
+	}
+
+	// Reopen the channel if the broker closed it (i.e. after a channel error)
+	if publisher.channel.IsClosed() {
+		err = publisher.openChannel()
+		if err != nil {
+			return err
+		}
+	}
+
+	return publisher.channel.PublishWithContext(
+		ctx,
+		publisher.exchangeName,
+		"",    // routing key
+		false, // mandatory?
+		false, // immediate?
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now().UTC(),
+			Body:         body,
+		},
+	)
+}
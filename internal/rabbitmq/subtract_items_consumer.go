@@ -0,0 +1,168 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Common/logger"
+	"github.com/PlayEconomy37/Play.Common/validator"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubtractItemsConsumer is the consumer for subtract items command.
+// It replies with an InventoryItemsSubtractedEvent once the items are subtracted, or with an
+// InventoryItemsSubtractRejectedEvent when they cannot be subtracted.
+type SubtractItemsConsumer struct {
+	baseConsumer
+	inventoryItemsRepository    *data.InventoryItemsRepository
+	processedMessagesRepository *data.ProcessedMessagesRepository
+	subtractedPublisher         eventPublisher
+	rejectedPublisher           eventPublisher
+}
+
+// NewSubtractItemsConsumer returns a new SubtractItemsConsumer
+func NewSubtractItemsConsumer(
+	inventoryItemsRepository *data.InventoryItemsRepository,
+	processedMessagesRepository *data.ProcessedMessagesRepository,
+	serviceName string,
+	options ConsumerOptions,
+	logger *logger.Logger,
+) *SubtractItemsConsumer {
+	consumer := SubtractItemsConsumer{
+		baseConsumer: baseConsumer{
+			exchangeName: "Play.Inventory:subtract-items",
+			routingKey:   "",
+			consumerTag:  "",
+			queueName:    fmt.Sprintf("%s-subtract-items", serviceName),
+			options:      options,
+			partitionKey: partitionByJSONField("userID"),
+			logger:       logger,
+		},
+		inventoryItemsRepository:    inventoryItemsRepository,
+		processedMessagesRepository: processedMessagesRepository,
+		subtractedPublisher:         NewPublisher("Play.Inventory:inventory-items-subtracted"),
+		rejectedPublisher:           NewPublisher("Play.Inventory:inventory-items-subtract-rejected"),
+	}
+
+	return &consumer
+}
+
+// CreateChannel declares the topology of the consumer and opens the channels used to reply
+// once items are subtracted or rejected
+func (consumer *SubtractItemsConsumer) CreateChannel(conn *amqp.Connection) error {
+	err := consumer.subtractedPublisher.CreateChannel(conn)
+	if err != nil {
+		return err
+	}
+
+	err = consumer.rejectedPublisher.CreateChannel(conn)
+	if err != nil {
+		return err
+	}
+
+	return consumer.baseConsumer.CreateChannel(conn)
+}
+
+// StartConsumer starts up consumer and keeps it listening for messages
+func (consumer *SubtractItemsConsumer) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	return consumer.consume(ctx, conn, func(ctx context.Context, msg amqp.Delivery) error {
+		var command events.SubtractItemsCommand
+
+		err := json.Unmarshal(msg.Body, &command)
+		if err != nil {
+			return permanent(err)
+		}
+
+		messageID, err := messageObjectID(msg)
+		if err != nil {
+			return permanent(err)
+		}
+
+		return consumer.handleCommand(ctx, command, messageID)
+	})
+}
+
+// handleCommand subtracts the items of the given command and replies to its sender.
+// Commands which cannot be applied are rejected and acknowledged, while invalid commands
+// are rejected and sent to the dead-letter exchange.
+func (consumer *SubtractItemsConsumer) handleCommand(ctx context.Context, command events.SubtractItemsCommand, messageID primitive.ObjectID) error {
+	properties := map[string]string{
+		"correlationID": command.CorrelationID.Hex(),
+		"messageID":     messageID.Hex(),
+	}
+
+	// Perform validation checks
+	v := validator.New()
+
+	data.ValidateInventoryItem(v, data.InventoryItem{UserID: command.UserID, CatalogItemID: command.CatalogItemID, Quantity: command.Quantity})
+
+	if v.HasErrors() {
+		err := fmt.Errorf("invalid subtract items command: %v", v.Errors)
+
+		rejectErr := consumer.reject(ctx, command, messageID, err)
+		if rejectErr != nil {
+			return rejectErr
+		}
+
+		return permanent(err)
+	}
+
+	// Decrement the quantity of the inventory item and record the message id so that
+	// the command is not applied twice if the message is delivered again
+	_, err := consumer.inventoryItemsRepository.Subtract(ctx, command.UserID, command.CatalogItemID, command.Quantity, data.MessageSource(messageID), nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMessageAlreadyProcessed):
+			// We still reply since we might have failed to do so the first time
+			consumer.logger.Info("Ignoring subtract items command which was already processed", properties)
+
+			return consumer.replyProcessed(ctx, command, messageID)
+		case errors.Is(err, data.ErrInsufficientQuantity):
+			// Delivering the message again must not change the outcome we replied with
+			consumer.logger.Info("Rejecting subtract items command since the user does not own enough items", properties)
+
+			return consumer.reject(ctx, command, messageID, err)
+		default:
+			return err
+		}
+	}
+
+	return consumer.subtractedPublisher.Publish(ctx, events.InventoryItemsSubtractedEvent{CorrelationID: command.CorrelationID})
+}
+
+// reject records that the message of the given command was rejected for the given reason
+// so that it is not applied if it is delivered again, and replies to its sender
+func (consumer *SubtractItemsConsumer) reject(ctx context.Context, command events.SubtractItemsCommand, messageID primitive.ObjectID, reason error) error {
+	err := consumer.processedMessagesRepository.Reject(ctx, messageID, reason.Error())
+	if errors.Is(err, data.ErrMessageAlreadyProcessed) {
+		return consumer.replyProcessed(ctx, command, messageID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return consumer.rejectedPublisher.Publish(ctx, events.InventoryItemsSubtractRejectedEvent{CorrelationID: command.CorrelationID, Reason: reason.Error()})
+}
+
+// replyProcessed replies to the sender of the given command, whose message was already processed,
+// with the outcome of its first delivery
+func (consumer *SubtractItemsConsumer) replyProcessed(ctx context.Context, command events.SubtractItemsCommand, messageID primitive.ObjectID) error {
+	message, err := consumer.processedMessagesRepository.GetByMessageID(ctx, messageID)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		return err
+	}
+
+	if message.Rejection != "" {
+		return consumer.rejectedPublisher.Publish(ctx, events.InventoryItemsSubtractRejectedEvent{CorrelationID: command.CorrelationID, Reason: message.Rejection})
+	}
+
+	return consumer.subtractedPublisher.Publish(ctx, events.InventoryItemsSubtractedEvent{CorrelationID: command.CorrelationID})
+}
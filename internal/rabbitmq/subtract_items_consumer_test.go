@@ -0,0 +1,106 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"github.com/PlayEconomy37/Play.Inventory/internal/events"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSubtractItemsConsumerHandleCommand(t *testing.T) {
+	mongoClient := newTestDatabase(t)
+	inventoryItemsRepository := data.NewInventoryItemsRepository(mongoClient, testDatabase, 0)
+	processedMessagesRepository := data.NewProcessedMessagesRepository(mongoClient, testDatabase)
+
+	consumer := NewSubtractItemsConsumer(inventoryItemsRepository, processedMessagesRepository, "test", ConsumerOptions{}, newTestConsumer(1).logger)
+	subtractedPublisher := &testEventPublisher{}
+	rejectedPublisher := &testEventPublisher{}
+	consumer.subtractedPublisher = subtractedPublisher
+	consumer.rejectedPublisher = rejectedPublisher
+
+	ctx := context.Background()
+	catalogItemID := primitive.NewObjectID()
+	subtractMessageID := primitive.NewObjectID()
+	rejectedMessageID := primitive.NewObjectID()
+
+	_, _, err := inventoryItemsRepository.Grant(ctx, 1, catalogItemID, 3, time.Time{}, data.HTTPSource(1), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName         string
+		messageID        primitive.ObjectID
+		quantity         int64
+		grantBefore      int64
+		wantedPermanent  bool
+		wantedSubtracted bool
+		wantedRejected   bool
+		wantedQuantity   int64
+	}{
+		{"Subtract", subtractMessageID, 2, 0, false, true, false, 1},
+		{"Message delivered again", subtractMessageID, 2, 0, false, true, false, 1},
+		{"Insufficient quantity", rejectedMessageID, 2, 0, false, false, true, 1},
+		{"Rejected message delivered again once the user owns enough items", rejectedMessageID, 2, 2, false, false, true, 3},
+		{"Invalid command", primitive.NewObjectID(), 0, 0, true, false, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			if tt.grantBefore != 0 {
+				_, _, err := inventoryItemsRepository.Grant(ctx, 1, catalogItemID, tt.grantBefore, time.Time{}, data.HTTPSource(1), nil, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			subtractedBefore := len(subtractedPublisher.events)
+			rejectedBefore := len(rejectedPublisher.events)
+			correlationID := primitive.NewObjectID()
+
+			command := events.SubtractItemsCommand{UserID: 1, CatalogItemID: catalogItemID, Quantity: tt.quantity, CorrelationID: correlationID}
+
+			err := consumer.handleCommand(ctx, command, tt.messageID)
+
+			var permanentErr *permanentError
+
+			switch {
+			case tt.wantedPermanent && !errors.As(err, &permanentErr):
+				t.Fatalf("want permanent error, but got %v", err)
+			case !tt.wantedPermanent && err != nil:
+				t.Fatal(err)
+			}
+
+			if subtracted := len(subtractedPublisher.events) > subtractedBefore; subtracted != tt.wantedSubtracted {
+				t.Errorf("want subtracted reply to be published to be %t, but got %t", tt.wantedSubtracted, subtracted)
+			}
+
+			rejected := len(rejectedPublisher.events) > rejectedBefore
+			if rejected != tt.wantedRejected {
+				t.Errorf("want rejected reply to be published to be %t, but got %t", tt.wantedRejected, rejected)
+			}
+
+			if rejected {
+				event := rejectedPublisher.events[len(rejectedPublisher.events)-1].(events.InventoryItemsSubtractRejectedEvent)
+				if event.CorrelationID != correlationID || event.Reason == "" {
+					t.Errorf("want rejected reply with correlation id %s and a reason, but got %+v", correlationID.Hex(), event)
+				}
+			}
+
+			item, err := inventoryItemsRepository.GetByFilter(ctx, bson.M{"user_id": 1, "catalog_item_id": catalogItemID})
+			if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+				t.Fatal(err)
+			}
+
+			if item.Quantity != tt.wantedQuantity {
+				t.Errorf("want quantity to be %d, but got %d", tt.wantedQuantity, item.Quantity)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package rabbitmq
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/configuration"
+	"github.com/PlayEconomy37/Play.Common/events"
+	"github.com/PlayEconomy37/Play.Common/logger"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// minReconnectBackoff is the maximum time the supervisor waits before its first reconnection attempt
+	minReconnectBackoff = time.Second
+
+	// maxReconnectBackoff is the maximum time the supervisor waits between two reconnection attempts
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// Supervisor owns our RabbitMQ connection. It reconnects whenever the connection closes,
+// declares the topology of every registered consumer and keeps the consumers running.
+type Supervisor struct {
+	config    *configuration.Config
+	consumers []Consumer
+	logger    *logger.Logger
+	connected atomic.Bool
+	random    *rand.Rand
+}
+
+// NewSupervisor returns a new Supervisor which connects to RabbitMQ using the given configuration
+func NewSupervisor(config *configuration.Config, logger *logger.Logger) *Supervisor {
+	return &Supervisor{
+		config: config,
+		logger: logger,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// RegisterConsumer adds a consumer to the consumers managed by the supervisor.
+// Consumers must be registered before starting the supervisor.
+func (supervisor *Supervisor) RegisterConsumer(consumer Consumer) {
+	supervisor.consumers = append(supervisor.consumers, consumer)
+}
+
+// IsConnected returns whether the supervisor is currently connected to RabbitMQ
+func (supervisor *Supervisor) IsConnected() bool {
+	return supervisor.connected.Load()
+}
+
+// Start connects to RabbitMQ and starts every registered consumer, reconnecting with a jittered
+// exponential backoff whenever the connection closes. It blocks until the given context is canceled,
+// at which point it stops every consumer, waits for the messages being handled and closes the connection.
+func (supervisor *Supervisor) Start(ctx context.Context) {
+	backoff := minReconnectBackoff
+
+	for ctx.Err() == nil {
+		conn, err := supervisor.connect()
+		if err != nil {
+			supervisor.logger.Error(err, map[string]string{"backoff": backoff.String()})
+
+			select {
+			case <-time.After(supervisor.jitter(backoff)):
+			case <-ctx.Done():
+				return
+			}
+
+			backoff = nextBackoff(backoff)
+
+			continue
+		}
+
+		backoff = minReconnectBackoff
+
+		supervisor.logger.Info("Connected to RabbitMQ", nil)
+		supervisor.connected.Store(true)
+
+		// Keep consumers running until the connection closes or we are stopped
+		supervisor.superviseConsumers(ctx, conn)
+
+		supervisor.connected.Store(false)
+
+		if ctx.Err() != nil {
+			err = conn.Close()
+			if err != nil && err != amqp.ErrClosed {
+				supervisor.logger.Error(err, nil)
+			}
+
+			supervisor.logger.Info("Closed connection to RabbitMQ", nil)
+
+			return
+		}
+
+		supervisor.logger.Warning("Lost connection to RabbitMQ, reconnecting", nil)
+	}
+}
+
+// jitter returns a random duration up to the given backoff so that all of our instances
+// do not reconnect at the same time
+func (supervisor *Supervisor) jitter(backoff time.Duration) time.Duration {
+	return time.Duration(supervisor.random.Int63n(int64(backoff)))
+}
+
+// nextBackoff returns the backoff which follows the given one, doubling it up to maxReconnectBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+
+	return backoff
+}
+
+// connect opens a new connection to RabbitMQ and declares the topology of every registered consumer
+func (supervisor *Supervisor) connect() (*amqp.Connection, error) {
+	conn, err := events.NewRabbitMQConnection(supervisor.config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Declare exchanges, create channels and queues, and bind them
+	for _, consumer := range supervisor.consumers {
+		err = consumer.CreateChannel(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// superviseConsumers runs every registered consumer on the given connection and restarts the ones
+// whose channel closes. It returns once the connection is closed or the given context is canceled,
+// and every consumer has stopped.
+func (supervisor *Supervisor) superviseConsumers(ctx context.Context, conn *amqp.Connection) {
+	closeNotifications := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	var wg sync.WaitGroup
+
+	for _, consumer := range supervisor.consumers {
+		wg.Add(1)
+
+		go func(consumer Consumer) {
+			defer wg.Done()
+
+			for ctx.Err() == nil && !conn.IsClosed() {
+				err := consumer.StartConsumer(ctx, conn)
+
+				// Consumers only stop on their own when their channel closes. We restart them
+				// unless the whole connection closed, in which case we reconnect first.
+				if err != nil && !conn.IsClosed() {
+					supervisor.logger.Error(err, nil)
+
+					select {
+					case <-time.After(minReconnectBackoff):
+					case <-ctx.Done():
+					}
+				}
+			}
+		}(consumer)
+	}
+
+	// Wait for the connection to close or for the supervisor to be stopped
+	select {
+	case err, ok := <-closeNotifications:
+		if ok && err != nil {
+			supervisor.logger.Error(err, nil)
+		}
+	case <-ctx.Done():
+	}
+
+	wg.Wait()
+}
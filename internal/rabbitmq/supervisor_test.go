@@ -0,0 +1,192 @@
+package rabbitmq
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/configuration"
+	"github.com/PlayEconomy37/Play.Common/logger"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testConsumerStart holds the connection and the channel used by a start of a testSupervisedConsumer
+type testConsumerStart struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+// testSupervisedConsumer counts the declarations of its topology and its starts,
+// and hands the connection and channel of every start to the test
+type testSupervisedConsumer struct {
+	mutex        sync.Mutex
+	declarations int
+	starts       int
+	started      chan testConsumerStart
+}
+
+// CreateChannel records that the topology of the consumer was declared
+func (c *testSupervisedConsumer) CreateChannel(conn *amqp.Connection) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.declarations++
+
+	return nil
+}
+
+// StartConsumer opens a channel and waits for it to close or for the context to be canceled
+func (c *testSupervisedConsumer) StartConsumer(ctx context.Context, conn *amqp.Connection) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	closeNotifications := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.mutex.Lock()
+	c.starts++
+	c.mutex.Unlock()
+
+	c.started <- testConsumerStart{conn: conn, channel: channel}
+
+	select {
+	case <-closeNotifications:
+		return errChannelClosed
+	case <-ctx.Done():
+		channel.Close()
+		return nil
+	}
+}
+
+// counts returns the number of declarations and starts of the consumer
+func (c *testSupervisedConsumer) counts() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.declarations, c.starts
+}
+
+// nextStart returns the connection and channel used by the next start of the consumer
+func (c *testSupervisedConsumer) nextStart(t *testing.T) testConsumerStart {
+	select {
+	case start := <-c.started:
+		return start
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for consumer to start")
+		return testConsumerStart{}
+	}
+}
+
+func TestSupervisorRecovers(t *testing.T) {
+	config, err := configuration.LoadConfig("../../config/dev.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	supervisor := NewSupervisor(config, logger.New(io.Discard, logger.LevelOff))
+	consumer := &testSupervisedConsumer{started: make(chan testConsumerStart, 10)}
+	supervisor.RegisterConsumer(consumer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan struct{})
+
+	go func() {
+		supervisor.Start(ctx)
+		close(stopped)
+	}()
+
+	start := consumer.nextStart(t)
+
+	if !supervisor.IsConnected() {
+		t.Error("want supervisor to be connected")
+	}
+
+	// A closed channel only restarts its consumer
+	err = start.channel.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restart := consumer.nextStart(t)
+
+	if restart.conn != start.conn {
+		t.Error("want consumer to be restarted on the same connection")
+	}
+
+	if declarations, starts := consumer.counts(); declarations != 1 || starts != 2 {
+		t.Errorf("want topology to be declared once and consumer to be started twice, but got %d declarations and %d starts", declarations, starts)
+	}
+
+	// A closed connection is reopened, and its topology is declared again before consumers restart
+	err = restart.conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconnect := consumer.nextStart(t)
+
+	if reconnect.conn == restart.conn {
+		t.Error("want consumer to be restarted on a new connection")
+	}
+
+	if declarations, starts := consumer.counts(); declarations != 2 || starts != 3 {
+		t.Errorf("want topology to be declared twice and consumer to be started 3 times, but got %d declarations and %d starts", declarations, starts)
+	}
+
+	// Stopping the supervisor stops its consumers and closes its connection
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for supervisor to stop")
+	}
+
+	if supervisor.IsConnected() {
+		t.Error("want supervisor to be disconnected")
+	}
+
+	if !reconnect.conn.IsClosed() {
+		t.Error("want connection to be closed")
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	supervisor := NewSupervisor(nil, logger.New(io.Discard, logger.LevelOff))
+
+	backoff := minReconnectBackoff
+
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff = nextBackoff(backoff)
+
+		if backoff > maxReconnectBackoff {
+			t.Fatalf("want backoff to be at most %v, but got %v", maxReconnectBackoff, backoff)
+		}
+	}
+
+	if backoff != maxReconnectBackoff {
+		t.Errorf("want backoff to reach %v, but got %v", maxReconnectBackoff, backoff)
+	}
+
+	// Delays are spread between zero and the backoff
+	delays := make(map[time.Duration]bool)
+
+	for i := 0; i < 100; i++ {
+		delay := supervisor.jitter(backoff)
+		if delay < 0 || delay >= backoff {
+			t.Fatalf("want delay between 0 and %v, but got %v", backoff, delay)
+		}
+
+		delays[delay] = true
+	}
+
+	if len(delays) < 2 {
+		t.Errorf("want delays to be jittered, but always got %v", delays)
+	}
+}
@@ -0,0 +1,51 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PlayEconomy37/Play.Inventory/internal/constants"
+	"github.com/PlayEconomy37/Play.Inventory/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testDatabase is a constant that defines the name of the database we use when we run tests
+const testDatabase = constants.Database + "_rabbitmq_test"
+
+// newTestDatabase connects to MongoDB and creates the collections of our test database,
+// which is dropped once the test ends
+func newTestDatabase(t *testing.T) *mongo.Client {
+	return testutils.NewTestDatabase(t, testDatabase)
+}
+
+// testEventPublisher records the events published by consumers to reply to the sender of their messages
+type testEventPublisher struct {
+	events []any
+}
+
+// CreateChannel does nothing since the stub does not use RabbitMQ
+func (p *testEventPublisher) CreateChannel(conn *amqp.Connection) error {
+	return nil
+}
+
+// Publish records the given event
+func (p *testEventPublisher) Publish(ctx context.Context, event any) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+// counterValue returns the current value of the given Prometheus counter
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+
+	err := counter.Write(&metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
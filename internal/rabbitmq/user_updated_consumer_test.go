@@ -0,0 +1,122 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/PlayEconomy37/Play.Common/events"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+)
+
+func TestUserUpdatedConsumerHandleEvent(t *testing.T) {
+	usersRepository := data.NewUsersRepository(newTestDatabase(t), testDatabase)
+	consumer := NewUserUpdatedConsumer(usersRepository, "test", ConsumerOptions{}, newTestConsumer(1).logger)
+	staleEvents := staleEventsTotal.WithLabelValues(consumer.queueName)
+
+	tests := []struct {
+		testName            string
+		event               events.UserUpdatedEvent
+		wantedStale         bool
+		wantedPermissions   []string
+		wantedActivated     bool
+		wantedStoredVersion int32
+	}{
+		{"Create user", events.UserUpdatedEvent{ID: 1, Permissions: []string{"inventory:read", "inventory:write"}, Activated: true, Version: 2}, false, []string{"inventory:read", "inventory:write"}, true, 2},
+		{"Older version", events.UserUpdatedEvent{ID: 1, Permissions: []string{}, Activated: false, Version: 1}, true, []string{"inventory:read", "inventory:write"}, true, 2},
+		{"Same version", events.UserUpdatedEvent{ID: 1, Permissions: []string{}, Activated: false, Version: 2}, true, []string{"inventory:read", "inventory:write"}, true, 2},
+		{"Revoke permission", events.UserUpdatedEvent{ID: 1, Permissions: []string{"inventory:read"}, Activated: true, Version: 3}, false, []string{"inventory:read"}, true, 3},
+		{"Revoke every permission", events.UserUpdatedEvent{ID: 1, Activated: true, Version: 4}, false, []string{}, true, 4},
+		{"Deactivate user", events.UserUpdatedEvent{ID: 1, Permissions: []string{"inventory:read"}, Activated: false, Version: 6}, false, []string{"inventory:read"}, false, 6},
+		{"Delayed activation", events.UserUpdatedEvent{ID: 1, Permissions: []string{"inventory:read"}, Activated: true, Version: 5}, true, []string{"inventory:read"}, false, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			staleBefore := counterValue(t, staleEvents)
+
+			err := consumer.handleEvent(context.Background(), tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantedStaleEvents := staleBefore
+			if tt.wantedStale {
+				wantedStaleEvents++
+			}
+
+			if staleAfter := counterValue(t, staleEvents); staleAfter != wantedStaleEvents {
+				t.Errorf("want stale_events_total to be %v, but got %v", wantedStaleEvents, staleAfter)
+			}
+
+			user, err := usersRepository.GetByID(context.Background(), tt.event.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.Version != tt.wantedStoredVersion {
+				t.Errorf("want version %d, but got %d", tt.wantedStoredVersion, user.Version)
+			}
+
+			if user.Activated != tt.wantedActivated {
+				t.Errorf("want activated to be %t, but got %t", tt.wantedActivated, user.Activated)
+			}
+
+			if len(user.Permissions) != len(tt.wantedPermissions) {
+				t.Fatalf("want permissions %v, but got %v", tt.wantedPermissions, user.Permissions)
+			}
+
+			for i := range user.Permissions {
+				if user.Permissions[i] != tt.wantedPermissions[i] {
+					t.Errorf("want permissions %v, but got %v", tt.wantedPermissions, user.Permissions)
+				}
+			}
+		})
+	}
+}
+
+func TestUserUpdatedConsumerReplacesPermissions(t *testing.T) {
+	usersRepository := data.NewUsersRepository(newTestDatabase(t), testDatabase)
+	consumer := NewUserUpdatedConsumer(usersRepository, "test", ConsumerOptions{}, newTestConsumer(1).logger)
+
+	// Identity service publishes the whole user, with null permissions when the user has none
+	tests := []struct {
+		testName string
+		userID   int64
+		body     string
+	}{
+		{"Null permissions", 1, `{"id":1,"email":"a@b.com","permissions":null,"activated":true,"version":2}`},
+		{"Empty permissions", 2, `{"id":2,"email":"b@b.com","permissions":[],"activated":true,"version":2}`},
+		{"Missing permissions", 3, `{"id":3,"email":"c@b.com","activated":true,"version":2}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			err := consumer.handleEvent(context.Background(), events.UserUpdatedEvent{ID: tt.userID, Permissions: []string{"inventory:read"}, Activated: true, Version: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var event events.UserUpdatedEvent
+
+			err = json.Unmarshal([]byte(tt.body), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = consumer.handleEvent(context.Background(), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := usersRepository.GetByID(context.Background(), tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.Permissions == nil || len(user.Permissions) != 0 {
+				t.Errorf("want permissions to be revoked, but got %v", user.Permissions)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package settings
+
+import (
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
+)
+
+const (
+	// defaultConsumerWorkers is the number of messages a consumer handles in parallel by default
+	defaultConsumerWorkers = 10
+
+	// defaultConsumerPrefetch is the number of unacknowledged messages RabbitMQ delivers
+	// to a consumer by default
+	defaultConsumerPrefetch = 50
+)
+
+// Settings is a struct that holds the configuration specific to the Inventory microservice.
+// Configuration shared by all of our microservices is read by the common configuration package.
+type Settings struct {
+	Consumers struct {
+		Workers  int `koanf:"Workers"`
+		Prefetch int `koanf:"Prefetch"`
+	} `koanf:"Consumers"`
+	Inventory struct {
+		// SlotCapacity is the number of distinct catalog items an user can own. Inventories are not limited when it is 0.
+		SlotCapacity int `koanf:"SlotCapacity"`
+	} `koanf:"Inventory"`
+}
+
+// LoadSettings reads settings from a given file and from environment variables
+// (i.e. Consumers__Workers=...). Missing settings are set to their default value.
+// Negative slot capacities are treated as 0.
+func LoadSettings(filePath string) (*Settings, error) {
+	var settings Settings
+
+	settingsReader := koanf.New(".")
+
+	// Load JSON settings
+	if err := settingsReader.Load(file.Provider(filePath), json.Parser()); err != nil {
+		return nil, err
+	}
+
+	// Load environment variables and merge into the loaded settings
+	settingsReader.Load(
+		env.Provider(
+			"",
+			"__",
+			nil,
+		),
+		nil,
+	)
+
+	err := settingsReader.Unmarshal("", &settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Consumers.Workers <= 0 {
+		settings.Consumers.Workers = defaultConsumerWorkers
+	}
+
+	if settings.Consumers.Prefetch <= 0 {
+		settings.Consumers.Prefetch = defaultConsumerPrefetch
+	}
+
+	if settings.Inventory.SlotCapacity < 0 {
+		settings.Inventory.SlotCapacity = 0
+	}
+
+	return &settings, nil
+}
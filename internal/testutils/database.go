@@ -0,0 +1,63 @@
+// Package testutils holds the helpers shared by the tests of our packages
+package testutils
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/PlayEconomy37/Play.Common/configuration"
+	"github.com/PlayEconomy37/Play.Common/database"
+	"github.com/PlayEconomy37/Play.Inventory/internal/data"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewTestDatabase connects to MongoDB using our development configuration and creates the collections
+// of the given test database, which is dropped once the test ends
+func NewTestDatabase(t *testing.T, databaseName string) *mongo.Client {
+	// Our configuration is found relative to this file so that tests of any package can use it
+	_, file, _, _ := runtime.Caller(0)
+
+	config, err := configuration.LoadConfig(filepath.Join(filepath.Dir(file), "..", "..", "config", "dev.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mongoClient, err := database.NewMongoClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createCollections := []func(client *mongo.Client, databaseName string) error{
+		database.CreateUsersCollection,
+		data.CreateCatalogItemsCollection,
+		data.CreateInventoryItemsCollection,
+		data.CreateOutboxMessagesCollection,
+		data.CreateReservationsCollection,
+		data.CreateTransfersCollection,
+		data.CreateLedgerEntriesCollection,
+		data.CreateProcessedMessagesCollection,
+	}
+
+	for _, createCollection := range createCollections {
+		err = createCollection(mongoClient, databaseName)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		mongoClient.Database(databaseName).Drop(ctx)
+
+		if err := mongoClient.Disconnect(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return mongoClient
+}